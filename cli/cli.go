@@ -3,22 +3,149 @@ package cli
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
 	"strings"
-	"yourproject/store"
+	"time"
+
+	"json-key-value-store/store"
 )
 
-// RunCLI starts the Command-Line Interface for the JSON Key-Value Store.
-func RunCLI() {
+// keyValueStore is the set of operations the CLI runs against the selected namespace.
+type keyValueStore interface {
+	Create(key, value string) error
+	Read(key string) (string, error)
+	ReadPath(key, path string) (string, error)
+	Update(key, value string) error
+	Delete(key string) error
+	Expire(key string, ttl time.Duration) error
+	TTL(key string) (time.Duration, error)
+	Persist(key string) error
+	Txn(fn func(tx *store.Tx) error) error
+	History(key string) ([]store.HistoryEntry, error)
+	Revert(key string, rev uint64) (uint64, error)
+	Find(q store.Query) ([]store.Document, error)
+}
+
+// author returns the name the CLI's writes are attributed to in key histories.
+func author() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "cli"
+}
+
+// pendingOp is a write queued between `begin` and `commit`.
+type pendingOp struct {
+	op    string // "create", "update" or "delete"
+	key   string
+	value string
+}
+
+// commitPending applies queued writes to db in a single transaction.
+func commitPending(db keyValueStore, ops []pendingOp) error {
+	return db.Txn(func(tx *store.Tx) error {
+		for _, op := range ops {
+			var err error
+			switch op.op {
+			case "create":
+				err = tx.Create(op.key, op.value)
+			case "update":
+				err = tx.Update(op.key, op.value)
+			case "delete":
+				err = tx.Delete(op.key)
+			}
+			if err != nil {
+				return fmt.Errorf("%s '%s': %w", op.op, op.key, err)
+			}
+		}
+		return nil
+	})
+}
+
+// parseFindArgs parses the arguments of `find`: a filter document, followed by
+// options such as sort=-age,name, skip=10, limit=5 and fields=name,email. Fields to
+// leave out of the results are prefixed with '-', e.g. fields=-password.
+func parseFindArgs(input string) (store.Query, error) {
+	var query store.Query
+
+	dec := json.NewDecoder(strings.NewReader(input))
+	if err := dec.Decode(&query.Filter); err != nil {
+		return query, fmt.Errorf("filter must be a JSON object: %w", err)
+	}
+	for _, opt := range strings.Fields(input[dec.InputOffset():]) {
+		name, value, found := strings.Cut(opt, "=")
+		if !found || value == "" {
+			return query, fmt.Errorf("invalid option '%s'", opt)
+		}
+		var err error
+		switch name {
+		case "sort":
+			query.Sort = strings.Split(value, ",")
+		case "skip":
+			query.Skip, err = strconv.Atoi(value)
+		case "limit":
+			query.Limit, err = strconv.Atoi(value)
+		case "fields":
+			query.Projection = make(store.Projection)
+			for _, field := range strings.Split(value, ",") {
+				name, exclude := strings.CutPrefix(field, "-")
+				query.Projection[name] = !exclude
+			}
+		default:
+			return query, fmt.Errorf("unknown option '%s'", name)
+		}
+		if err != nil {
+			return query, fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	return query, nil
+}
+
+// defaultNamespace is the name `use` accepts to switch back to the default key space.
+const defaultNamespace = "default"
+
+// RunCLI opens the store at path with store.Open, so no other process can use it
+// meanwhile, and starts the Command-Line Interface for the JSON Key-Value Store on it
+// and its namespaces. The store is closed however the CLI exits: on `exit`, at the end
+// of its input, or on a read error.
+func RunCLI(path string, opts ...store.Option) (err error) {
+	root, err := store.Open(path, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to open store: %w", err)
+	}
+	// However the CLI exits, save anything the durability policy has not saved yet
+	// and release the lock
+	defer func() {
+		if closeErr := root.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to close store: %w", closeErr)
+		}
+	}()
+
 	fmt.Println("Welcome to the JSON Key-Value Store CLI!")
 	fmt.Println("Type 'help' for a list of commands or 'exit' to quit.")
 
 	// Create a scanner to read user input from the terminal
 	scanner := bufio.NewScanner(os.Stdin)
 
+	// Commands run against the default key space until `use` selects a namespace
+	who := author()
+	var db keyValueStore = root.As(who)
+	namespace := defaultNamespace
+
+	// Writes are queued instead of applied while a transaction is open
+	var pending []pendingOp
+	inTxn := false
+
 	for {
-		// Prompt the user for input
+		// Prompt the user for input, showing the selected namespace
+		if namespace != defaultNamespace {
+			fmt.Printf("[%s] ", namespace)
+		}
 		fmt.Print("Enter command: ")
 		if !scanner.Scan() {
 			if err := scanner.Err(); err != nil {
@@ -53,7 +180,12 @@ func RunCLI() {
 			}
 			key := args[1]
 			json := strings.Join(args[2:], " ") // Combine remaining args into JSON string
-			err := store.CreateJSON(key, json)
+			if inTxn {
+				pending = append(pending, pendingOp{op: "create", key: key, value: json})
+				fmt.Printf("Queued create of '%s'.\n", key)
+				continue
+			}
+			err := db.Create(key, json)
 			if err != nil {
 				fmt.Printf("Error creating JSON: %v\n", err)
 			} else {
@@ -63,11 +195,22 @@ func RunCLI() {
 		case "read":
 			// Handle JSON reading
 			if len(args) < 2 {
-				fmt.Println("Usage: read <key>")
+				fmt.Println("Usage: read <key> [path]")
 				continue
 			}
 			key := args[1]
-			json, err := store.ReadJSON(key)
+			if len(args) > 2 {
+				// Read only the part of the document at a path such as .address.city
+				path := strings.Join(args[2:], " ")
+				part, err := db.ReadPath(key, path)
+				if err != nil {
+					fmt.Printf("Error reading JSON: %v\n", err)
+				} else {
+					fmt.Printf("JSON at '%s' for key '%s':\n%s\n", path, key, part)
+				}
+				continue
+			}
+			json, err := db.Read(key)
 			if err != nil {
 				fmt.Printf("Error reading JSON: %v\n", err)
 			} else {
@@ -82,7 +225,12 @@ func RunCLI() {
 			}
 			key := args[1]
 			json := strings.Join(args[2:], " ") // Combine remaining args into JSON string
-			err := store.UpdateJSON(key, json)
+			if inTxn {
+				pending = append(pending, pendingOp{op: "update", key: key, value: json})
+				fmt.Printf("Queued update of '%s'.\n", key)
+				continue
+			}
+			err := db.Update(key, json)
 			if err != nil {
 				fmt.Printf("Error updating JSON: %v\n", err)
 			} else {
@@ -96,24 +244,423 @@ func RunCLI() {
 				continue
 			}
 			key := args[1]
-			err := store.DeleteJSON(key)
+			if inTxn {
+				pending = append(pending, pendingOp{op: "delete", key: key})
+				fmt.Printf("Queued delete of '%s'.\n", key)
+				continue
+			}
+			err := db.Delete(key)
 			if err != nil {
 				fmt.Printf("Error deleting JSON: %v\n", err)
 			} else {
 				fmt.Printf("JSON with key '%s' deleted successfully!\n", key)
 			}
 
+		case "find":
+			// Handle querying documents with a filter and options
+			if len(args) < 2 {
+				fmt.Println("Usage: find <filter> [sort=<fields>] [skip=<n>] [limit=<n>] [fields=<fields>]")
+				continue
+			}
+			query, err := parseFindArgs(strings.Join(args[1:], " "))
+			if err != nil {
+				fmt.Printf("Invalid query: %v\n", err)
+				continue
+			}
+			docs, err := db.Find(query)
+			if err != nil {
+				fmt.Printf("Error finding documents: %v\n", err)
+				continue
+			}
+			for _, doc := range docs {
+				fmt.Printf("  %s: %s\n", doc.Key, doc.Value)
+			}
+			fmt.Printf("%d document(s) found.\n", len(docs))
+
+		case "expire":
+			// Handle setting a TTL
+			if len(args) < 3 {
+				fmt.Println("Usage: expire <key> <seconds|duration>")
+				continue
+			}
+			key := args[1]
+			ttl, err := time.ParseDuration(args[2])
+			if err != nil {
+				seconds, convErr := strconv.Atoi(args[2])
+				if convErr != nil {
+					fmt.Printf("Invalid ttl '%s': use seconds or a duration such as 90s or 1h\n", args[2])
+					continue
+				}
+				ttl = time.Duration(seconds) * time.Second
+			}
+			err = db.Expire(key, ttl)
+			if err != nil {
+				fmt.Printf("Error setting TTL: %v\n", err)
+			} else {
+				fmt.Printf("Key '%s' will expire in %s.\n", key, ttl)
+			}
+
+		case "ttl":
+			// Handle TTL lookup
+			if len(args) < 2 {
+				fmt.Println("Usage: ttl <key>")
+				continue
+			}
+			key := args[1]
+			ttl, err := db.TTL(key)
+			if err != nil {
+				fmt.Printf("Error reading TTL: %v\n", err)
+			} else if ttl == store.NoExpiry {
+				fmt.Printf("Key '%s' does not expire.\n", key)
+			} else {
+				fmt.Printf("Key '%s' expires in %s.\n", key, ttl.Round(time.Second))
+			}
+
+		case "persist":
+			// Handle TTL removal
+			if len(args) < 2 {
+				fmt.Println("Usage: persist <key>")
+				continue
+			}
+			key := args[1]
+			err := db.Persist(key)
+			if err != nil {
+				fmt.Printf("Error removing TTL: %v\n", err)
+			} else {
+				fmt.Printf("Key '%s' will no longer expire.\n", key)
+			}
+
+		case "begin":
+			// Handle starting a transaction
+			if inTxn {
+				fmt.Println("A transaction is already open. Use 'commit' or 'rollback' first.")
+				continue
+			}
+			inTxn, pending = true, nil
+			fmt.Println("Transaction started. Writes are queued until 'commit'.")
+
+		case "commit":
+			// Handle committing a transaction
+			if !inTxn {
+				fmt.Println("No transaction is open. Use 'begin' to start one.")
+				continue
+			}
+			err := commitPending(db, pending)
+			inTxn, pending = false, nil
+			if err != nil {
+				fmt.Printf("Transaction rolled back: %v\n", err)
+			} else {
+				fmt.Println("Transaction committed successfully!")
+			}
+
+		case "rollback":
+			// Handle discarding a transaction
+			if !inTxn {
+				fmt.Println("No transaction is open.")
+				continue
+			}
+			fmt.Printf("Transaction rolled back; %d queued write(s) discarded.\n", len(pending))
+			inTxn, pending = false, nil
+
+		case "history":
+			// Handle history listing
+			if len(args) < 2 {
+				fmt.Println("Usage: history <key>")
+				continue
+			}
+			entries, err := db.History(args[1])
+			if err != nil {
+				fmt.Printf("Error reading history: %v\n", err)
+				continue
+			}
+			for _, e := range entries {
+				by := e.Author
+				if by == "" {
+					by = "unknown"
+				}
+				value := e.Value
+				if e.Deleted {
+					value = "(deleted)"
+				}
+				fmt.Printf("  %d  %s  %s  %s\n", e.Revision, e.Time.Local().Format(time.RFC3339), by, value)
+			}
+
+		case "revert":
+			// Handle reverting a key to an earlier revision
+			if len(args) < 3 {
+				fmt.Println("Usage: revert <key> <revision>")
+				continue
+			}
+			if inTxn {
+				fmt.Println("Commit or roll back the open transaction before reverting.")
+				continue
+			}
+			rev, err := strconv.ParseUint(args[2], 10, 64)
+			if err != nil {
+				fmt.Printf("Invalid revision: %v\n", err)
+				continue
+			}
+			if _, err := db.Revert(args[1], rev); err != nil {
+				fmt.Printf("Error reverting key: %v\n", err)
+			} else {
+				fmt.Printf("Key '%s' reverted to revision %d.\n", args[1], rev)
+			}
+
+		case "use":
+			// Handle namespace selection
+			if len(args) < 2 {
+				fmt.Println("Usage: use <namespace>")
+				continue
+			}
+			if inTxn {
+				fmt.Println("Commit or roll back the open transaction before switching namespaces.")
+				continue
+			}
+			if args[1] == defaultNamespace {
+				db, namespace = root.As(who), defaultNamespace
+				fmt.Println("Using the default namespace.")
+				continue
+			}
+			ns, err := root.Namespace(args[1])
+			if err != nil {
+				fmt.Printf("Error selecting namespace: %v\n", err)
+				continue
+			}
+			db, namespace = ns.As(who), args[1]
+			fmt.Printf("Using namespace '%s'.\n", namespace)
+
+		case "namespaces":
+			// Handle namespace listing
+			names, err := root.Namespaces()
+			if err != nil {
+				fmt.Printf("Error listing namespaces: %v\n", err)
+				continue
+			}
+			fmt.Printf("  %s\n", defaultNamespace)
+			for _, name := range names {
+				fmt.Printf("  %s\n", name)
+			}
+
+		case "create-namespace":
+			// Handle namespace creation
+			if len(args) < 2 {
+				fmt.Println("Usage: create-namespace <namespace>")
+				continue
+			}
+			if _, err := root.CreateNamespace(args[1]); err != nil {
+				fmt.Printf("Error creating namespace: %v\n", err)
+			} else {
+				fmt.Printf("Namespace '%s' created successfully!\n", args[1])
+			}
+
+		case "drop-namespace":
+			// Handle namespace deletion
+			if len(args) < 2 {
+				fmt.Println("Usage: drop-namespace <namespace>")
+				continue
+			}
+			if err := root.DropNamespace(args[1]); err != nil {
+				fmt.Printf("Error dropping namespace: %v\n", err)
+				continue
+			}
+			if args[1] == namespace {
+				db, namespace = root.As(who), defaultNamespace
+			}
+			fmt.Printf("Namespace '%s' dropped successfully!\n", args[1])
+
+		case "snapshot":
+			// Handle snapshot creation
+			if len(args) < 2 {
+				fmt.Println("Usage: snapshot <name>")
+				continue
+			}
+			name := args[1]
+			err := root.Snapshot(name)
+			if err != nil {
+				fmt.Printf("Error creating snapshot: %v\n", err)
+			} else {
+				fmt.Printf("Snapshot '%s' created successfully!\n", name)
+			}
+
+		case "restore":
+			// Handle snapshot restore
+			if len(args) < 2 {
+				fmt.Println("Usage: restore <name>")
+				continue
+			}
+			name := args[1]
+			err := root.Restore(name)
+			if err != nil {
+				fmt.Printf("Error restoring snapshot: %v\n", err)
+			} else {
+				fmt.Printf("Snapshot '%s' restored successfully!\n", name)
+			}
+
+		case "snapshots":
+			// Handle snapshot listing
+			snapshots, err := root.ListSnapshots()
+			if err != nil {
+				fmt.Printf("Error listing snapshots: %v\n", err)
+				continue
+			}
+			if len(snapshots) == 0 {
+				fmt.Println("No snapshots found.")
+			}
+			for _, snapshot := range snapshots {
+				fmt.Printf("  %-20s %s  %d bytes\n", snapshot.Name, snapshot.Created.Format("2006-01-02 15:04:05"), snapshot.Size)
+			}
+
+		case "delete-snapshot":
+			// Handle snapshot deletion
+			if len(args) < 2 {
+				fmt.Println("Usage: delete-snapshot <name>")
+				continue
+			}
+			name := args[1]
+			err := root.DeleteSnapshot(name)
+			if err != nil {
+				fmt.Printf("Error deleting snapshot: %v\n", err)
+			} else {
+				fmt.Printf("Snapshot '%s' deleted successfully!\n", name)
+			}
+
+		case "fsck", "repair":
+			// Check the store's data file, or another one, or salvage what can be read from it
+			path := root.Path()
+			if len(args) > 1 {
+				path = args[1]
+			}
+			var opts []store.Option
+			if keys, err := store.KeyringFromEnv(store.DefaultKeyEnv); err == nil {
+				opts = append(opts, store.WithEncryption(keys))
+			}
+
+			if args[0] == "fsck" {
+				report, err := store.Fsck(path, opts...)
+				if err != nil {
+					fmt.Printf("Error checking %s: %v\n", path, err)
+					continue
+				}
+				fmt.Printf("%s: %d entries, %d write-ahead log records\n", path, report.Entries, report.LogRecords)
+				for _, problem := range report.Problems {
+					fmt.Printf("  %s\n", problem)
+				}
+				if report.OK() {
+					fmt.Println("No problems found.")
+				} else {
+					fmt.Printf("%d problems found; run 'repair' to salvage the readable entries.\n", len(report.Problems))
+				}
+				continue
+			}
+
+			// The open store holds its file's lock, so it repairs and reloads itself
+			var report store.RepairReport
+			if filepath.Clean(path) == filepath.Clean(root.Path()) {
+				report, err = root.Repair()
+			} else {
+				report, err = store.Repair(path, opts...)
+			}
+			if err != nil {
+				fmt.Printf("Error repairing %s: %v\n", path, err)
+				continue
+			}
+			if report.Quarantine == "" {
+				fmt.Println("Nothing to repair.")
+				continue
+			}
+			fmt.Printf("Salvaged %d entries; the damaged original was kept as %s\n", report.Salvaged, report.Quarantine)
+
+		case "migrate":
+			// Report what migrating the data file to the current format would change
+			path := root.Path()
+			if len(args) > 1 {
+				path = args[1]
+			}
+			var opts []store.Option
+			if keys, err := store.KeyringFromEnv(store.DefaultKeyEnv); err == nil {
+				opts = append(opts, store.WithEncryption(keys))
+			}
+
+			report, err := store.Migrate(path, true, opts...)
+			if err != nil {
+				fmt.Printf("Error checking %s: %v\n", path, err)
+				continue
+			}
+			if report.From == report.To {
+				fmt.Printf("%s is already in format version %d.\n", path, report.To)
+				continue
+			}
+			fmt.Printf("%s would be migrated from format version %d to %d:\n", path, report.From, report.To)
+			for _, change := range report.Changes {
+				fmt.Printf("  %s\n", change)
+			}
+			fmt.Printf("%d entries: %d values stored as native JSON, %d as strings.\n", report.Entries, report.NativeValues, report.StringValues)
+			fmt.Println("Nothing was changed; the file is migrated the next time the store loads it.")
+
+		case "convert":
+			// Rewrite a data file or snapshot in another format
+			if len(args) < 4 {
+				fmt.Println("Usage: convert <src> <dst> <json|binary>")
+				continue
+			}
+			format, err := store.ParseSnapshotFormat(args[3])
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			var opts []store.Option
+			if keys, err := store.KeyringFromEnv(store.DefaultKeyEnv); err == nil {
+				opts = append(opts, store.WithEncryption(keys))
+			}
+			if err := store.ConvertSnapshot(args[1], args[2], format, opts...); err != nil {
+				fmt.Printf("Error converting %s: %v\n", args[1], err)
+			} else {
+				fmt.Printf("Converted %s to %s in the %s format.\n", args[1], args[2], format)
+			}
+
+		case "rotate-key":
+			// Handle encryption key rotation
+			id, err := root.RotateKey()
+			if err != nil {
+				fmt.Printf("Error rotating key: %v\n", err)
+			} else {
+				fmt.Printf("Data re-encrypted under new key '%s'.\n", id)
+			}
+
 		case "help":
 			// Display CLI usage instructions
 			fmt.Println("Available commands:")
 			fmt.Println("  create <key> <json>   - Create a new JSON object.")
-			fmt.Println("  read <key>            - Read a JSON object.")
+			fmt.Println("  read <key> [path]     - Read a JSON object, or the part at a path such as .address.city or /address/city.")
 			fmt.Println("  update <key> <json>   - Update an existing JSON object.")
 			fmt.Println("  delete <key>          - Delete a JSON object.")
+			fmt.Println("  find <filter> [sort=-age,name] [skip=n] [limit=n] [fields=name,age] - Find documents matching a filter such as {\"age\": {\"$gt\": 30}}.")
+			fmt.Println("  expire <key> <ttl>    - Expire a key after a number of seconds or a duration.")
+			fmt.Println("  ttl <key>             - Show how long a key has left before it expires.")
+			fmt.Println("  persist <key>         - Stop a key from expiring.")
+			fmt.Println("  history <key>         - List the retained revisions of a key.")
+			fmt.Println("  revert <key> <rev>    - Restore a key to the value it had at a revision.")
+			fmt.Println("  begin                 - Start a transaction; writes are queued until commit.")
+			fmt.Println("  commit                - Apply the queued writes atomically.")
+			fmt.Println("  rollback              - Discard the queued writes.")
+			fmt.Println("  use <namespace>       - Run commands in a namespace ('default' for none).")
+			fmt.Println("  namespaces            - List namespaces.")
+			fmt.Println("  create-namespace <ns> - Create a namespace.")
+			fmt.Println("  drop-namespace <ns>   - Delete a namespace and all of its keys.")
+			fmt.Println("  snapshot <name>       - Save a point-in-time snapshot.")
+			fmt.Println("  restore <name>        - Replace all data with a snapshot.")
+			fmt.Println("  snapshots             - List saved snapshots.")
+			fmt.Println("  delete-snapshot <name> - Delete a snapshot.")
+			fmt.Println("  rotate-key            - Re-encrypt the data under a newly generated key.")
+			fmt.Println("  fsck [file]           - Check the data file for damaged entries.")
+			fmt.Println("  repair [file]         - Salvage readable entries and quarantine a damaged data file.")
+			fmt.Println("  migrate [file]        - Show what migrating the data file to the current format would change.")
+			fmt.Println("  convert <src> <dst> <json|binary> - Rewrite a data file or snapshot in another format.")
 			fmt.Println("  exit                  - Exit the CLI.")
 
 		default:
 			fmt.Println("Invalid command. Type 'help' for a list of available commands.")
 		}
 	}
+	return nil
 }
@@ -0,0 +1,113 @@
+// Package handlers implements the administrative HTTP routes, such as snapshot management
+// and encryption key rotation.
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// ListSnapshotsHandler lists the stored snapshots.
+func (h *Handler) ListSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := h.db.ListSnapshots()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list snapshots: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Send success response
+	response := Response{Message: "Snapshots retrieved", Data: snapshots}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// CreateSnapshotHandler captures a named point-in-time snapshot of the store.
+func (h *Handler) CreateSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := decodeSnapshotName(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.db.Snapshot(name); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create snapshot: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Send success response
+	response := Response{Message: "Snapshot created successfully"}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// RestoreSnapshotHandler replaces the store's data with a named snapshot.
+func (h *Handler) RestoreSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := decodeSnapshotName(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.db.Restore(name); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to restore snapshot: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Send success response
+	response := Response{Message: "Snapshot restored successfully"}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// DeleteSnapshotHandler deletes a named snapshot.
+func (h *Handler) DeleteSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Missing 'name' parameter", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.DeleteSnapshot(name); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete snapshot: %s", err), http.StatusNotFound)
+		return
+	}
+
+	// Send success response
+	response := Response{Message: "Snapshot deleted successfully"}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// RotateKeyHandler switches the store to a newly generated encryption key and
+// re-encrypts the data file under it.
+func (h *Handler) RotateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := h.db.RotateKey()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to rotate key: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Send success response
+	response := Response{Message: "Encryption key rotated successfully", Data: id}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// decodeSnapshotName reads the snapshot name from a JSON request body.
+// It writes an error response and returns false if the name is missing.
+func decodeSnapshotName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var requestData map[string]string
+
+	// Decode the JSON body
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %s", err), http.StatusBadRequest)
+		return "", false
+	}
+	defer r.Body.Close()
+
+	name := requestData["name"]
+	if name == "" {
+		http.Error(w, "Name is a required field", http.StatusBadRequest)
+		return "", false
+	}
+	return name, true
+}
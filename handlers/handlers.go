@@ -3,11 +3,25 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
+
 	"json-key-value-store/store"
 )
 
+// Handler serves the HTTP API for a Store: the default key space and its namespaces.
+type Handler struct {
+	db *store.Store // Store the routes operate on
+}
+
+// NewHandler returns the HTTP handlers for db.
+func NewHandler(db *store.Store) *Handler {
+	return &Handler{db: db}
+}
+
 // Response represents a consistent structure for API responses.
 type Response struct {
 	Message string      `json:"message"`
@@ -15,7 +29,13 @@ type Response struct {
 }
 
 // CreateKeyValueHandler handles the creation of new key-value pairs in the JSON store.
-func CreateKeyValueHandler(w http.ResponseWriter, r *http.Request) {
+// Creating a key that exists fails with 409, or with 412 under "If-None-Match: *".
+func (h *Handler) CreateKeyValueHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := h.storeFor(w, r)
+	if !ok {
+		return
+	}
+
 	var requestData map[string]string
 
 	// Decode the JSON body
@@ -32,21 +52,37 @@ func CreateKeyValueHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Key and value are required fields", http.StatusBadRequest)
 		return
 	}
+	ttl, err := parseTTL(requestData["ttl"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid ttl: %s", err), http.StatusBadRequest)
+		return
+	}
 
-	// Store the key-value pair
-	if err := store.Create(key, value); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create key-value pair: %s", err), http.StatusInternalServerError)
+	// Store the key-value pair, with its expiry if one was requested
+	version, err := db.CreateWithTTL(key, value, ttl)
+	if err != nil {
+		writeStoreError(w, r, "Failed to create key-value pair", err, http.StatusInternalServerError)
 		return
 	}
 
 	// Send success response
 	response := Response{Message: "Key-value pair created successfully"}
+	setETag(w, version)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// ReadKeyValueHandler retrieves a key-value pair by its key from the store.
-func ReadKeyValueHandler(w http.ResponseWriter, r *http.Request) {
+// ReadKeyValueHandler retrieves a key-value pair by its key from the store, with its
+// version as the ETag. If-None-Match naming the current version yields 304. With a
+// 'path' parameter, a JSON Pointer such as /address/city or a JSON path such as
+// $.address.city, only that part of the document is returned, as JSON rather than a
+// string; a path with nothing at it yields 404.
+func (h *Handler) ReadKeyValueHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := h.storeFor(w, r)
+	if !ok {
+		return
+	}
+
 	key := r.URL.Query().Get("key")
 	if key == "" {
 		http.Error(w, "Missing 'key' parameter", http.StatusBadRequest)
@@ -54,20 +90,47 @@ func ReadKeyValueHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Retrieve the value
-	value, err := store.Read(key)
+	value, version, err := db.ReadVersion(key)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Key not found: %s", err), http.StatusNotFound)
 		return
 	}
 
+	var data any = value
+	if r.URL.Query().Has("path") {
+		part, err := store.SelectPath(value, r.URL.Query().Get("path"))
+		if errors.Is(err, store.ErrPathNotFound) {
+			http.Error(w, fmt.Sprintf("Failed to read path: %s", err), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read path: %s", err), http.StatusBadRequest)
+			return
+		}
+		data = json.RawMessage(part)
+	}
+
+	setETag(w, version)
+	if match := r.Header.Get("If-None-Match"); match != "" && matchesETag(match, version) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	// Send success response
-	response := Response{Message: "Key-value pair retrieved", Data: value}
+	response := Response{Message: "Key-value pair retrieved", Data: data}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// UpdateKeyValueHandler updates the value of an existing key in the store.
-func UpdateKeyValueHandler(w http.ResponseWriter, r *http.Request) {
+// UpdateKeyValueHandler updates the value of an existing key in the store. With an
+// If-Match header, the update only applies if the key is still at that version;
+// otherwise it fails with 412.
+func (h *Handler) UpdateKeyValueHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := h.storeFor(w, r)
+	if !ok {
+		return
+	}
+
 	var requestData map[string]string
 
 	// Decode the JSON body
@@ -84,30 +147,55 @@ func UpdateKeyValueHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Key and value are required fields", http.StatusBadRequest)
 		return
 	}
+	ttl, err := parseTTL(requestData["ttl"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid ttl: %s", err), http.StatusBadRequest)
+		return
+	}
+	expected, err := expectedVersion(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid If-Match: %s", err), http.StatusBadRequest)
+		return
+	}
 
-	// Update the key-value pair
-	if err := store.Update(key, value); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to update key-value pair: %s", err), http.StatusInternalServerError)
+	// Update the key-value pair, replacing its expiry if one was requested; otherwise
+	// the key keeps its current TTL
+	version, err := db.CompareAndSwapWithTTL(key, expected, value, ttl)
+	if err != nil {
+		writeStoreError(w, r, "Failed to update key-value pair", err, http.StatusInternalServerError)
 		return
 	}
 
 	// Send success response
 	response := Response{Message: "Key-value pair updated successfully"}
+	setETag(w, version)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// DeleteKeyValueHandler deletes a key-value pair from the store by its key.
-func DeleteKeyValueHandler(w http.ResponseWriter, r *http.Request) {
+// DeleteKeyValueHandler deletes a key-value pair from the store by its key. Like
+// updates, deletes honour If-Match.
+func (h *Handler) DeleteKeyValueHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := h.storeFor(w, r)
+	if !ok {
+		return
+	}
+
 	key := r.URL.Query().Get("key")
 	if key == "" {
 		http.Error(w, "Missing 'key' parameter", http.StatusBadRequest)
 		return
 	}
 
+	expected, err := expectedVersion(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid If-Match: %s", err), http.StatusBadRequest)
+		return
+	}
+
 	// Delete the key-value pair
-	if err := store.Delete(key); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to delete key-value pair: %s", err), http.StatusNotFound)
+	if err := db.DeleteIfVersion(key, expected); err != nil {
+		writeStoreError(w, r, "Failed to delete key-value pair", err, http.StatusNotFound)
 		return
 	}
 
@@ -117,19 +205,92 @@ func DeleteKeyValueHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// SetupRoutes initializes the HTTP server routes.
-func SetupRoutes() {
-	mux := http.NewServeMux()
+// parseTTL parses an optional ttl field, given either as a Go duration ("90s", "1h")
+// or as a whole number of seconds. An empty field means no TTL.
+func parseTTL(field string) (time.Duration, error) {
+	if field == "" {
+		return 0, nil
+	}
 
-	// Register handlers
-	mux.HandleFunc("/create", CreateKeyValueHandler)
-	mux.HandleFunc("/read", ReadKeyValueHandler)
-	mux.HandleFunc("/update", UpdateKeyValueHandler)
-	mux.HandleFunc("/delete", DeleteKeyValueHandler)
+	ttl, err := time.ParseDuration(field)
+	if err != nil {
+		seconds, convErr := strconv.Atoi(field)
+		if convErr != nil {
+			return 0, err
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("ttl must be positive")
+	}
+	return ttl, nil
+}
+
+// SetupRoutes opens the store at path with store.Open, so no other process can use it
+// while the server runs, initializes the HTTP server routes for it and starts the
+// server. The store is closed when the server stops.
+func SetupRoutes(path string, opts ...store.Option) error {
+	db, err := store.Open(path, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to open store: %w", err)
+	}
 
 	// Wrap with middleware and start the server
-	wrappedMux := AuthMiddleware(LoggingMiddleware(mux))
-	if err := http.ListenAndServe(":8080", wrappedMux); err != nil {
-		fmt.Printf("Failed to start server: %s\n", err)
+	wrappedMux := AuthMiddleware(LoggingMiddleware(NewHandler(db).Routes()))
+	err = http.ListenAndServe(":8080", wrappedMux)
+
+	// Save anything the durability policy has not saved yet, and release the lock
+	if closeErr := db.Close(); closeErr != nil {
+		fmt.Printf("Error saving store: %s\n", closeErr)
 	}
+	return fmt.Errorf("server stopped: %w", err)
+}
+
+// Routes returns the API's routes, without the authentication and logging middleware.
+func (h *Handler) Routes() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Register handlers
+	mux.HandleFunc("/create", h.CreateKeyValueHandler)
+	mux.HandleFunc("/read", h.ReadKeyValueHandler)
+	mux.HandleFunc("/update", h.UpdateKeyValueHandler)
+	mux.HandleFunc("/delete", h.DeleteKeyValueHandler)
+	mux.HandleFunc("/txn", h.TxnHandler)
+	mux.HandleFunc("GET /keys/{key}/history", h.HistoryHandler)
+	mux.HandleFunc("POST /keys/{key}/revert", h.RevertHandler)
+	mux.HandleFunc("/indexes", h.ListIndexesHandler)
+	mux.HandleFunc("/indexes/create", h.CreateIndexHandler)
+	mux.HandleFunc("/indexes/drop", h.DropIndexHandler)
+	mux.HandleFunc("/lookup", h.LookupHandler)
+	mux.HandleFunc("POST /query", h.QueryHandler)
+
+	// Register the same handlers scoped to a namespace
+	mux.HandleFunc("/ns/{ns}/create", h.CreateKeyValueHandler)
+	mux.HandleFunc("/ns/{ns}/read", h.ReadKeyValueHandler)
+	mux.HandleFunc("/ns/{ns}/update", h.UpdateKeyValueHandler)
+	mux.HandleFunc("/ns/{ns}/delete", h.DeleteKeyValueHandler)
+	mux.HandleFunc("/ns/{ns}/txn", h.TxnHandler)
+	mux.HandleFunc("GET /ns/{ns}/keys/{key}/history", h.HistoryHandler)
+	mux.HandleFunc("POST /ns/{ns}/keys/{key}/revert", h.RevertHandler)
+	mux.HandleFunc("/ns/{ns}/indexes", h.ListIndexesHandler)
+	mux.HandleFunc("/ns/{ns}/indexes/create", h.CreateIndexHandler)
+	mux.HandleFunc("/ns/{ns}/indexes/drop", h.DropIndexHandler)
+	mux.HandleFunc("/ns/{ns}/lookup", h.LookupHandler)
+	mux.HandleFunc("POST /ns/{ns}/query", h.QueryHandler)
+	mux.HandleFunc("/ns/{ns}/stats", h.StatsHandler)
+	mux.HandleFunc("/stats", h.StatsHandler)
+
+	// Register namespace management handlers
+	mux.HandleFunc("/namespaces", h.ListNamespacesHandler)
+	mux.HandleFunc("/namespaces/create", h.CreateNamespaceHandler)
+	mux.HandleFunc("/namespaces/drop", h.DropNamespaceHandler)
+
+	// Register admin handlers
+	mux.HandleFunc("/admin/snapshots", h.ListSnapshotsHandler)
+	mux.HandleFunc("/admin/snapshots/create", h.CreateSnapshotHandler)
+	mux.HandleFunc("/admin/snapshots/restore", h.RestoreSnapshotHandler)
+	mux.HandleFunc("/admin/snapshots/delete", h.DeleteSnapshotHandler)
+	mux.HandleFunc("POST /admin/rotate-key", h.RotateKeyHandler)
+
+	return mux
 }
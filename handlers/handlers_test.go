@@ -2,95 +2,282 @@
 package handlers
 
 import (
-    "net/http"
-    "net/http/httptest"
-    "testing"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"json-key-value-store/store"
 )
 
 // TestLoggingMiddleware tests the logging functionality of the LoggingMiddleware.
 func TestLoggingMiddleware(t *testing.T) {
-    // Create a request to test with
-    req, err := http.NewRequest(http.MethodGet, "/get/testuser", nil)
-    if err != nil {
-        t.Fatalf("Failed to create request: %v", err)
-    }
-
-    // Create a response recorder to capture the response
-    rr := httptest.NewRecorder()
-
-    // Create a simple handler for testing
-    handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        w.WriteHeader(http.StatusOK)
-    })
-
-    // Wrap the handler with the LoggingMiddleware
-    middleware := LoggingMiddleware(handler)
-
-    // Serve the request through the middleware
-    middleware.ServeHTTP(rr, req)
-
-    // Check if the status code is correct
-    if rr.Code != http.StatusOK {
-        t.Errorf("Expected status code %d, but got %d", http.StatusOK, rr.Code)
-    }
+	// Create a request to test with
+	req, err := http.NewRequest(http.MethodGet, "/get/testuser", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+
+	// Create a response recorder to capture the response
+	rr := httptest.NewRecorder()
+
+	// Create a simple handler for testing
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// Wrap the handler with the LoggingMiddleware
+	middleware := LoggingMiddleware(handler)
+
+	// Serve the request through the middleware
+	middleware.ServeHTTP(rr, req)
+
+	// Check if the status code is correct
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, but got %d", http.StatusOK, rr.Code)
+	}
 }
 
 // TestAuthMiddleware tests the authentication functionality of the AuthMiddleware.
 func TestAuthMiddleware(t *testing.T) {
-    tests := []struct {
-        name         string
-        authHeader   string
-        expectedCode int
-    }{
-        {
-            name:         "Valid Credentials",
-            authHeader:   "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:password123")),
-            expectedCode: http.StatusOK,
-        },
-        {
-            name:         "Invalid Credentials",
-            authHeader:   "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:wrongpassword")),
-            expectedCode: http.StatusUnauthorized,
-        },
-        {
-            name:         "No Credentials",
-            authHeader:   "",
-            expectedCode: http.StatusUnauthorized,
-        },
-    }
-
-    // Iterate through test cases
-    for _, tt := range tests {
-        t.Run(tt.name, func(t *testing.T) {
-            // Create a request to test with
-            req, err := http.NewRequest(http.MethodGet, "/get/testuser", nil)
-            if err != nil {
-                t.Fatalf("Failed to create request: %v", err)
-            }
-
-            // Set the Authorization header if provided
-            if tt.authHeader != "" {
-                req.Header.Set("Authorization", tt.authHeader)
-            }
-
-            // Create a response recorder to capture the response
-            rr := httptest.NewRecorder()
-
-            // Create a simple handler for testing
-            handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-                w.WriteHeader(http.StatusOK)
-            })
-
-            // Wrap the handler with the AuthMiddleware
-            middleware := AuthMiddleware(handler)
-
-            // Serve the request through the middleware
-            middleware.ServeHTTP(rr, req)
-
-            // Check if the status code matches the expected value
-            if rr.Code != tt.expectedCode {
-                t.Errorf("Test case '%s': Expected status code %d, but got %d", tt.name, tt.expectedCode, rr.Code)
-            }
-        })
-    }
-}
\ No newline at end of file
+	tests := []struct {
+		name         string
+		authHeader   string
+		expectedCode int
+	}{
+		{
+			name:         "Valid Credentials",
+			authHeader:   "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:password123")),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "Invalid Credentials",
+			authHeader:   "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:wrongpassword")),
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "No Credentials",
+			authHeader:   "",
+			expectedCode: http.StatusUnauthorized,
+		},
+	}
+
+	// Iterate through test cases
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create a request to test with
+			req, err := http.NewRequest(http.MethodGet, "/get/testuser", nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+
+			// Set the Authorization header if provided
+			if tt.authHeader != "" {
+				req.Header.Set("Authorization", tt.authHeader)
+			}
+
+			// Create a response recorder to capture the response
+			rr := httptest.NewRecorder()
+
+			// Create a simple handler for testing
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			// Wrap the handler with the AuthMiddleware
+			middleware := AuthMiddleware(handler)
+
+			// Serve the request through the middleware
+			middleware.ServeHTTP(rr, req)
+
+			// Check if the status code matches the expected value
+			if rr.Code != tt.expectedCode {
+				t.Errorf("Test case '%s': Expected status code %d, but got %d", tt.name, tt.expectedCode, rr.Code)
+			}
+		})
+	}
+}
+
+// newTestHandler returns the API's routes over a fresh store in a temporary directory.
+func newTestHandler(t *testing.T) (http.Handler, *store.Store) {
+	db := store.NewStore(filepath.Join(t.TempDir(), "store.json"))
+	return NewHandler(db).Routes(), db
+}
+
+// serve sends a request through h, with headers given as name-value pairs.
+func serve(h http.Handler, method, target, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+// TestConditionalWrites tests the 409 and 412 responses of creates and updates, and
+// that ETags follow each write.
+func TestConditionalWrites(t *testing.T) {
+	h, db := newTestHandler(t)
+
+	rr := serve(h, http.MethodPost, "/create", `{"key": "user1", "value": "{\"v\": 1}", "ttl": "1h"}`)
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") == "" {
+		t.Fatalf("Expected a created key with an ETag, but got %d: %s", rr.Code, rr.Body)
+	}
+	etag := rr.Header().Get("ETag")
+	if ttl, err := db.TTL("user1"); err != nil || ttl <= 59*time.Minute {
+		t.Errorf("Expected the key to be created with its TTL, but got %v, %v", ttl, err)
+	}
+
+	if rr := serve(h, http.MethodPost, "/create", `{"key": "user1", "value": "{}"}`); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for an existing key, but got %d", rr.Code)
+	}
+	if rr := serve(h, http.MethodPost, "/create", `{"key": "user1", "value": "{}"}`, "If-None-Match", "*"); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for an existing key under If-None-Match, but got %d", rr.Code)
+	}
+
+	rr = serve(h, http.MethodPut, "/update", `{"key": "user1", "value": "{\"v\": 2}"}`, "If-Match", etag)
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") == etag {
+		t.Fatalf("Expected the update to succeed with a new ETag, but got %d: %s", rr.Code, rr.Body)
+	}
+	if rr := serve(h, http.MethodPut, "/update", `{"key": "user1", "value": "{\"v\": 3}"}`, "If-Match", etag); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a stale If-Match, but got %d", rr.Code)
+	}
+	if rr := serve(h, http.MethodGet, "/read?key=user1", "", "If-None-Match", etag); rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a stale If-None-Match, but got %d", rr.Code)
+	}
+	etag = serve(h, http.MethodGet, "/read?key=user1", "").Header().Get("ETag")
+	if rr := serve(h, http.MethodGet, "/read?key=user1", "", "If-None-Match", etag); rr.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for the current ETag, but got %d", rr.Code)
+	}
+	if rr := serve(h, http.MethodGet, "/ns/missing/read?key=user1", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing namespace, but got %d", rr.Code)
+	}
+}
+
+// TestTxnEndpoint tests that /txn applies every operation, or none if a precondition fails.
+func TestTxnEndpoint(t *testing.T) {
+	h, db := newTestHandler(t)
+
+	body := `{"ops": [{"op": "create", "key": "a", "value": "{}"}, {"op": "create", "key": "b", "value": "{}"}]}`
+	if rr := serve(h, http.MethodPost, "/txn", body); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the transaction to commit, but got %d: %s", rr.Code, rr.Body)
+	}
+
+	body = `{"preconditions": [{"key": "a", "exists": false}], "ops": [{"op": "delete", "key": "b"}]}`
+	if rr := serve(h, http.MethodPost, "/txn", body); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a failed precondition, but got %d", rr.Code)
+	}
+	if _, err := db.Read("b"); err != nil {
+		t.Errorf("Expected b to survive the aborted transaction, but got: %v", err)
+	}
+	if rr := serve(h, http.MethodPost, "/txn", `{"ops": []}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an empty transaction, but got %d", rr.Code)
+	}
+	if rr := serve(h, http.MethodPost, "/txn", `{"ops": [{"op": "rename", "key": "a"}]}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown operation, but got %d", rr.Code)
+	}
+	if rr := serve(h, http.MethodPost, "/txn", `{"ops": [{"op": "create", "key": "a", "value": "{}"}]}`); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for creating an existing key, but got %d", rr.Code)
+	}
+	if rr := serve(h, http.MethodPost, "/txn", `{"ops": [{"op": "update", "key": "missing", "value": "{}"}]}`); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for updating a missing key, but got %d", rr.Code)
+	}
+
+	// A store that cannot be written to is a server error, not a bad request.
+	db.Save()
+	readOnly := NewHandler(store.NewStore(db.Path(), store.WithReadOnly())).Routes()
+	if rr := serve(readOnly, http.MethodPost, "/txn", `{"ops": [{"op": "set", "key": "c", "value": "{}"}]}`); rr.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 for a read-only store, but got %d", rr.Code)
+	}
+}
+
+// TestQueryEndpoint tests that /query returns the matching documents in order.
+func TestQueryEndpoint(t *testing.T) {
+	h, db := newTestHandler(t)
+	db.Create("ada", `{"name": "Ada", "age": 36}`)
+	db.Create("alan", `{"name": "Alan", "age": 41}`)
+	db.Create("bob", `{"name": "Bob", "age": 25}`)
+
+	rr := serve(h, http.MethodPost, "/query", `{"filter": {"age": {"$gt": 30}}, "sort": ["-age"], "projection": {"name": 1}}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, but got %d: %s", rr.Code, rr.Body)
+	}
+	var response struct {
+		Data []store.Document `json:"data"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(response.Data) != 2 || response.Data[0].Key != "alan" || string(response.Data[0].Value) != `{"name":"Alan"}` {
+		t.Errorf("Expected alan then ada, names only, but got %+v", response.Data)
+	}
+
+	if rr := serve(h, http.MethodPost, "/query", `{"filter": {"age": {"$bogus": 1}}}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid query, but got %d", rr.Code)
+	}
+	if rr := serve(h, http.MethodGet, "/query", ""); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for a GET, but got %d", rr.Code)
+	}
+}
+
+// TestReadPathEndpoint tests that /read returns the part of a document at a path as JSON.
+func TestReadPathEndpoint(t *testing.T) {
+	h, db := newTestHandler(t)
+	db.Create("user1", `{"name": "Ada", "address": {"city": "London"}}`)
+
+	for _, path := range []string{"/address/city", "$.address.city", ".address.city"} {
+		rr := serve(h, http.MethodGet, "/read?key=user1&path="+url.QueryEscape(path), "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, but got %d: %s", path, rr.Code, rr.Body)
+		}
+		if body := strings.TrimSpace(rr.Body.String()); !strings.Contains(body, `"data":"London"`) {
+			t.Errorf("%s: expected the city as a JSON string, but got %s", path, body)
+		}
+	}
+	if rr := serve(h, http.MethodGet, "/read?key=user1&path=/address/zip", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing path, but got %d", rr.Code)
+	}
+	if rr := serve(h, http.MethodGet, "/read?key=user1&path=address", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid path, but got %d", rr.Code)
+	}
+}
+
+// TestHistoryEndpointStatuses tests that reading history answers 404 when there is
+// nothing to read, and 500 when what is there cannot be read
+func TestHistoryEndpointStatuses(t *testing.T) {
+	h, _ := newTestHandler(t)
+	if rr := serve(h, http.MethodGet, "/keys/a/history", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 with history disabled, but got %d", rr.Code)
+	}
+
+	backend := store.NewMemoryBackend()
+	db := store.NewStore(filepath.Join(t.TempDir(), "store.json"), store.WithBackend(backend), store.WithHistory(5))
+	h = NewHandler(db).Routes()
+	rev, _ := db.CreateWithTTL("a", `{"v":1}`, 0)
+
+	if rr := serve(h, http.MethodGet, "/keys/a/history", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected 200, but got %d: %s", rr.Code, rr.Body)
+	}
+	if rr := serve(h, http.MethodGet, "/keys/missing/history", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a key without history, but got %d", rr.Code)
+	}
+	if rr := serve(h, http.MethodGet, "/keys/a/history?revision=999", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a revision not in the history, but got %d", rr.Code)
+	}
+
+	// Damage the stored entry so it cannot be decoded.
+	backend.Put(fmt.Sprintf("\x00hist:a\x00%020d", rev), "not json")
+	if rr := serve(h, http.MethodGet, "/keys/a/history", ""); rr.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 for an unreadable history, but got %d", rr.Code)
+	}
+	if rr := serve(h, http.MethodGet, fmt.Sprintf("/keys/a/history?revision=%d", rev), ""); rr.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 for an unreadable revision, but got %d", rr.Code)
+	}
+}
@@ -0,0 +1,106 @@
+// Package handlers implements the key history endpoints, which list the retained
+// revisions of a key and revert it to one of them.
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"json-key-value-store/store"
+)
+
+// HistoryHandler lists the retained revisions of the key in the path, newest first,
+// or returns a single one if a 'revision' parameter is given.
+func (h *Handler) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := h.storeFor(w, r)
+	if !ok {
+		return
+	}
+	key := r.PathValue("key")
+
+	if param := r.URL.Query().Get("revision"); param != "" {
+		rev, err := strconv.ParseUint(param, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid revision: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		entry, err := db.HistoryAt(key, rev)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read revision: %s", err), historyErrorStatus(err))
+			return
+		}
+
+		// Send success response
+		response := Response{Message: "Revision retrieved", Data: entry}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	entries, err := db.History(key)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read history: %s", err), historyErrorStatus(err))
+		return
+	}
+
+	// Send success response
+	response := Response{Message: "History retrieved", Data: entries}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// RevertHandler restores the key in the path to the value it had at the revision given
+// in the body, as a new write.
+func (h *Handler) RevertHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := h.storeFor(w, r)
+	if !ok {
+		return
+	}
+	key := r.PathValue("key")
+
+	var requestData map[string]uint64
+
+	// Decode the JSON body
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %s", err), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	rev, ok := requestData["revision"]
+	if !ok {
+		http.Error(w, "Revision is a required field", http.StatusBadRequest)
+		return
+	}
+
+	version, err := db.Revert(key, rev)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to revert: %s", err), historyErrorStatus(err))
+		return
+	}
+
+	// Send success response
+	response := Response{Message: fmt.Sprintf("Key reverted to revision %d", rev)}
+	if version > 0 {
+		setETag(w, version)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// historyErrorStatus returns the status for an error reading or reverting a key's
+// history: 404 if there is nothing to read, 500 if reading it failed.
+func historyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, store.ErrRevisionNotFound),
+		errors.Is(err, store.ErrKeyNotFound),
+		errors.Is(err, store.ErrHistoryDisabled):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
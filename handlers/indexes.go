@@ -0,0 +1,132 @@
+// Package handlers implements the secondary index endpoints, which declare indexes on
+// JSON paths and look keys up by the values their documents hold there.
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"json-key-value-store/store"
+)
+
+// ListIndexesHandler lists the secondary indexes of a namespace.
+func (h *Handler) ListIndexesHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := h.storeFor(w, r)
+	if !ok {
+		return
+	}
+
+	// Send success response
+	response := Response{Message: "Indexes retrieved", Data: db.Indexes()}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// CreateIndexHandler declares a secondary index on the JSON path given in the body.
+func (h *Handler) CreateIndexHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := h.storeFor(w, r)
+	if !ok {
+		return
+	}
+
+	var requestData map[string]string
+
+	// Decode the JSON body
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %s", err), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	path := requestData["path"]
+	if path == "" {
+		http.Error(w, "Path is a required field", http.StatusBadRequest)
+		return
+	}
+
+	err := db.CreateIndex(path)
+	if errors.Is(err, store.ErrIndexExists) {
+		http.Error(w, fmt.Sprintf("Failed to create index: %s", err), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create index: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	// Send success response
+	response := Response{Message: "Index created successfully"}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// DropIndexHandler removes the secondary index on the 'path' parameter.
+func (h *Handler) DropIndexHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := h.storeFor(w, r)
+	if !ok {
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "Missing 'path' parameter", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.DropIndex(path); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to drop index: %s", err), http.StatusNotFound)
+		return
+	}
+
+	// Send success response
+	response := Response{Message: "Index dropped successfully"}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// LookupHandler returns the keys whose documents hold the given values at the indexed
+// JSON 'path'. Values are JSON, e.g. 30 or "ada@example.com": 'value' looks up one
+// value, and 'gt', 'gte', 'lt' and 'lte' bound a range.
+func (h *Handler) LookupHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := h.storeFor(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	path := query.Get("path")
+	if path == "" {
+		http.Error(w, "Missing 'path' parameter", http.StatusBadRequest)
+		return
+	}
+
+	var keys []string
+	var err error
+	if value := query.Get("value"); value != "" {
+		keys, err = db.Lookup(path, value)
+	} else {
+		bounds := store.IndexRange{Min: query.Get("gte"), Max: query.Get("lte")}
+		if gt := query.Get("gt"); gt != "" {
+			bounds.Min, bounds.ExcludeMin = gt, true
+		}
+		if lt := query.Get("lt"); lt != "" {
+			bounds.Max, bounds.ExcludeMax = lt, true
+		}
+		keys, err = db.LookupRange(path, bounds)
+	}
+	if errors.Is(err, store.ErrIndexNotFound) {
+		http.Error(w, fmt.Sprintf("Failed to look up keys: %s", err), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to look up keys: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	// Send success response
+	response := Response{Message: "Keys retrieved", Data: keys}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,129 @@
+// Package handlers implements namespace management and resolves the namespace a request operates on.
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"json-key-value-store/store"
+)
+
+// keyValueStore is the set of operations the key-value handlers run against a namespace.
+type keyValueStore interface {
+	CreateWithTTL(key, value string, ttl time.Duration) (uint64, error)
+	ReadVersion(key string) (string, uint64, error)
+	CompareAndSwapWithTTL(key string, expectedVersion uint64, value string, ttl time.Duration) (uint64, error)
+	DeleteIfVersion(key string, expectedVersion uint64) error
+	Stats() (store.StoreStats, error)
+	Txn(fn func(tx *store.Tx) error) error
+	History(key string) ([]store.HistoryEntry, error)
+	HistoryAt(key string, rev uint64) (store.HistoryEntry, error)
+	Revert(key string, rev uint64) (uint64, error)
+	CreateIndex(path string) error
+	DropIndex(path string) error
+	Indexes() []store.IndexInfo
+	Lookup(path, value string) ([]string, error)
+	LookupRange(path string, r store.IndexRange) ([]string, error)
+	Find(q store.Query) ([]store.Document, error)
+}
+
+// storeFor returns the namespace named by the request's {ns} path segment, or the
+// default key space for routes without one, attributing writes to the authenticated
+// user. It writes a 404 response and returns false if the namespace does not exist.
+func (h *Handler) storeFor(w http.ResponseWriter, r *http.Request) (keyValueStore, bool) {
+	author, _, _ := r.BasicAuth()
+
+	name := r.PathValue("ns")
+	if name == "" {
+		return h.db.As(author), true
+	}
+
+	ns, err := h.db.Namespace(name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Namespace not found: %s", err), http.StatusNotFound)
+		return nil, false
+	}
+	return ns.As(author), true
+}
+
+// ListNamespacesHandler lists every namespace.
+func (h *Handler) ListNamespacesHandler(w http.ResponseWriter, r *http.Request) {
+	names, err := h.db.Namespaces()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list namespaces: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Send success response
+	response := Response{Message: "Namespaces retrieved", Data: names}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// CreateNamespaceHandler creates an empty namespace.
+func (h *Handler) CreateNamespaceHandler(w http.ResponseWriter, r *http.Request) {
+	var requestData map[string]string
+
+	// Decode the JSON body
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %s", err), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	name := requestData["name"]
+	if name == "" {
+		http.Error(w, "Name is a required field", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.db.CreateNamespace(name); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create namespace: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Send success response
+	response := Response{Message: "Namespace created successfully"}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// DropNamespaceHandler deletes a namespace and all of its keys.
+func (h *Handler) DropNamespaceHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Missing 'name' parameter", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.DropNamespace(name); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to drop namespace: %s", err), http.StatusNotFound)
+		return
+	}
+
+	// Send success response
+	response := Response{Message: "Namespace dropped successfully"}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// StatsHandler reports the number of keys and bytes stored in a namespace.
+func (h *Handler) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := h.storeFor(w, r)
+	if !ok {
+		return
+	}
+
+	stats, err := db.Stats()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to collect stats: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Send success response
+	response := Response{Message: "Stats retrieved", Data: stats}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
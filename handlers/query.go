@@ -0,0 +1,40 @@
+// Package handlers implements the query endpoint, which finds documents matching a
+// MongoDB-style filter.
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"json-key-value-store/store"
+)
+
+// QueryHandler returns the documents matching the query in the body: a filter such as
+// {"age": {"$gt": 30}}, with optional "sort", "skip", "limit" and "projection".
+func (h *Handler) QueryHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := h.storeFor(w, r)
+	if !ok {
+		return
+	}
+
+	var query store.Query
+
+	// Decode the JSON body
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %s", err), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	docs, err := db.Find(query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid query: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	// Send success response
+	response := Response{Message: fmt.Sprintf("%d documents found", len(docs)), Data: docs}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
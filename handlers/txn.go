@@ -0,0 +1,145 @@
+// Package handlers implements the transaction endpoint, which applies several writes atomically.
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"json-key-value-store/store"
+)
+
+// TxnRequest is the body of a transaction request. Every precondition is checked and
+// every operation applied in one transaction; if any fails, nothing is written.
+type TxnRequest struct {
+	Preconditions []TxnPrecondition `json:"preconditions"`
+	Ops           []TxnOp           `json:"ops"`
+}
+
+// TxnPrecondition requires a key to exist or not, and optionally to hold a given value.
+type TxnPrecondition struct {
+	Key    string  `json:"key"`
+	Exists *bool   `json:"exists,omitempty"` // Whether the key must exist; omitted means either
+	Value  *string `json:"value,omitempty"`  // Exact value the key must hold; implies it exists
+}
+
+// TxnOp is a single write in a transaction.
+type TxnOp struct {
+	Op    string `json:"op"` // One of "create", "update", "set" or "delete"
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// errPreconditionFailed marks a transaction aborted by one of its preconditions.
+var errPreconditionFailed = errors.New("precondition failed")
+
+// TxnHandler applies a list of operations atomically, provided every precondition holds.
+// A failed precondition or creating a key that exists answers 409, and updating or
+// deleting a missing key 404. An invalid request answers 400, and a failure to write,
+// e.g. to a read-only store, 500.
+func (h *Handler) TxnHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := h.storeFor(w, r)
+	if !ok {
+		return
+	}
+
+	var request TxnRequest
+
+	// Decode the JSON body
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %s", err), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if len(request.Ops) == 0 {
+		http.Error(w, "At least one operation is required", http.StatusBadRequest)
+		return
+	}
+
+	// Validate the request up front, so anything failing later is the store's doing
+	for _, pre := range request.Preconditions {
+		if err := store.ValidateKey(pre.Key); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid precondition on %q: %s", pre.Key, err), http.StatusBadRequest)
+			return
+		}
+	}
+	for i, op := range request.Ops {
+		if err := validateTxnOp(op); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid operation %d (%s %q): %s", i, op.Op, op.Key, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Run the transaction
+	err := db.Txn(func(tx *store.Tx) error {
+		for _, pre := range request.Preconditions {
+			if err := checkPrecondition(tx, pre); err != nil {
+				return err
+			}
+		}
+		for i, op := range request.Ops {
+			if err := applyTxnOp(tx, op); err != nil {
+				return fmt.Errorf("operation %d (%s %q): %w", i, op.Op, op.Key, err)
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errPreconditionFailed) {
+		http.Error(w, fmt.Sprintf("Transaction aborted: %s", err), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, "Transaction failed", err, http.StatusInternalServerError)
+		return
+	}
+
+	// Send success response
+	response := Response{Message: "Transaction committed successfully", Data: len(request.Ops)}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// checkPrecondition returns an error wrapping errPreconditionFailed if pre does not hold.
+func checkPrecondition(tx *store.Tx, pre TxnPrecondition) error {
+	value, exists, err := tx.Get(pre.Key)
+	if err != nil {
+		return err
+	}
+	if pre.Exists != nil && exists != *pre.Exists {
+		return fmt.Errorf("%w: key %q exists=%t", errPreconditionFailed, pre.Key, exists)
+	}
+	if pre.Value != nil && (!exists || value != *pre.Value) {
+		return fmt.Errorf("%w: key %q does not hold the expected value", errPreconditionFailed, pre.Key)
+	}
+	return nil
+}
+
+// validateTxnOp checks an operation's kind, key and value before the transaction runs.
+func validateTxnOp(op TxnOp) error {
+	switch op.Op {
+	case "create", "update", "set":
+		return store.ValidateKeyValue(op.Key, op.Value)
+	case "delete":
+		return store.ValidateKey(op.Key)
+	default:
+		return fmt.Errorf("unknown operation %q", op.Op)
+	}
+}
+
+// applyTxnOp buffers a single operation in tx.
+func applyTxnOp(tx *store.Tx, op TxnOp) error {
+	switch op.Op {
+	case "create":
+		return tx.Create(op.Key, op.Value)
+	case "update":
+		return tx.Update(op.Key, op.Value)
+	case "set":
+		return tx.Set(op.Key, op.Value)
+	case "delete":
+		return tx.Delete(op.Key)
+	default:
+		return fmt.Errorf("unknown operation %q", op.Op)
+	}
+}
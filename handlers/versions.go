@@ -0,0 +1,78 @@
+// Package handlers maps per-key versions onto HTTP entity tags, so clients can make
+// their writes conditional with If-Match and If-None-Match.
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"json-key-value-store/store"
+)
+
+// setETag reports a key's version to the client as its entity tag.
+func setETag(w http.ResponseWriter, version uint64) {
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatUint(version, 10)))
+}
+
+// parseETag returns the version named by a single entity tag. Weak tags are accepted,
+// since a version identifies the exact value.
+func parseETag(tag string) (uint64, error) {
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	unquoted, err := strconv.Unquote(tag)
+	if err != nil {
+		return 0, fmt.Errorf("malformed entity tag %s", tag)
+	}
+	version, err := strconv.ParseUint(unquoted, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unknown entity tag %s", tag)
+	}
+	return version, nil
+}
+
+// expectedVersion returns the version a write's If-Match header requires, or
+// store.AnyVersion if there is no header or it is "*".
+func expectedVersion(r *http.Request) (uint64, error) {
+	match := r.Header.Get("If-Match")
+	if match == "" || strings.TrimSpace(match) == "*" {
+		return store.AnyVersion, nil
+	}
+	return parseETag(match)
+}
+
+// matchesETag reports whether an If-None-Match header names version.
+func matchesETag(header string, version uint64) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if v, err := parseETag(tag); err == nil && v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// writeStoreError sends err with a status that tells conflicts apart from other
+// failures: 412 when a precondition header did not hold, 409 when creating a key
+// that exists, 404 when the key is missing, and fallback otherwise.
+func writeStoreError(w http.ResponseWriter, r *http.Request, message string, err error, fallback int) {
+	conditional := r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != ""
+
+	status := fallback
+	switch {
+	case errors.Is(err, store.ErrVersionMismatch):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, store.ErrKeyExists) && conditional:
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, store.ErrKeyExists):
+		status = http.StatusConflict
+	case errors.Is(err, store.ErrKeyNotFound) && conditional:
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, store.ErrKeyNotFound):
+		status = http.StatusNotFound
+	}
+	http.Error(w, fmt.Sprintf("%s: %s", message, err), status)
+}
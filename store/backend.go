@@ -0,0 +1,195 @@
+// Package store defines the Backend interface that Store keeps its data in.
+// Store owns key and JSON validation and serialises access; a Backend only has to
+// store and retrieve raw values, so storage engines can be swapped without touching
+// that logic.
+package store
+
+// Backend is a storage engine for a Store.
+// Implementations must be safe for concurrent use.
+type Backend interface {
+	// Get returns the value stored under key and whether it was found.
+	Get(key string) (value string, found bool, err error)
+
+	// Put stores value under key, replacing any existing value.
+	Put(key, value string) error
+
+	// Delete removes key. Deleting a key that does not exist is not an error.
+	Delete(key string) error
+
+	// Iterate calls fn for every key-value pair until fn returns false.
+	// The order of iteration is unspecified, and fn must not call back into the backend.
+	Iterate(fn func(key, value string) bool) error
+
+	// Close releases any resources held by the backend.
+	Close() error
+}
+
+// Persister is implemented by backends that hold their data in memory and write it
+// to durable storage on request. Store.Load and Store.Save delegate to it.
+type Persister interface {
+	Load() error
+	Save() error
+}
+
+// Clearer is implemented by backends that can remove every key more efficiently
+// than deleting them one at a time.
+type Clearer interface {
+	Clear() error
+}
+
+// RangeIterator is implemented by backends that keep keys sorted and can visit a key
+// range without scanning everything.
+type RangeIterator interface {
+	// Range calls fn, in key order, for every key k with start <= k < end until fn
+	// returns false. An empty end means no upper bound.
+	Range(start, end string, fn func(key, value string) bool) error
+}
+
+// BatchWriter is implemented by backends that can apply several writes atomically:
+// after a crash either every write in the batch is visible or none is.
+type BatchWriter interface {
+	WriteBatch(ops []BatchOp) error
+}
+
+// RevisionBatchWriter is implemented by batch writers that keep the store's revision
+// counter themselves, e.g. in the header of each log record, rather than under a key.
+// The store then leaves the counter out of its batches, so writes to different keys
+// share no key and take no common lock.
+type RevisionBatchWriter interface {
+	// WriteBatchAt applies ops atomically, like WriteBatch, as the store's revision rev.
+	// The latest revision written must be found under the revision key once the data
+	// is loaded again.
+	WriteBatchAt(rev uint64, ops []BatchOp) error
+}
+
+// BatchOp is one write in a batch: a Put of Value under Key, or a Delete of Key.
+type BatchOp struct {
+	Key    string
+	Value  string
+	Delete bool
+}
+
+// writeBatch applies ops to b, atomically if b is a BatchWriter and one at a time otherwise.
+func writeBatch(b Backend, ops []BatchOp) error {
+	if bw, ok := b.(BatchWriter); ok {
+		return bw.WriteBatch(ops)
+	}
+	for _, op := range ops {
+		var err error
+		if op.Delete {
+			err = b.Delete(op.Key)
+		} else {
+			err = b.Put(op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBatchAt applies ops to b as the store's revision rev. A RevisionBatchWriter keeps
+// the revision itself; other backends are given it as a write of the revision key,
+// first, so a crash part way through a non-atomic batch never leaves it behind the data.
+func writeBatchAt(b Backend, rev uint64, ops []BatchOp) error {
+	if rw, ok := b.(RevisionBatchWriter); ok {
+		return rw.WriteBatchAt(rev, ops)
+	}
+	return writeBatch(b, append([]BatchOp{{Key: revisionKey, Value: formatRevision(rev)}}, ops...))
+}
+
+// MemoryBackend is a Backend that keeps everything in memory and never touches disk.
+// Keys are spread over independently locked shards so writers to different keys do not
+// block each other.
+type MemoryBackend struct {
+	data *shardedMap // In-memory data store
+}
+
+// NewMemoryBackend returns an empty in-memory backend with DefaultShards shards.
+func NewMemoryBackend() *MemoryBackend {
+	return NewShardedMemoryBackend(DefaultShards)
+}
+
+// NewShardedMemoryBackend returns an empty in-memory backend with n shards.
+func NewShardedMemoryBackend(n int) *MemoryBackend {
+	return &MemoryBackend{
+		data: newShardedMap(n),
+	}
+}
+
+// Get returns the value stored under key.
+func (b *MemoryBackend) Get(key string) (string, bool, error) {
+	sh := b.data.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	value, exists := sh.data[key]
+	return value, exists, nil
+}
+
+// Put stores value under key.
+func (b *MemoryBackend) Put(key, value string) error {
+	sh := b.data.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	sh.data[key] = value
+	return nil
+}
+
+// Delete removes key.
+func (b *MemoryBackend) Delete(key string) error {
+	sh := b.data.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	delete(sh.data, key)
+	return nil
+}
+
+// Iterate calls fn for every key-value pair until fn returns false.
+// Every shard is read-locked for the duration, so fn sees a consistent view.
+func (b *MemoryBackend) Iterate(fn func(key, value string) bool) error {
+	b.data.rLockAll()
+	defer b.data.rUnlockAll()
+
+	b.data.rangeLocked(fn)
+	return nil
+}
+
+// Clear removes every key.
+func (b *MemoryBackend) Clear() error {
+	b.data.lockAll()
+	defer b.data.unlockAll()
+
+	b.data.clearLocked()
+	return nil
+}
+
+// WriteBatch applies ops with the shards they touch locked, so readers see all of them
+// or none.
+func (b *MemoryBackend) WriteBatch(ops []BatchOp) error {
+	shards := b.data.shardsOf(ops)
+	b.data.lockShards(shards)
+	defer b.data.unlockShards(shards)
+
+	for _, op := range ops {
+		if op.Delete {
+			delete(b.data.shardFor(op.Key).data, op.Key)
+		} else {
+			b.data.shardFor(op.Key).data[op.Key] = op.Value
+		}
+	}
+	return nil
+}
+
+// WriteBatchAt applies ops like WriteBatch. Nothing outlives the process, so there is
+// no revision to keep.
+func (b *MemoryBackend) WriteBatchAt(rev uint64, ops []BatchOp) error {
+	return b.WriteBatch(ops)
+}
+
+// Close is a no-op for the in-memory backend.
+func (b *MemoryBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,311 @@
+// Package store implements the binary snapshot format, a compact alternative to the
+// JSON records for large stores. Each entry is a length-prefixed key and value with
+// a CRC-32, so files are written and read as a stream: loading never holds the raw
+// file in memory next to the data parsed from it, and saving writes the data
+// straight from the backend's shards.
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// SnapshotFormat selects how the data file and named snapshots are encoded. Files in
+// either format are read regardless of the configured one.
+type SnapshotFormat int
+
+const (
+	// FormatJSON writes one checksummed JSON record per line; see FormatVersion.
+	FormatJSON SnapshotFormat = iota
+	// FormatBinary writes length-prefixed binary records, which are smaller and
+	// faster to load and save.
+	FormatBinary
+)
+
+// String returns the format's name, as accepted by ParseSnapshotFormat.
+func (f SnapshotFormat) String() string {
+	if f == FormatBinary {
+		return "binary"
+	}
+	return "json"
+}
+
+// ParseSnapshotFormat returns the format with the given name: "json" or "binary".
+func ParseSnapshotFormat(name string) (SnapshotFormat, error) {
+	switch name {
+	case "json":
+		return FormatJSON, nil
+	case "binary":
+		return FormatBinary, nil
+	default:
+		return FormatJSON, fmt.Errorf("unknown snapshot format %q", name)
+	}
+}
+
+// binaryMagic starts every file in the binary format.
+var binaryMagic = []byte("KVBIN\x01")
+
+// maxBinaryField is the longest key or value a binary record may hold. A longer
+// length prefix means the file is damaged.
+const maxBinaryField = 1 << 31
+
+// writeBinary streams the entries visited by each to w in the binary format: the
+// magic header, then per entry the key and value length as uvarints, the key, the
+// value and a CRC-32 of all of those, and finally a zero key length with the entry
+// count and its CRC-32.
+func writeBinary(w io.Writer, each func(fn func(key, value string) bool) error) error {
+	bw := bufio.NewWriterSize(w, 1<<16)
+	if _, err := bw.Write(binaryMagic); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	var (
+		count  uint64
+		header [2 * binary.MaxVarintLen64]byte
+		sum    [4]byte
+		err    error
+	)
+	rangeErr := each(func(key, value string) bool {
+		n := binary.PutUvarint(header[:], uint64(len(key)))
+		n += binary.PutUvarint(header[n:], uint64(len(value)))
+
+		crc := crc32.Update(0, crc32.IEEETable, header[:n])
+		crc = crc32.Update(crc, crc32.IEEETable, []byte(key))
+		crc = crc32.Update(crc, crc32.IEEETable, []byte(value))
+		binary.BigEndian.PutUint32(sum[:], crc)
+
+		bw.Write(header[:n])
+		bw.WriteString(key)
+		bw.WriteString(value)
+		if _, err = bw.Write(sum[:]); err != nil {
+			return false
+		}
+		count++
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if rangeErr != nil {
+		return rangeErr
+	}
+
+	n := binary.PutUvarint(header[:], 0)
+	n += binary.PutUvarint(header[n:], count)
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(header[:n]))
+	bw.Write(header[:n])
+	bw.Write(sum[:])
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// readBinary streams the entries of a file in the binary format from r to visit,
+// with the offset of each record. A damaged record is passed to damaged and ends the
+// read, since its length prefix cannot be trusted to find the next one.
+func readBinary(r *bufio.Reader, visit func(snapshotEntry) error, damaged func(FsckProblem) error) error {
+	magic := make([]byte, len(binaryMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, binaryMagic) {
+		return damaged(FsckProblem{Problem: "not a binary snapshot"})
+	}
+	broken := func(format string, args ...any) error {
+		return damaged(FsckProblem{Problem: fmt.Sprintf(format, args...)})
+	}
+
+	off := int64(len(binaryMagic))
+	var count uint64
+	for record := 1; ; record++ {
+		crc := crc32.NewIEEE()
+		keyLen, n1, err := readUvarint(r, crc)
+		if err != nil {
+			return broken("record %d is cut short; the file may be truncated", record)
+		}
+
+		if keyLen == 0 {
+			// The trailer: the entry count, which catches records lost without a trace.
+			want, _, err := readUvarint(r, crc)
+			if err == nil {
+				err = checkSum(r, crc.Sum32())
+			}
+			if err != nil {
+				return broken("trailer is damaged: %v", err)
+			}
+			if want != count {
+				return broken("trailer counts %d entries, but %d were read", want, count)
+			}
+			if _, err := r.ReadByte(); err != io.EOF {
+				return broken("data follows the trailer")
+			}
+			return nil
+		}
+
+		valueLen, n2, err := readUvarint(r, crc)
+		if err != nil {
+			return broken("record %d is cut short; the file may be truncated", record)
+		}
+		if keyLen > maxBinaryField || valueLen > maxBinaryField {
+			return broken("record %d has an implausible length", record)
+		}
+
+		buf := make([]byte, keyLen+valueLen)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return broken("record %d is cut short; the file may be truncated", record)
+		}
+		crc.Write(buf)
+		if err := checkSum(r, crc.Sum32()); err != nil {
+			return broken("record %d: %v", record, err)
+		}
+
+		size := n1 + n2 + len(buf) + 4
+		ref := valueRef{off: off, n: size, kind: refBinary}
+		off += int64(size)
+		count++
+		if err := visit(snapshotEntry{Key: string(buf[:keyLen]), Value: string(buf[keyLen:]), Ref: ref}); err != nil {
+			return err
+		}
+	}
+}
+
+// decodeBinaryRecord verifies and parses one record of a binary file, read back
+// whole from the file.
+func decodeBinaryRecord(raw []byte) (string, string, error) {
+	r := bufio.NewReader(bytes.NewReader(raw))
+	crc := crc32.NewIEEE()
+	keyLen, _, err := readUvarint(r, crc)
+	if err != nil {
+		return "", "", errors.New("record is cut short")
+	}
+	valueLen, _, err := readUvarint(r, crc)
+	if err != nil || keyLen > maxBinaryField || valueLen > maxBinaryField {
+		return "", "", errors.New("record has an implausible length")
+	}
+	buf := make([]byte, keyLen+valueLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", "", errors.New("record is cut short")
+	}
+	crc.Write(buf)
+	if err := checkSum(r, crc.Sum32()); err != nil {
+		return "", "", err
+	}
+	return string(buf[:keyLen]), string(buf[keyLen:]), nil
+}
+
+// readUvarint reads a uvarint from r, adding the bytes read to crc, and returns it
+// with the number of bytes it took up.
+func readUvarint(r *bufio.Reader, crc io.Writer) (uint64, int, error) {
+	var raw [binary.MaxVarintLen64]byte
+	for i := range raw {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		raw[i] = b
+		if b < 0x80 {
+			crc.Write(raw[:i+1])
+			v, _ := binary.Uvarint(raw[:i+1])
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("length prefix is too long")
+}
+
+// checkSum reads a CRC-32 from r and compares it with want.
+func checkSum(r *bufio.Reader, want uint32) error {
+	var sum [4]byte
+	if _, err := io.ReadFull(r, sum[:]); err != nil {
+		return errors.New("checksum is cut short")
+	}
+	if binary.BigEndian.Uint32(sum[:]) != want {
+		return errors.New("checksum mismatch")
+	}
+	return nil
+}
+
+// rangeMap visits the entries of data, for writeBinary.
+func rangeMap(data map[string]string) func(fn func(key, value string) bool) error {
+	return func(fn func(key, value string) bool) error {
+		for key, value := range data {
+			if !fn(key, value) {
+				break
+			}
+		}
+		return nil
+	}
+}
+
+// encodeSnapshotAs encodes data in the given format.
+func encodeSnapshotAs(format SnapshotFormat, data map[string]string) ([]byte, error) {
+	if format != FormatBinary {
+		return encodeSnapshot(data)
+	}
+	var buf bytes.Buffer
+	if err := writeBinary(&buf, rangeMap(data)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeSnapshotFile replaces the file at path with the entries visited by each,
+// encoded in format, compressed with c and encrypted under keys if they are set.
+// Unencrypted binary files are streamed to disk; everything else is encoded in
+// memory first, since encryption seals the file as a whole.
+func writeSnapshotFile(path string, format SnapshotFormat, c Codec, keys *Keyring, each func(fn func(key, value string) bool) error) error {
+	if format == FormatBinary && keys == nil {
+		return writeFileAtomicWith(path, func(w io.Writer) error {
+			if c == nil {
+				return writeBinary(w, each)
+			}
+			cw, err := c.NewWriter(w)
+			if err != nil {
+				return fmt.Errorf("failed to compress with %s: %w", c.Name(), err)
+			}
+			if err := writeBinary(cw, each); err != nil {
+				cw.Close()
+				return err
+			}
+			if err := cw.Close(); err != nil {
+				return fmt.Errorf("failed to compress with %s: %w", c.Name(), err)
+			}
+			return nil
+		})
+	}
+
+	data := make(map[string]string)
+	if err := each(func(key, value string) bool {
+		data[key] = value
+		return true
+	}); err != nil {
+		return err
+	}
+	content, err := encodeSnapshotAs(format, data)
+	if err != nil {
+		return err
+	}
+	if content, err = sealFile(content, c, keys); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content)
+}
+
+// ConvertSnapshot reads the data file or snapshot at src, in whichever format it is
+// in, and writes it to dst in format, compressed and encrypted as configured by opts.
+// Keys needed to read src must be supplied with WithEncryption.
+func ConvertSnapshot(src, dst string, format SnapshotFormat, opts ...Option) error {
+	o := buildOptions(opts)
+
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("failed to read %s: %w", src, err)
+	}
+	data, _, err := readSnapshot(src, o.keys)
+	if err != nil {
+		return err
+	}
+	return writeSnapshotFile(dst, format, o.codec, o.keys, rangeMap(data))
+}
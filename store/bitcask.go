@@ -0,0 +1,719 @@
+// Package store implements Bitcask, a log-structured Backend modelled on the Bitcask paper.
+// Every write is appended as a checksummed record to the active data file and an in-memory
+// hash index maps each key to the location of its latest record, so a write costs one
+// append instead of re-marshalling the whole store. A background merge rewrites live
+// records into a compacted file and drops the stale ones; it also writes a hint file so
+// that startup can rebuild the index without scanning the merged data.
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for BitcaskOptions fields left at zero.
+const (
+	DefaultBitcaskMaxFileSize   = 64 << 20    // Size at which the active data file is sealed
+	DefaultBitcaskMergeInterval = time.Minute // How often the background merge checks for work
+	DefaultBitcaskMergeRatio    = 0.5         // Fraction of stale bytes that triggers a merge
+)
+
+const (
+	bitcaskHeaderSize = 12             // crc32 | key length | value length
+	bitcaskHintHeader = 20             // crc32 | key length | record size | offset
+	bitcaskTombstone  = math.MaxUint32 // Value length marking a deleted key
+	bitcaskMinMerge   = 1 << 20        // Stale bytes below which the background merge does nothing
+	bitcaskDataExt    = ".data"
+	bitcaskHintExt    = ".hint"
+	bitcaskTmpExt     = ".tmp"
+)
+
+// ErrBitcaskClosed is returned by operations on a closed Bitcask.
+var ErrBitcaskClosed = errors.New("bitcask is closed")
+
+// BitcaskOptions configures a Bitcask. Zero values select the defaults.
+type BitcaskOptions struct {
+	MaxFileSize   int64         // Size at which the active data file is sealed and a new one started
+	MergeInterval time.Duration // Interval between background merge checks; negative disables them
+	MergeRatio    float64       // Fraction of on-disk bytes that must be stale before a merge runs
+	NoSync        bool          // Skip the fsync after every write, trading durability for speed
+}
+
+// bitcaskLoc is the location of a key's latest record.
+type bitcaskLoc struct {
+	fileID int   // Data file holding the record
+	offset int64 // Offset of the record header within the file
+	size   int64 // Total record size, header included
+}
+
+// Bitcask is a Backend storing its data in append-only files under a directory.
+type Bitcask struct {
+	dir        string
+	opts       BitcaskOptions
+	mu         sync.RWMutex          // Guards everything below
+	index      map[string]bitcaskLoc // Key -> location of the latest record
+	files      map[int]*os.File      // Open handles for every data file, active included
+	activeID   int                   // File currently being appended to
+	activeSize int64                 // Write offset within the active file
+	diskBytes  int64                 // Total size of all data files
+	liveBytes  int64                 // Size of the records the index points at
+	closed     bool
+	mergeMu    sync.Mutex    // Serialises merges
+	stop       chan struct{} // Closed to stop the background merge
+	wg         sync.WaitGroup
+}
+
+// OpenBitcask opens (or creates) a Bitcask in dir and rebuilds its index.
+func OpenBitcask(dir string, opts BitcaskOptions) (*Bitcask, error) {
+	if opts.MaxFileSize <= 0 {
+		opts.MaxFileSize = DefaultBitcaskMaxFileSize
+	}
+	if opts.MergeInterval == 0 {
+		opts.MergeInterval = DefaultBitcaskMergeInterval
+	}
+	if opts.MergeRatio <= 0 {
+		opts.MergeRatio = DefaultBitcaskMergeRatio
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directories: %w", err)
+	}
+
+	b := &Bitcask{
+		dir:   dir,
+		opts:  opts,
+		index: make(map[string]bitcaskLoc),
+		files: make(map[int]*os.File),
+		stop:  make(chan struct{}),
+	}
+	if err := b.recover(); err != nil {
+		b.closeFiles()
+		return nil, err
+	}
+
+	if opts.MergeInterval > 0 {
+		b.wg.Add(1)
+		go b.mergeLoop()
+	}
+	return b, nil
+}
+
+// recover rebuilds the index from the files in the directory and opens a fresh active file.
+func (b *Bitcask) recover() error {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	var dataIDs []int
+	hints := make(map[int]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, bitcaskTmpExt) {
+			// Leftovers of an interrupted merge
+			os.Remove(filepath.Join(b.dir, name))
+			continue
+		}
+		id, ext, ok := parseBitcaskName(name)
+		if !ok {
+			continue
+		}
+		switch ext {
+		case bitcaskDataExt:
+			dataIDs = append(dataIDs, id)
+		case bitcaskHintExt:
+			hints[id] = true
+		}
+	}
+	sort.Ints(dataIDs)
+
+	// A hint file is only written once a merge has completed, and the merged file
+	// supersedes every older file. Finish any cleanup the merge did not get to.
+	base := 0
+	for id := range hints {
+		base = max(base, id)
+	}
+	var live []int
+	for _, id := range dataIDs {
+		if id < base {
+			os.Remove(b.filePath(id, bitcaskDataExt))
+			os.Remove(b.filePath(id, bitcaskHintExt))
+			continue
+		}
+		live = append(live, id)
+	}
+
+	for i, id := range live {
+		newest := i == len(live)-1
+		if err := b.loadFile(id, id == base && hints[id], newest); err != nil {
+			return err
+		}
+	}
+
+	next := 1
+	if len(live) > 0 {
+		next = live[len(live)-1] + 1
+	}
+	return b.openActive(next)
+}
+
+// loadFile adds the records of one data file to the index, using its hint file when
+// it has one. A torn tail is truncated away if this is the newest file.
+func (b *Bitcask) loadFile(id int, useHint, newest bool) error {
+	file, err := os.OpenFile(b.filePath(id, bitcaskDataExt), os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open data file: %w", err)
+	}
+	b.files[id] = file
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat data file: %w", err)
+	}
+	b.diskBytes += info.Size()
+
+	if useHint {
+		err := b.loadHint(id)
+		if err == nil {
+			return nil
+		}
+		log.Printf("store: unreadable hint file for %d (%v); scanning data file", id, err)
+	}
+
+	good, err := b.scanFile(id, file)
+	if err == nil {
+		return nil
+	}
+	if !newest {
+		return fmt.Errorf("corrupt data file %d at offset %d: %w", id, good, err)
+	}
+
+	// The process died part-way through the last append; drop the partial record.
+	if err := file.Truncate(good); err != nil {
+		return fmt.Errorf("failed to truncate data file: %w", err)
+	}
+	b.diskBytes -= info.Size() - good
+	return nil
+}
+
+// scanFile reads every record in a data file in order and applies it to the index.
+// It returns the offset just past the last intact record.
+func (b *Bitcask) scanFile(id int, file *os.File) (int64, error) {
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, math.MaxInt64))
+	var offset int64
+	for {
+		key, _, tombstone, size, err := readBitcaskRecord(reader)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+
+		if tombstone {
+			b.unindex(key)
+		} else {
+			b.reindex(key, bitcaskLoc{fileID: id, offset: offset, size: size})
+		}
+		offset += size
+	}
+}
+
+// loadHint applies a hint file, which lists the location of every key in a merged file.
+func (b *Bitcask) loadHint(id int) error {
+	content, err := os.ReadFile(b.filePath(id, bitcaskHintExt))
+	if err != nil {
+		return err
+	}
+
+	locs := make(map[string]bitcaskLoc)
+	for len(content) > 0 {
+		if len(content) < bitcaskHintHeader {
+			return io.ErrUnexpectedEOF
+		}
+		keyLen := int(binary.BigEndian.Uint32(content[4:8]))
+		if len(content) < bitcaskHintHeader+keyLen {
+			return io.ErrUnexpectedEOF
+		}
+		entry := content[:bitcaskHintHeader+keyLen]
+		if crc32.ChecksumIEEE(entry[4:]) != binary.BigEndian.Uint32(entry[0:4]) {
+			return errors.New("checksum mismatch")
+		}
+		locs[string(entry[bitcaskHintHeader:])] = bitcaskLoc{
+			fileID: id,
+			size:   int64(binary.BigEndian.Uint32(entry[8:12])),
+			offset: int64(binary.BigEndian.Uint64(entry[12:20])),
+		}
+		content = content[len(entry):]
+	}
+
+	for key, loc := range locs {
+		b.reindex(key, loc)
+	}
+	return nil
+}
+
+// reindex points key at a new record, accounting for the record it replaces.
+func (b *Bitcask) reindex(key string, loc bitcaskLoc) {
+	if old, ok := b.index[key]; ok {
+		b.liveBytes -= old.size
+	}
+	b.index[key] = loc
+	b.liveBytes += loc.size
+}
+
+// unindex removes key from the index.
+func (b *Bitcask) unindex(key string) {
+	if old, ok := b.index[key]; ok {
+		b.liveBytes -= old.size
+		delete(b.index, key)
+	}
+}
+
+// openActive starts a new, empty active data file. The caller must hold the write lock
+// (or be the only user, during recovery).
+func (b *Bitcask) openActive(id int) error {
+	if active, ok := b.files[b.activeID]; ok && !b.opts.NoSync {
+		if err := active.Sync(); err != nil {
+			return fmt.Errorf("failed to sync data file: %w", err)
+		}
+	}
+
+	file, err := os.OpenFile(b.filePath(id, bitcaskDataExt), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create data file: %w", err)
+	}
+	if err := syncDir(b.dir); err != nil {
+		file.Close()
+		return err
+	}
+
+	b.files[id] = file
+	b.activeID = id
+	b.activeSize = 0
+	return nil
+}
+
+// Get returns the value stored under key, reading it from its data file.
+func (b *Bitcask) Get(key string) (string, bool, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return "", false, ErrBitcaskClosed
+	}
+
+	loc, ok := b.index[key]
+	if !ok {
+		return "", false, nil
+	}
+	value, err := b.readValue(loc)
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// readValue reads and verifies the record at loc. The caller must hold the lock.
+func (b *Bitcask) readValue(loc bitcaskLoc) (string, error) {
+	section := io.NewSectionReader(b.files[loc.fileID], loc.offset, loc.size)
+	_, value, _, _, err := readBitcaskRecord(section)
+	if err != nil {
+		return "", fmt.Errorf("failed to read record in data file %d at offset %d: %w", loc.fileID, loc.offset, err)
+	}
+	return value, nil
+}
+
+// Put appends a record for key and points the index at it.
+func (b *Bitcask) Put(key, value string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	loc, err := b.append(encodeBitcaskRecord(key, value, false))
+	if err != nil {
+		return err
+	}
+	b.reindex(key, loc)
+	return nil
+}
+
+// Delete appends a tombstone for key and removes it from the index.
+func (b *Bitcask) Delete(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.index[key]; !ok {
+		return nil
+	}
+	if _, err := b.append(encodeBitcaskRecord(key, "", true)); err != nil {
+		return err
+	}
+	b.unindex(key)
+	return nil
+}
+
+// append writes an encoded record to the active file, sealing it first if it is full.
+// The caller must hold the write lock.
+func (b *Bitcask) append(record []byte) (bitcaskLoc, error) {
+	if b.closed {
+		return bitcaskLoc{}, ErrBitcaskClosed
+	}
+
+	if b.activeSize > 0 && b.activeSize+int64(len(record)) > b.opts.MaxFileSize {
+		if err := b.openActive(b.activeID + 1); err != nil {
+			return bitcaskLoc{}, err
+		}
+	}
+
+	active := b.files[b.activeID]
+	if _, err := active.WriteAt(record, b.activeSize); err != nil {
+		return bitcaskLoc{}, fmt.Errorf("failed to write record: %w", err)
+	}
+	if !b.opts.NoSync {
+		if err := active.Sync(); err != nil {
+			return bitcaskLoc{}, fmt.Errorf("failed to sync data file: %w", err)
+		}
+	}
+
+	loc := bitcaskLoc{fileID: b.activeID, offset: b.activeSize, size: int64(len(record))}
+	b.activeSize += loc.size
+	b.diskBytes += loc.size
+	return loc, nil
+}
+
+// Iterate calls fn for every live key-value pair until fn returns false.
+func (b *Bitcask) Iterate(fn func(key, value string) bool) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return ErrBitcaskClosed
+	}
+
+	for key, loc := range b.index {
+		value, err := b.readValue(loc)
+		if err != nil {
+			return err
+		}
+		if !fn(key, value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Sync flushes the active data file to disk. It is only needed with NoSync set.
+func (b *Bitcask) Sync() error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return ErrBitcaskClosed
+	}
+	return b.files[b.activeID].Sync()
+}
+
+// Close stops the background merge and closes every data file.
+func (b *Bitcask) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.stop)
+	b.mu.Unlock()
+
+	b.wg.Wait()
+
+	// Wait for a merge triggered by a caller to finish with the files.
+	b.mergeMu.Lock()
+	defer b.mergeMu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var firstErr error
+	if !b.opts.NoSync {
+		firstErr = b.files[b.activeID].Sync()
+	}
+	if err := b.closeFiles(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// closeFiles closes every open data file.
+func (b *Bitcask) closeFiles() error {
+	var firstErr error
+	for id, file := range b.files {
+		if err := file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(b.files, id)
+	}
+	return firstErr
+}
+
+// mergeLoop periodically merges once enough of the data on disk is stale.
+func (b *Bitcask) mergeLoop() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.opts.MergeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			if !b.needsMerge() {
+				continue
+			}
+			if err := b.Merge(); err != nil && !errors.Is(err, ErrBitcaskClosed) {
+				log.Printf("store: bitcask merge failed: %v", err)
+			}
+		}
+	}
+}
+
+// needsMerge reports whether the stale fraction of the data on disk exceeds the merge ratio.
+func (b *Bitcask) needsMerge() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	stale := b.diskBytes - b.liveBytes
+	return stale >= bitcaskMinMerge && float64(stale) >= b.opts.MergeRatio*float64(b.diskBytes)
+}
+
+// Merge compacts every data file written so far into a single file holding only live
+// records, plus a hint file for fast startup. Writes continue in a new active file
+// while the merge runs.
+func (b *Bitcask) Merge() error {
+	b.mergeMu.Lock()
+	defer b.mergeMu.Unlock()
+
+	// Seal the active file so that everything written so far becomes merge input.
+	// The merged file takes the ID just above the inputs and below the new active
+	// file, so on recovery it overrides the inputs and is overridden by newer writes.
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrBitcaskClosed
+	}
+	mergedID := b.activeID + 1
+	if err := b.openActive(b.activeID + 2); err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	snapshot := make(map[string]bitcaskLoc, len(b.index))
+	for key, loc := range b.index {
+		if loc.fileID < mergedID {
+			snapshot[key] = loc
+		}
+	}
+	var inputs []int
+	for id := range b.files {
+		if id < mergedID {
+			inputs = append(inputs, id)
+		}
+	}
+	b.mu.Unlock()
+
+	merged, err := b.writeMerged(mergedID, snapshot)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(b.filePath(mergedID, bitcaskDataExt), os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open merged file: %w", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.files[mergedID] = file
+	for key, old := range snapshot {
+		// Keys written or deleted during the merge keep their newer state.
+		if cur, ok := b.index[key]; ok && cur == old {
+			b.index[key] = merged[key]
+		}
+	}
+	for _, id := range inputs {
+		if f, ok := b.files[id]; ok {
+			f.Close()
+			delete(b.files, id)
+		}
+		os.Remove(b.filePath(id, bitcaskDataExt))
+		os.Remove(b.filePath(id, bitcaskHintExt))
+	}
+
+	b.diskBytes = 0
+	for _, f := range b.files {
+		if info, err := f.Stat(); err == nil {
+			b.diskBytes += info.Size()
+		}
+	}
+	return nil
+}
+
+// writeMerged copies the records in snapshot into a new data file and writes its hint
+// file. The hint file is renamed into place last: its presence marks the merge as
+// complete and the input files as obsolete.
+func (b *Bitcask) writeMerged(id int, snapshot map[string]bitcaskLoc) (map[string]bitcaskLoc, error) {
+	dataPath := b.filePath(id, bitcaskDataExt)
+	hintPath := b.filePath(id, bitcaskHintExt)
+
+	data, err := os.Create(dataPath + bitcaskTmpExt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create merge file: %w", err)
+	}
+	defer os.Remove(data.Name())
+	defer data.Close()
+
+	hint, err := os.Create(hintPath + bitcaskTmpExt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create hint file: %w", err)
+	}
+	defer os.Remove(hint.Name())
+	defer hint.Close()
+
+	dataWriter := bufio.NewWriter(data)
+	hintWriter := bufio.NewWriter(hint)
+	merged := make(map[string]bitcaskLoc, len(snapshot))
+	var offset int64
+
+	for key, loc := range snapshot {
+		record := make([]byte, loc.size)
+		b.mu.RLock()
+		_, err := b.files[loc.fileID].ReadAt(record, loc.offset)
+		b.mu.RUnlock()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read record for merge: %w", err)
+		}
+
+		if _, err := dataWriter.Write(record); err != nil {
+			return nil, fmt.Errorf("failed to write merge file: %w", err)
+		}
+		if _, err := hintWriter.Write(encodeBitcaskHint(key, loc.size, offset)); err != nil {
+			return nil, fmt.Errorf("failed to write hint file: %w", err)
+		}
+		merged[key] = bitcaskLoc{fileID: id, offset: offset, size: loc.size}
+		offset += loc.size
+	}
+
+	for _, f := range []struct {
+		w    *bufio.Writer
+		file *os.File
+	}{{dataWriter, data}, {hintWriter, hint}} {
+		if err := f.w.Flush(); err != nil {
+			return nil, fmt.Errorf("failed to write merge output: %w", err)
+		}
+		if err := f.file.Sync(); err != nil {
+			return nil, fmt.Errorf("failed to sync merge output: %w", err)
+		}
+	}
+
+	if err := os.Rename(data.Name(), dataPath); err != nil {
+		return nil, fmt.Errorf("failed to install merge file: %w", err)
+	}
+	if err := os.Rename(hint.Name(), hintPath); err != nil {
+		return nil, fmt.Errorf("failed to install hint file: %w", err)
+	}
+	if err := syncDir(b.dir); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// filePath returns the path of a data or hint file.
+func (b *Bitcask) filePath(id int, ext string) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%09d%s", id, ext))
+}
+
+// parseBitcaskName splits a file name such as 000000042.data into its ID and extension.
+func parseBitcaskName(name string) (int, string, bool) {
+	ext := filepath.Ext(name)
+	if ext != bitcaskDataExt && ext != bitcaskHintExt {
+		return 0, "", false
+	}
+	id, err := strconv.Atoi(strings.TrimSuffix(name, ext))
+	if err != nil {
+		return 0, "", false
+	}
+	return id, ext, true
+}
+
+// encodeBitcaskRecord encodes a data record:
+// crc32 (4) | key length (4) | value length or tombstone (4) | key | value.
+// The checksum covers everything after itself.
+func encodeBitcaskRecord(key, value string, tombstone bool) []byte {
+	record := make([]byte, bitcaskHeaderSize+len(key)+len(value))
+	binary.BigEndian.PutUint32(record[4:8], uint32(len(key)))
+	if tombstone {
+		binary.BigEndian.PutUint32(record[8:12], bitcaskTombstone)
+	} else {
+		binary.BigEndian.PutUint32(record[8:12], uint32(len(value)))
+	}
+	copy(record[bitcaskHeaderSize:], key)
+	copy(record[bitcaskHeaderSize+len(key):], value)
+	binary.BigEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
+	return record
+}
+
+// readBitcaskRecord reads and verifies one data record.
+// It returns io.EOF only if r is exhausted before the record starts.
+func readBitcaskRecord(r io.Reader) (key, value string, tombstone bool, size int64, err error) {
+	header := make([]byte, bitcaskHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", "", false, 0, err // io.EOF if nothing was read, io.ErrUnexpectedEOF if torn
+	}
+
+	keyLen := binary.BigEndian.Uint32(header[4:8])
+	valueLen := binary.BigEndian.Uint32(header[8:12])
+	tombstone = valueLen == bitcaskTombstone
+	if tombstone {
+		valueLen = 0
+	}
+
+	body := make([]byte, int(keyLen)+int(valueLen))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return "", "", false, 0, io.ErrUnexpectedEOF
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(body)
+	if crc.Sum32() != binary.BigEndian.Uint32(header[0:4]) {
+		return "", "", false, 0, errors.New("checksum mismatch")
+	}
+
+	size = int64(bitcaskHeaderSize + len(body))
+	return string(body[:keyLen]), string(body[keyLen:]), tombstone, size, nil
+}
+
+// encodeBitcaskHint encodes a hint entry:
+// crc32 (4) | key length (4) | record size (4) | record offset (8) | key.
+func encodeBitcaskHint(key string, size, offset int64) []byte {
+	entry := make([]byte, bitcaskHintHeader+len(key))
+	binary.BigEndian.PutUint32(entry[4:8], uint32(len(key)))
+	binary.BigEndian.PutUint32(entry[8:12], uint32(size))
+	binary.BigEndian.PutUint64(entry[12:20], uint64(offset))
+	copy(entry[bitcaskHintHeader:], key)
+	binary.BigEndian.PutUint32(entry[0:4], crc32.ChecksumIEEE(entry[4:]))
+	return entry
+}
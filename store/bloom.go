@@ -0,0 +1,79 @@
+// Package store implements the bloom filter stored in each SSTable, which lets a lookup
+// skip tables that certainly do not contain a key without touching their data.
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+)
+
+// bloomBitsPerKey sizes filters for roughly a 1% false-positive rate.
+const bloomBitsPerKey = 10
+
+// bloomFilter is a fixed-size bloom filter using double hashing.
+type bloomFilter struct {
+	bits   []byte // Filter bits
+	hashes uint32 // Number of hash functions
+}
+
+// newBloomFilter returns a filter sized for n keys.
+func newBloomFilter(n int) *bloomFilter {
+	nbits := max(n*bloomBitsPerKey, 64)
+	hashes := uint32(math.Round(bloomBitsPerKey * math.Ln2))
+	return &bloomFilter{
+		bits:   make([]byte, (nbits+7)/8),
+		hashes: max(hashes, 1),
+	}
+}
+
+// add records key in the filter.
+func (f *bloomFilter) add(key string) {
+	h1, h2 := bloomHash(key)
+	nbits := uint64(len(f.bits) * 8)
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % nbits
+		f.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// mayContain reports whether key might have been added. False means it definitely was not.
+func (f *bloomFilter) mayContain(key string) bool {
+	h1, h2 := bloomHash(key)
+	nbits := uint64(len(f.bits) * 8)
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % nbits
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHash derives the two base hashes for double hashing from a single FNV-1a hash.
+func bloomHash(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return sum & math.MaxUint32, sum>>32 | 1 // The second hash must be odd to cycle through every bit
+}
+
+// marshal encodes the filter as: hash count (4) | bits.
+func (f *bloomFilter) marshal() []byte {
+	out := make([]byte, 4+len(f.bits))
+	binary.BigEndian.PutUint32(out, f.hashes)
+	copy(out[4:], f.bits)
+	return out
+}
+
+// unmarshalBloomFilter decodes a filter written by marshal.
+func unmarshalBloomFilter(data []byte) (*bloomFilter, error) {
+	if len(data) < 5 {
+		return nil, errors.New("bloom filter too short")
+	}
+	return &bloomFilter{
+		hashes: binary.BigEndian.Uint32(data),
+		bits:   data[4:],
+	}, nil
+}
@@ -0,0 +1,383 @@
+// Package store implements CachedBackend, a memory-bounded read cache in front of an
+// on-disk Backend. Every value lives on disk and writes go straight through, so cold
+// entries are evicted by simply dropping them from memory and are read back from disk
+// the next time they are needed. Paired with Bitcask or the LSM engine, memory use is
+// bounded by the cache budget rather than by the size of the dataset.
+package store
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+)
+
+// DefaultCacheBytes is the cache budget used when CacheOptions.MaxBytes is not set.
+const DefaultCacheBytes = 64 << 20
+
+// cacheEntryOverhead approximates the bookkeeping cost of one cached entry, in bytes.
+const cacheEntryOverhead = 64
+
+// CachePolicy selects which entry is evicted when the cache is over budget.
+type CachePolicy int
+
+const (
+	// CacheLRU evicts the least recently used entry.
+	CacheLRU CachePolicy = iota
+	// CacheLFU evicts the least frequently used entry, breaking ties by recency.
+	CacheLFU
+)
+
+// CacheOptions configures a CachedBackend.
+type CacheOptions struct {
+	MaxBytes int64       // Memory budget for cached keys and values; 0 selects DefaultCacheBytes
+	Policy   CachePolicy // Eviction policy
+}
+
+// CacheStats reports how well a CachedBackend is serving reads.
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`      // Reads served from memory
+	Misses    uint64 `json:"misses"`    // Reads that went to disk
+	Evictions uint64 `json:"evictions"` // Entries dropped to stay within budget
+	Entries   int    `json:"entries"`   // Entries currently cached
+	Bytes     int64  `json:"bytes"`     // Approximate memory used by cached entries
+	MaxBytes  int64  `json:"maxBytes"`  // Memory budget
+}
+
+// HitRate returns the fraction of reads served from memory.
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// cacheEntry is one cached key-value pair.
+type cacheEntry struct {
+	key   string
+	value string
+	found bool          // False caches the key's absence
+	size  int64         // Approximate memory used by the entry
+	freq  int           // Number of accesses, for LFU
+	elem  *list.Element // Position in the recency list (LRU) or frequency bucket (LFU)
+}
+
+// CachedBackend keeps recently or frequently read values in memory, within a byte
+// budget, in front of a slower Backend that holds every value.
+type CachedBackend struct {
+	disk     Backend     // Backend holding every value
+	maxBytes int64       // Memory budget
+	policy   CachePolicy // Eviction policy
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	bytes   int64              // Memory used by cached entries
+	recency *list.List         // LRU order, most recent first
+	buckets map[int]*list.List // LFU entries by access count, most recent first
+	minFreq int                // Lowest access count with a non-empty bucket
+	writes  uint64             // Incremented by every write, to detect races with disk reads
+
+	hits, misses, evictions uint64
+}
+
+// NewCachedBackend returns a backend that caches reads from disk within opts.MaxBytes.
+func NewCachedBackend(disk Backend, opts CacheOptions) *CachedBackend {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultCacheBytes
+	}
+	return &CachedBackend{
+		disk:     disk,
+		maxBytes: opts.MaxBytes,
+		policy:   opts.Policy,
+		entries:  make(map[string]*cacheEntry),
+		recency:  list.New(),
+		buckets:  make(map[int]*list.List),
+	}
+}
+
+// Disk returns the backend behind the cache.
+func (c *CachedBackend) Disk() Backend {
+	return c.disk
+}
+
+// Get returns the value stored under key, from memory if it is cached.
+func (c *CachedBackend) Get(key string) (string, bool, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.hits++
+		c.touchLocked(e)
+		c.mu.Unlock()
+		return e.value, e.found, nil
+	}
+	c.misses++
+	writes := c.writes
+	c.mu.Unlock()
+
+	value, found, err := c.disk.Get(key)
+	if err != nil {
+		return "", false, err
+	}
+
+	// Only cache what was read if no write could have changed it in the meantime.
+	c.mu.Lock()
+	if c.writes == writes {
+		c.storeLocked(key, value, found)
+	}
+	c.mu.Unlock()
+	return value, found, nil
+}
+
+// Put writes value to disk. The next read of key caches it.
+func (c *CachedBackend) Put(key, value string) error {
+	err := c.disk.Put(key, value)
+	c.invalidate(key)
+	return err
+}
+
+// Delete removes key from disk and from the cache.
+func (c *CachedBackend) Delete(key string) error {
+	err := c.disk.Delete(key)
+	c.invalidate(key)
+	return err
+}
+
+// WriteBatch applies ops to disk, atomically if the disk backend supports it.
+func (c *CachedBackend) WriteBatch(ops []BatchOp) error {
+	err := writeBatch(c.disk, ops)
+	for _, op := range ops {
+		c.invalidate(op.Key)
+	}
+	return err
+}
+
+// WriteBatchAt applies ops to disk as the store's revision rev, keeping the revision
+// however the disk backend does.
+func (c *CachedBackend) WriteBatchAt(rev uint64, ops []BatchOp) error {
+	err := writeBatchAt(c.disk, rev, ops)
+	c.invalidate(revisionKey)
+	for _, op := range ops {
+		c.invalidate(op.Key)
+	}
+	return err
+}
+
+// Iterate calls fn for every key-value pair on disk until fn returns false.
+// Iteration does not populate the cache.
+func (c *CachedBackend) Iterate(fn func(key, value string) bool) error {
+	return c.disk.Iterate(fn)
+}
+
+// Range calls fn, in key order, for every key in [start, end) until fn returns false.
+func (c *CachedBackend) Range(start, end string, fn func(key, value string) bool) error {
+	if r, ok := c.disk.(RangeIterator); ok {
+		return r.Range(start, end, fn)
+	}
+	return rangeBySorting(c.disk, start, end, fn)
+}
+
+// Clear removes every key from disk and empties the cache.
+func (c *CachedBackend) Clear() error {
+	defer c.reset()
+
+	if cl, ok := c.disk.(Clearer); ok {
+		return cl.Clear()
+	}
+	var keys []string
+	if err := c.disk.Iterate(func(key, _ string) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := c.disk.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load reloads the disk backend, if it supports it, and empties the cache.
+func (c *CachedBackend) Load() error {
+	defer c.reset()
+
+	if p, ok := c.disk.(Persister); ok {
+		return p.Load()
+	}
+	return nil
+}
+
+// Save persists the disk backend, if it supports it.
+func (c *CachedBackend) Save() error {
+	if p, ok := c.disk.(Persister); ok {
+		return p.Save()
+	}
+	return nil
+}
+
+// Close closes the disk backend.
+func (c *CachedBackend) Close() error {
+	c.reset()
+	return c.disk.Close()
+}
+
+// Stats returns the cache's hit/miss counters and memory use.
+func (c *CachedBackend) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   len(c.entries),
+		Bytes:     c.bytes,
+		MaxBytes:  c.maxBytes,
+	}
+}
+
+// invalidate drops key from the cache after a write.
+func (c *CachedBackend) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writes++
+	if e, ok := c.entries[key]; ok {
+		c.removeLocked(e)
+	}
+}
+
+// reset empties the cache after a write that touched every key.
+func (c *CachedBackend) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writes++
+	c.entries = make(map[string]*cacheEntry)
+	c.bytes = 0
+	c.recency.Init()
+	c.buckets = make(map[int]*list.List)
+	c.minFreq = 0
+}
+
+// storeLocked caches key's value read from disk, then evicts entries until the
+// cache is within budget. Concurrent misses on the same key may both store it.
+func (c *CachedBackend) storeLocked(key, value string, found bool) {
+	if e, ok := c.entries[key]; ok {
+		c.removeLocked(e)
+	}
+
+	e := &cacheEntry{
+		key:   key,
+		value: value,
+		found: found,
+		size:  int64(len(key)+len(value)) + cacheEntryOverhead,
+	}
+	if e.size > c.maxBytes {
+		return // Larger than the whole budget; always read from disk
+	}
+
+	c.entries[key] = e
+	c.bytes += e.size
+	if c.policy == CacheLFU {
+		e.freq = 1
+		e.elem = c.bucketLocked(1).PushFront(e)
+		c.minFreq = 1
+	} else {
+		e.elem = c.recency.PushFront(e)
+	}
+
+	for c.bytes > c.maxBytes {
+		c.removeLocked(c.victimLocked())
+		c.evictions++
+	}
+}
+
+// touchLocked records an access to e.
+func (c *CachedBackend) touchLocked(e *cacheEntry) {
+	if c.policy != CacheLFU {
+		c.recency.MoveToFront(e.elem)
+		return
+	}
+
+	c.unlinkLocked(e)
+	e.freq++
+	e.elem = c.bucketLocked(e.freq).PushFront(e)
+	if _, ok := c.buckets[c.minFreq]; !ok {
+		c.minFreq = e.freq
+	}
+}
+
+// removeLocked drops e from the cache.
+func (c *CachedBackend) removeLocked(e *cacheEntry) {
+	c.unlinkLocked(e)
+	delete(c.entries, e.key)
+	c.bytes -= e.size
+}
+
+// unlinkLocked removes e from its recency list or frequency bucket.
+func (c *CachedBackend) unlinkLocked(e *cacheEntry) {
+	if c.policy != CacheLFU {
+		c.recency.Remove(e.elem)
+		return
+	}
+
+	bucket := c.buckets[e.freq]
+	bucket.Remove(e.elem)
+	if bucket.Len() == 0 {
+		delete(c.buckets, e.freq)
+	}
+}
+
+// bucketLocked returns the LFU bucket for freq, creating it if needed.
+func (c *CachedBackend) bucketLocked(freq int) *list.List {
+	bucket, ok := c.buckets[freq]
+	if !ok {
+		bucket = list.New()
+		c.buckets[freq] = bucket
+	}
+	return bucket
+}
+
+// victimLocked returns the entry to evict next. The cache must not be empty.
+func (c *CachedBackend) victimLocked() *cacheEntry {
+	if c.policy != CacheLFU {
+		return c.recency.Back().Value.(*cacheEntry)
+	}
+
+	// minFreq goes stale when its last entry is removed rather than touched.
+	if _, ok := c.buckets[c.minFreq]; !ok {
+		c.minFreq = 0
+		for freq := range c.buckets {
+			if c.minFreq == 0 || freq < c.minFreq {
+				c.minFreq = freq
+			}
+		}
+	}
+	return c.buckets[c.minFreq].Back().Value.(*cacheEntry)
+}
+
+// rangeBySorting serves a range read from a backend without sorted keys by visiting
+// every key and sorting the matches.
+func rangeBySorting(b Backend, start, end string, fn func(key, value string) bool) error {
+	matches := make(map[string]string)
+	if err := b.Iterate(func(key, value string) bool {
+		if key >= start && (end == "" || key < end) {
+			matches[key] = value
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(matches))
+	for key := range matches {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !fn(key, matches[key]) {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+// Package store implements compression of the files the store persists. A Codec wraps
+// the bytes written to the data file, its backups and named snapshots; every registered
+// codec has a magic header, so reads detect how a file was written instead of relying
+// on configuration, and files written before compression was enabled still load.
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec compresses persisted files.
+type Codec interface {
+	// Name identifies the codec, e.g. in WithCompression and error messages.
+	Name() string
+	// Magic returns the bytes every output of the codec starts with.
+	Magic() []byte
+	// NewWriter returns a writer compressing into w; closing it flushes the output.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// NewReader returns a reader decompressing r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// Gzip compresses files with compress/gzip at the default compression level.
+var Gzip Codec = gzipCodec{level: gzip.DefaultCompression}
+
+// GzipLevel returns a gzip codec using the given compress/gzip compression level.
+func GzipLevel(level int) Codec {
+	return gzipCodec{level: level}
+}
+
+// gzipCodec is the built-in gzip Codec.
+type gzipCodec struct {
+	level int // compress/gzip compression level
+}
+
+func (gzipCodec) Name() string  { return "gzip" }
+func (gzipCodec) Magic() []byte { return []byte{0x1f, 0x8b} }
+
+func (c gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.level)
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// codecs holds every codec that files can be read with, by name.
+var codecs = struct {
+	sync.RWMutex
+	byName map[string]Codec
+}{byName: map[string]Codec{"gzip": Gzip}}
+
+// RegisterCodec makes files written by c readable. A codec passed to WithCompression
+// is registered automatically; others only need registering to read files written by
+// another configuration. The magic header must not start with '{', which marks an
+// uncompressed file, or clash with another codec's.
+func RegisterCodec(c Codec) error {
+	magic := c.Magic()
+	if c.Name() == "" || len(magic) == 0 {
+		return errors.New("codec needs a name and a magic header")
+	}
+	if magic[0] == '{' {
+		return errors.New("codec magic header would be mistaken for uncompressed JSON")
+	}
+
+	codecs.Lock()
+	defer codecs.Unlock()
+
+	for name, other := range codecs.byName {
+		if name == c.Name() {
+			continue
+		}
+		m := other.Magic()
+		if bytes.HasPrefix(magic, m) || bytes.HasPrefix(m, magic) {
+			return fmt.Errorf("codec magic header clashes with %q", name)
+		}
+	}
+	codecs.byName[c.Name()] = c
+	return nil
+}
+
+// LookupCodec returns the registered codec with the given name.
+func LookupCodec(name string) (Codec, bool) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+
+	c, ok := codecs.byName[name]
+	return c, ok
+}
+
+// detectCodec returns the codec that wrote content, or nil if it is uncompressed.
+func detectCodec(content []byte) Codec {
+	codecs.RLock()
+	defer codecs.RUnlock()
+
+	for _, c := range codecs.byName {
+		if bytes.HasPrefix(content, c.Magic()) {
+			return c
+		}
+	}
+	return nil
+}
+
+// compress encodes content with c; a nil codec leaves it as it is.
+func compress(c Codec, content []byte) ([]byte, error) {
+	if c == nil {
+		return content, nil
+	}
+
+	var buf bytes.Buffer
+	w, err := c.NewWriter(&buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress with %s: %w", c.Name(), err)
+	}
+	if _, err := w.Write(content); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("failed to compress with %s: %w", c.Name(), err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress with %s: %w", c.Name(), err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress decodes content with the codec its magic header names. Content without
+// one is returned as it is.
+func decompress(content []byte) ([]byte, error) {
+	c := detectCodec(content)
+	if c == nil {
+		return content, nil
+	}
+
+	r, err := c.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s: %w", c.Name(), err)
+	}
+	defer r.Close()
+
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s: %w", c.Name(), err)
+	}
+	return plain, nil
+}
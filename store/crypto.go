@@ -0,0 +1,296 @@
+// Package store implements encryption at rest. Persisted files and write-ahead log
+// records are sealed with AES-GCM under the active key of a Keyring, and each one names
+// the key it was sealed with in its header. Rotating to a new key only changes what is
+// written from then on: anything sealed under an older key stays readable for as long
+// as that key remains in the keyring.
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultKeyEnv is the environment variable KeyringFromEnv reads by convention.
+const DefaultKeyEnv = "KVSTORE_ENCRYPTION_KEYS"
+
+// encryptedMagic starts every encrypted file and log record.
+var encryptedMagic = []byte("KVENC1")
+
+// ErrNoKeys is returned when reading encrypted data without a keyring.
+var ErrNoKeys = errors.New("data is encrypted but no encryption keys are configured")
+
+// ErrEncryptionUnsupported is returned by a store created with WithEncryption whose
+// backend writes its own files in plaintext, such as Bitcask or the LSM engine.
+var ErrEncryptionUnsupported = errors.New("backend cannot encrypt its files; WithEncryption needs an encrypted file backend")
+
+// Keyring holds the AES keys data is encrypted with, by ID. New data is sealed under
+// the active key; data sealed under any key in the ring can be read.
+type Keyring struct {
+	mu     sync.RWMutex
+	keys   map[string]cipher.AEAD // AES-GCM instances by key ID
+	active string                 // ID of the key new data is sealed under
+	path   string                 // Key file Rotate appends new keys to; empty if none
+}
+
+// NewKeyring returns an empty keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string]cipher.AEAD)}
+}
+
+// Add adds a 16, 24 or 32-byte AES key under id and makes it the active key.
+func (k *Keyring) Add(id string, key []byte) error {
+	if id == "" || len(id) > 255 || !namePattern.MatchString(id) {
+		return fmt.Errorf("invalid key ID %q", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("invalid key %q: %w", id, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("invalid key %q: %w", id, err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys[id] = aead
+	k.active = id
+	return nil
+}
+
+// Active returns the ID of the key new data is sealed under.
+func (k *Keyring) Active() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.active
+}
+
+// LoadKeyFile reads a keyring from a file with one key per line, written as
+// "<id>:<base64 key>"; blank lines and lines starting with '#' are ignored, and a bare
+// base64 key gets the ID "default". The last key is active. Keys added by Rotate are
+// appended to the file.
+func LoadKeyFile(path string) (*Keyring, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	k := NewKeyring()
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := k.addEncoded(line); err != nil {
+			return nil, fmt.Errorf("failed to load key file: %w", err)
+		}
+	}
+	if k.active == "" {
+		return nil, errors.New("key file holds no keys")
+	}
+	k.path = path
+	return k, nil
+}
+
+// KeyringFromEnv reads a keyring from the environment variable name, holding one or
+// more comma-separated keys in the key file format. The last key is active. Such a
+// keyring cannot Rotate, since there is nowhere to record the new key.
+func KeyringFromEnv(name string) (*Keyring, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
+	}
+
+	k := NewKeyring()
+	for _, entry := range strings.Split(value, ",") {
+		if err := k.addEncoded(strings.TrimSpace(entry)); err != nil {
+			return nil, fmt.Errorf("failed to load keys from %s: %w", name, err)
+		}
+	}
+	return k, nil
+}
+
+// Rotate generates a new 256-bit key, records it in the key file and makes it active,
+// returning its ID. Data already sealed is not touched; see Store.RotateKey.
+func (k *Keyring) Rotate() (string, error) {
+	if k.path == "" {
+		return "", errors.New("keyring has no key file to record a new key in")
+	}
+
+	key := make([]byte, 32)
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	id := fmt.Sprintf("key-%s-%s", time.Now().UTC().Format("20060102T150405"), hex.EncodeToString(suffix))
+
+	// The key is on disk before anything is sealed under it.
+	file, err := os.OpenFile(k.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to open key file: %w", err)
+	}
+	_, err = fmt.Fprintf(file, "%s:%s\n", id, base64.StdEncoding.EncodeToString(key))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to record key: %w", err)
+	}
+
+	if err := k.Add(id, key); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// addEncoded adds a key given as "<id>:<base64 key>" or a bare base64 key.
+func (k *Keyring) addEncoded(entry string) error {
+	id, encoded, found := strings.Cut(entry, ":")
+	if !found {
+		id, encoded = "default", entry
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("key %q is not valid base64: %w", id, err)
+	}
+	return k.Add(id, key)
+}
+
+// seal encrypts plain under the active key. The output is the magic header, the key
+// ID, a random nonce and the ciphertext; the header is authenticated with it.
+func (k *Keyring) seal(plain []byte) ([]byte, error) {
+	k.mu.RLock()
+	id, aead := k.active, k.keys[k.active]
+	k.mu.RUnlock()
+	if aead == nil {
+		return nil, errors.New("keyring has no active key")
+	}
+
+	header := append(append(append([]byte(nil), encryptedMagic...), byte(len(id))), id...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	out := append(append([]byte(nil), header...), nonce...)
+	return aead.Seal(out, nonce, plain, header), nil
+}
+
+// open decrypts data written by seal, with whichever key it names.
+func (k *Keyring) open(data []byte) ([]byte, error) {
+	rest := data[len(encryptedMagic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+		return nil, errors.New("encrypted data has a truncated header")
+	}
+	id := string(rest[1 : 1+rest[0]])
+	header := data[:len(encryptedMagic)+1+len(id)]
+
+	k.mu.RLock()
+	aead := k.keys[id]
+	k.mu.RUnlock()
+	if aead == nil {
+		return nil, fmt.Errorf("encryption key %q is not in the keyring", id)
+	}
+
+	body := data[len(header):]
+	if len(body) < aead.NonceSize() {
+		return nil, errors.New("encrypted data is truncated")
+	}
+	plain, err := aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt with key %q: %w", id, err)
+	}
+	return plain, nil
+}
+
+// isEncrypted reports whether data was written by seal.
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedMagic)
+}
+
+// sealFile prepares content for writing to disk: compressed with c, if set, then
+// encrypted under the active key, if keys is set.
+func sealFile(content []byte, c Codec, keys *Keyring) ([]byte, error) {
+	content, err := compress(c, content)
+	if err != nil || keys == nil {
+		return content, err
+	}
+	return keys.seal(content)
+}
+
+// openFile reverses sealFile, recognising encryption and compression by their headers.
+func openFile(content []byte, keys *Keyring) ([]byte, error) {
+	if isEncrypted(content) {
+		if keys == nil {
+			return nil, ErrNoKeys
+		}
+		plain, err := keys.open(content)
+		if err != nil {
+			return nil, err
+		}
+		content = plain
+	}
+	return decompress(content)
+}
+
+// RotateKey switches the store to a newly generated encryption key, recorded in the
+// keyring's key file, and rewrites the data file and open namespaces under it.
+// Named snapshots, backups and unopened namespaces keep the key they were written
+// with, and stay readable as long as it remains in the key file. It returns the new
+// key's ID.
+func (s *Store) RotateKey() (string, error) {
+	if s.keys == nil {
+		return "", errors.New("encryption is not enabled")
+	}
+	if err := s.writable(); err != nil {
+		return "", err
+	}
+
+	id, err := s.keys.Rotate()
+	if err != nil {
+		return "", err
+	}
+	if err := s.Save(); err != nil {
+		return "", fmt.Errorf("failed to re-encrypt data: %w", err)
+	}
+	return id, nil
+}
+
+// checkEncryption returns ErrEncryptionUnsupported if keys are set but b would write
+// files they do not cover. Backends that write nothing to disk pass.
+func checkEncryption(b Backend, keys *Keyring) error {
+	if keys == nil {
+		return nil
+	}
+	switch b := b.(type) {
+	case *FileBackend:
+		if b.keys != nil {
+			return nil
+		}
+	case *MemoryBackend:
+		return nil
+	case *CachedBackend:
+		return checkEncryption(b.disk, keys)
+	}
+	return fmt.Errorf("%w: %T", ErrEncryptionUnsupported, b)
+}
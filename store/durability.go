@@ -0,0 +1,267 @@
+// Package store implements durability policies: when the store saves itself without
+// being asked. A store can save after every write, in the background once enough
+// writes have built up or enough time has passed, or only when Save is called. It
+// keeps track of how far the data on disk lags behind memory, and Close makes a final
+// save before shutting down.
+package store
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// DurabilityMode selects when a store saves itself.
+type DurabilityMode int
+
+const (
+	// DurabilityManual only saves when Save or Close is called.
+	DurabilityManual DurabilityMode = iota
+	// DurabilityEveryWrite saves after every write, before the write returns.
+	DurabilityEveryWrite
+	// DurabilityPeriodic saves in the background every DurabilityOptions.Writes
+	// writes and every DurabilityOptions.Interval, whichever comes first.
+	DurabilityPeriodic
+)
+
+// String returns the mode's name as reported in stats.
+func (m DurabilityMode) String() string {
+	switch m {
+	case DurabilityEveryWrite:
+		return "every-write"
+	case DurabilityPeriodic:
+		return "periodic"
+	default:
+		return "manual"
+	}
+}
+
+// MarshalText encodes the mode by name.
+func (m DurabilityMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// DurabilityOptions configures when a store saves itself.
+type DurabilityOptions struct {
+	Mode     DurabilityMode // When to save
+	Writes   int            // Periodic: unsaved writes that trigger a save; 0 disables the trigger
+	Interval time.Duration  // Periodic: time between saves; 0 disables the timer
+}
+
+// DurabilityStats reports how far the data on disk lags behind memory.
+type DurabilityStats struct {
+	Mode          DurabilityMode `json:"mode"`                // When the store saves itself
+	UnsavedWrites uint64         `json:"unsavedWrites"`       // Writes made since the last successful save
+	UnsavedFor    time.Duration  `json:"unsavedFor"`          // Age of the oldest unsaved write
+	LastSave      time.Time      `json:"lastSave"`            // When the last successful save started
+	Saves         uint64         `json:"saves"`               // Successful saves
+	Failures      uint64         `json:"failures"`            // Failed saves
+	LastError     string         `json:"lastError,omitempty"` // Error from the last failed save, if it has not succeeded since
+}
+
+// durability tracks unsaved writes and runs the background saver.
+type durability struct {
+	opts DurabilityOptions
+
+	mu         sync.Mutex
+	unsaved    uint64    // Writes since the last successful save
+	firstDirty time.Time // When the oldest unsaved write was made
+	lastSave   time.Time // When the last successful save started
+	saves      uint64    // Successful saves
+	failures   uint64    // Failed saves
+	lastErr    error     // Error from the last failed save; cleared by a success
+
+	kick     chan struct{} // Wakes the background saver once enough writes have built up
+	stop     chan struct{} // Closed to stop the background saver
+	done     chan struct{} // Closed when the background saver has stopped
+	stopOnce sync.Once
+}
+
+// newDurability returns a tracker for the given policy. The background saver is
+// started separately, by start.
+func newDurability(opts DurabilityOptions) *durability {
+	return &durability{
+		opts: opts,
+		kick: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// start runs the background saver for a periodic policy, calling save whenever a save
+// is due. Other policies need no background work.
+func (d *durability) start(save func()) {
+	if d.opts.Mode != DurabilityPeriodic {
+		close(d.done)
+		return
+	}
+
+	go func() {
+		defer close(d.done)
+
+		var tick <-chan time.Time
+		if d.opts.Interval > 0 {
+			ticker := time.NewTicker(d.opts.Interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-tick:
+			case <-d.kick:
+			}
+			if d.pending() > 0 {
+				save()
+			}
+		}
+	}()
+}
+
+// halt stops the background saver and waits for a save in progress to finish.
+func (d *durability) halt() {
+	d.stopOnce.Do(func() { close(d.stop) })
+	<-d.done
+}
+
+// wrote records n writes and reports whether the caller must save before returning.
+func (d *durability) wrote(n int) bool {
+	d.mu.Lock()
+	if d.unsaved == 0 {
+		d.firstDirty = time.Now()
+	}
+	d.unsaved += uint64(n)
+	due := d.opts.Writes > 0 && d.unsaved >= uint64(d.opts.Writes)
+	d.mu.Unlock()
+
+	switch d.opts.Mode {
+	case DurabilityEveryWrite:
+		return true
+	case DurabilityPeriodic:
+		if due {
+			select {
+			case d.kick <- struct{}{}:
+			default: // A save is already due
+			}
+		}
+	}
+	return false
+}
+
+// pending returns the number of unsaved writes.
+func (d *durability) pending() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.unsaved
+}
+
+// saved records a successful save that started at start and covered at least the
+// given number of writes; writes made while it ran may not be covered, so they stay
+// unsaved.
+func (d *durability) saved(covered uint64, start time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.unsaved -= min(covered, d.unsaved)
+	if d.unsaved > 0 {
+		d.firstDirty = start
+	}
+	d.lastSave = start
+	d.saves++
+	d.lastErr = nil
+}
+
+// failed records a failed save.
+func (d *durability) failed(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.failures++
+	d.lastErr = err
+}
+
+// stats returns the current drift between memory and disk.
+func (d *durability) stats() DurabilityStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats := DurabilityStats{
+		Mode:          d.opts.Mode,
+		UnsavedWrites: d.unsaved,
+		LastSave:      d.lastSave,
+		Saves:         d.saves,
+		Failures:      d.failures,
+	}
+	if d.unsaved > 0 {
+		stats.UnsavedFor = time.Since(d.firstDirty)
+	}
+	if d.lastErr != nil {
+		stats.LastError = d.lastErr.Error()
+	}
+	return stats
+}
+
+// DurabilityStats reports how far the store's data on disk lags behind memory.
+func (s *Store) DurabilityStats() DurabilityStats {
+	return s.durability.stats()
+}
+
+// Close stops background saving, saves the store and its open namespaces a final
+// time and closes their backends, releasing the lock taken by Open. A read-only store
+// is not saved. The store must not be used afterwards.
+func (s *Store) Close() error {
+	s.durability.halt()
+
+	var err error
+	if !s.readOnly {
+		err = s.flush()
+	}
+	if nsErr := s.namespaces.close(); err == nil {
+		err = nsErr
+	}
+	if closeErr := s.backend.Close(); err == nil {
+		err = closeErr
+	}
+	if lockErr := s.lock.release(); err == nil {
+		err = lockErr
+	}
+	return err
+}
+
+// noteWrites records n committed writes and saves now if the policy requires it.
+// A failed save is logged and reported through DurabilityStats rather than failing
+// the write, which has already been applied.
+func (s *Store) noteWrites(n int) {
+	if !s.durability.wrote(n) {
+		return
+	}
+	if err := s.flush(); err != nil {
+		log.Printf("store: saving after write failed: %v", err)
+	}
+}
+
+// autosave is run by the background saver.
+func (s *Store) autosave() {
+	if err := s.flush(); err != nil {
+		log.Printf("store: background save failed: %v", err)
+	}
+}
+
+// flush saves the store's own data, without its namespaces, and records the outcome.
+func (s *Store) flush() error {
+	p, ok := s.backend.(Persister)
+	covered := s.durability.pending()
+	start := time.Now()
+
+	if ok {
+		if err := p.Save(); err != nil {
+			s.durability.failed(err)
+			return err
+		}
+	}
+	s.durability.saved(covered, start)
+	return nil
+}
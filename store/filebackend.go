@@ -0,0 +1,543 @@
+// Package store implements FileBackend, the default Backend: an in-memory map that is
+// snapshotted to a JSON file, with a write-ahead log covering writes since the last snapshot.
+package store
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// FileBackend keeps all data in memory and persists it to a JSON file.
+// Keys are spread over independently locked shards; appends to the write-ahead log
+// are serialised by their own mutex.
+type FileBackend struct {
+	data            *shardedMap    // In-memory data store
+	path            string         // Path to the JSON file for persistence
+	walMu           sync.Mutex     // Serialises access to the write-ahead log
+	wal             *writeAheadLog // Write-ahead log of changes since the last snapshot; nil when disabled
+	checkpointEvery int            // Logged writes between automatic checkpoints; 0 disables them
+	backups         int            // Number of previous snapshots kept as <file>.1, <file>.2, ...
+	codec           Codec          // Compression applied to snapshots; nil writes plain JSON
+	keys            *Keyring       // Encryption keys for snapshots and the log; nil disables encryption
+	readOnly        bool           // Whether Save is refused and the log is only read
+	format          SnapshotFormat // Encoding of snapshots
+	load            LoadOptions    // How Load reads the data file
+	source          *os.File       // Data file that lazily loaded values are read from; nil if there are none
+	rev             atomic.Uint64  // Latest store revision logged by WriteBatchAt; stored under revisionKey at checkpoints
+}
+
+// NewFileBackend returns a backend persisted to the JSON file at path.
+// Writes are logged to a write-ahead log next to the data file (`<file>.wal`)
+// unless disabled with WithoutWAL.
+func NewFileBackend(path string, opts ...Option) *FileBackend {
+	return newFileBackend(path, buildOptions(opts))
+}
+
+// newFileBackend returns a file backend configured from already-applied options.
+func newFileBackend(path string, o options) *FileBackend {
+	b := &FileBackend{
+		data:            newShardedMap(o.shards),
+		path:            path,
+		checkpointEvery: o.checkpointEvery,
+		backups:         o.backups,
+		codec:           o.codec,
+		keys:            o.keys,
+		readOnly:        o.readOnly,
+		format:          o.format,
+		load:            o.load,
+	}
+	if o.codec != nil {
+		// Make sure files written with the codec can be read back.
+		if err := RegisterCodec(o.codec); err != nil {
+			log.Printf("store: %v", err)
+		}
+	}
+	if o.wal {
+		b.wal = newWAL(path+".wal", o.keys)
+		b.wal.readOnly = o.readOnly
+	}
+	return b
+}
+
+// Get returns the value stored under key. A lazily loaded value is read from the
+// data file on first access and kept in memory from then on.
+func (b *FileBackend) Get(key string) (string, bool, error) {
+	sh := b.data.shardFor(key)
+	sh.mu.RLock()
+	value, exists := sh.data[key]
+	_, deferred := sh.lazy[key]
+	sh.mu.RUnlock()
+	if !deferred {
+		return value, exists, nil
+	}
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	// Another reader may have loaded it, or a writer replaced it, in the meantime.
+	ref, deferred := sh.lazy[key]
+	if !deferred {
+		value, exists := sh.data[key]
+		return value, exists, nil
+	}
+	value, err := b.readRef(ref)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to load value of %q: %w", key, err)
+	}
+	sh.data[key] = value
+	delete(sh.lazy, key)
+	return value, true, nil
+}
+
+// Put logs the write and stores value under key.
+func (b *FileBackend) Put(key, value string) error {
+	sh := b.data.shardFor(key)
+	sh.mu.Lock()
+
+	// The shard stays locked until the map is updated, so a checkpoint (which takes
+	// every shard) never sees a logged write that has not been applied yet.
+	if err := b.logWrite(walRecord{Op: walOpSet, Key: key, Value: value}); err != nil {
+		sh.mu.Unlock()
+		return err
+	}
+	sh.data[key] = value
+	delete(sh.lazy, key)
+	sh.mu.Unlock()
+
+	b.maybeCheckpoint()
+	return nil
+}
+
+// Delete logs the write and removes key.
+func (b *FileBackend) Delete(key string) error {
+	sh := b.data.shardFor(key)
+	sh.mu.Lock()
+
+	_, exists := sh.data[key]
+	_, deferred := sh.lazy[key]
+	if !exists && !deferred {
+		sh.mu.Unlock()
+		return nil
+	}
+	if err := b.logWrite(walRecord{Op: walOpDelete, Key: key}); err != nil {
+		sh.mu.Unlock()
+		return err
+	}
+	delete(sh.data, key)
+	delete(sh.lazy, key)
+	sh.mu.Unlock()
+
+	b.maybeCheckpoint()
+	return nil
+}
+
+// Iterate calls fn for every key-value pair until fn returns false.
+// Every shard is read-locked for the duration, so fn sees a consistent view.
+func (b *FileBackend) Iterate(fn func(key, value string) bool) error {
+	b.data.rLockAll()
+	defer b.data.rUnlockAll()
+
+	return b.rangeLocked(fn)
+}
+
+// Clear logs the write and removes every key.
+func (b *FileBackend) Clear() error {
+	b.data.lockAll()
+
+	if err := b.logWrite(walRecord{Op: walOpClear}); err != nil {
+		b.data.unlockAll()
+		return err
+	}
+	b.data.clearLocked()
+	b.data.unlockAll()
+
+	b.maybeCheckpoint()
+	return nil
+}
+
+// WriteBatch logs ops as a single record and applies them. On replay the record is
+// applied whole or, if the crash tore it, not at all. Only the shards the batch touches
+// are locked.
+func (b *FileBackend) WriteBatch(ops []BatchOp) error {
+	return b.WriteBatchAt(0, ops)
+}
+
+// WriteBatchAt logs and applies ops like WriteBatch, with rev in the record's header.
+// The latest revision is written under the revision key when the log is checkpointed,
+// and recovered from the log on replay. A zero rev records none.
+func (b *FileBackend) WriteBatchAt(rev uint64, ops []BatchOp) error {
+	shards := b.data.shardsOf(ops)
+	b.data.lockShards(shards)
+
+	rec := walRecord{Op: walOpBatch, Rev: rev, Batch: make([]walRecord, len(ops))}
+	for i, op := range ops {
+		if op.Delete {
+			rec.Batch[i] = walRecord{Op: walOpDelete, Key: op.Key}
+		} else {
+			rec.Batch[i] = walRecord{Op: walOpSet, Key: op.Key, Value: op.Value}
+		}
+	}
+	if err := b.logWrite(rec); err != nil {
+		b.data.unlockShards(shards)
+		return err
+	}
+	b.applyRecord(rec)
+	b.data.unlockShards(shards)
+
+	b.maybeCheckpoint()
+	return nil
+}
+
+// Close releases the write-ahead log and the data file lazily loaded values are read
+// from. Unsaved data remains recoverable from the log.
+func (b *FileBackend) Close() error {
+	b.data.lockAll()
+	b.setSourceLocked(nil)
+	b.data.unlockAll()
+
+	b.walMu.Lock()
+	defer b.walMu.Unlock()
+
+	if b.wal == nil {
+		return nil
+	}
+	return b.wal.close()
+}
+
+// Load streams the data from the JSON file, as configured by WithLoadOptions, then
+// replays any writes recorded in the write-ahead log since that snapshot was taken.
+// If the primary file is corrupt, the newest readable backup generation is used
+// instead, without the log: its records were written against the primary, so
+// replaying them over an older generation could bring back deleted keys. They are
+// moved to <file>.wal.orphaned-<time> for inspection, unless the store is read-only.
+func (b *FileBackend) Load() error {
+	b.data.lockAll()
+	defer b.data.unlockAll()
+	b.walMu.Lock()
+	defer b.walMu.Unlock()
+
+	version, err := b.loadFile()
+	fromBackup := err != nil
+	if fromBackup {
+		var data map[string]string
+		data, version, err = b.loadBackup(err)
+		if err != nil {
+			return err
+		}
+		b.data.replaceLocked(data)
+		b.setSourceLocked(nil)
+	}
+
+	// Recover writes that were acknowledged after the snapshot was taken. Over a
+	// backup, only the revisions they committed are kept, so none is handed out again.
+	switch {
+	case b.wal == nil:
+	case !fromBackup:
+		if err := b.wal.replay(b.applyRecord); err != nil {
+			return fmt.Errorf("failed to replay write-ahead log: %w", err)
+		}
+	default:
+		if err := b.wal.replay(func(rec walRecord) { b.noteRevision(recordRevision(rec)) }); err != nil {
+			return fmt.Errorf("failed to read write-ahead log: %w", err)
+		}
+		if b.readOnly {
+			log.Printf("store: not replaying %s over a backup", b.wal.path)
+			break
+		}
+		aside, err := b.wal.setAside()
+		if err != nil {
+			return err
+		}
+		if aside != "" {
+			log.Printf("store: not replaying %s over a backup; its records were moved to %s", b.wal.path, aside)
+		}
+	}
+	b.storeRevisionLocked()
+
+	// A file in an older format is rewritten in the current one straight away; the
+	// original is kept as the newest backup.
+	if version < FormatVersion && !b.readOnly {
+		log.Printf("store: migrating %s from format version %d to %d", b.path, version, FormatVersion)
+		if err := b.checkpoint(); err != nil {
+			return fmt.Errorf("failed to migrate %s: %w", b.path, err)
+		}
+	}
+
+	return nil
+}
+
+// Save saves the current in-memory data to the JSON file.
+// Once the snapshot is written the write-ahead log is truncated, since
+// every record in it is now reflected in the file.
+func (b *FileBackend) Save() error {
+	if b.readOnly {
+		return ErrReadOnly
+	}
+
+	b.data.lockAll()
+	defer b.data.unlockAll()
+	b.walMu.Lock()
+	defer b.walMu.Unlock()
+
+	return b.checkpoint()
+}
+
+// loadBackup returns the newest readable backup generation after the primary
+// snapshot failed to load with primaryErr.
+func (b *FileBackend) loadBackup(primaryErr error) (map[string]string, int, error) {
+	for gen := 1; gen <= b.backups; gen++ {
+		path := backupPath(b.path, gen)
+		data, version, err := readSnapshot(path, b.keys)
+		if err != nil || data == nil {
+			continue
+		}
+
+		// Anything between this generation and the primary has been lost, including
+		// the log's records; see Load.
+		log.Printf("store: %s is unreadable (%v); loaded backup %s", b.path, primaryErr, path)
+		return data, version, nil
+	}
+	return nil, 0, primaryErr
+}
+
+// checkpoint writes a snapshot and truncates the write-ahead log.
+// The caller must hold every shard's lock and walMu.
+func (b *FileBackend) checkpoint() error {
+	// The log is about to be truncated, so the revisions in its headers go in the file.
+	b.storeRevisionLocked()
+
+	// Keep the current snapshot as the newest backup generation.
+	if err := rotateBackups(b.path, b.backups); err != nil {
+		return err
+	}
+
+	// Write the in-memory data to the file.
+	if err := writeSnapshotFile(b.path, b.format, b.codec, b.keys, b.rangeLocked); err != nil {
+		return err
+	}
+
+	if b.wal != nil {
+		if err := b.wal.truncate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// logWrite appends a record to the write-ahead log before the change is applied.
+// The caller must hold the lock of the shard being changed.
+func (b *FileBackend) logWrite(rec walRecord) error {
+	b.walMu.Lock()
+	defer b.walMu.Unlock()
+
+	if b.wal == nil {
+		return nil
+	}
+	if err := b.wal.append(rec); err != nil {
+		return fmt.Errorf("failed to log write: %w", err)
+	}
+	return nil
+}
+
+// maybeCheckpoint folds the write-ahead log into a new snapshot once enough writes
+// have accumulated. The caller must not hold any shard lock.
+func (b *FileBackend) maybeCheckpoint() {
+	if !b.checkpointDue() {
+		return
+	}
+
+	b.data.lockAll()
+	defer b.data.unlockAll()
+	b.walMu.Lock()
+	defer b.walMu.Unlock()
+
+	// Another writer may have checkpointed while the locks were being taken.
+	if b.wal.records < b.checkpointEvery {
+		return
+	}
+
+	// The triggering write is already durable in the log, so a failed checkpoint
+	// is not reported to the writer; it will be retried after the next write.
+	if err := b.checkpoint(); err != nil {
+		log.Printf("store: checkpoint failed: %v", err)
+	}
+}
+
+// checkpointDue reports whether enough writes have been logged to checkpoint.
+func (b *FileBackend) checkpointDue() bool {
+	b.walMu.Lock()
+	defer b.walMu.Unlock()
+
+	return b.wal != nil && b.checkpointEvery > 0 && b.wal.records >= b.checkpointEvery
+}
+
+// storeRevisionLocked writes the latest revision logged under the revision key, unless
+// the key already holds a later one. The caller must hold every shard's write lock.
+func (b *FileBackend) storeRevisionLocked() {
+	rev := b.rev.Load()
+	if rev == 0 {
+		return
+	}
+	sh := b.data.shardFor(revisionKey)
+	if stored, err := strconv.ParseUint(sh.data[revisionKey], 10, 64); err == nil && stored >= rev {
+		return
+	}
+	sh.data[revisionKey] = formatRevision(rev)
+}
+
+// applyRecord applies a log record to the in-memory data, as it is written or replayed.
+// The caller must hold the write lock of every shard the record changes.
+func (b *FileBackend) applyRecord(rec walRecord) {
+	switch rec.Op {
+	case walOpSet:
+		sh := b.data.shardFor(rec.Key)
+		sh.data[rec.Key] = rec.Value
+		delete(sh.lazy, rec.Key)
+	case walOpDelete:
+		sh := b.data.shardFor(rec.Key)
+		delete(sh.data, rec.Key)
+		delete(sh.lazy, rec.Key)
+	case walOpClear:
+		b.data.clearLocked()
+	case walOpBatch:
+		for _, sub := range rec.Batch {
+			b.applyRecord(sub)
+		}
+		b.noteRevision(rec.Rev)
+	}
+}
+
+// noteRevision raises the latest logged revision to rev, if it is later.
+func (b *FileBackend) noteRevision(rev uint64) {
+	// Revisions from concurrent batches on other shards may arrive out of order.
+	for cur := b.rev.Load(); rev > cur && !b.rev.CompareAndSwap(cur, rev); cur = b.rev.Load() {
+	}
+}
+
+// recordRevision returns the latest revision a log record holds: the one its batch
+// commits, or one it writes under the revision key or a version key.
+func recordRevision(rec walRecord) uint64 {
+	rev := rec.Rev
+	if rec.Op == walOpSet && (rec.Key == revisionKey || strings.HasPrefix(rec.Key, versionKeyPrefix)) {
+		if v, err := strconv.ParseUint(rec.Value, 10, 64); err == nil {
+			rev = max(rev, v)
+		}
+	}
+	for _, sub := range rec.Batch {
+		rev = max(rev, recordRevision(sub))
+	}
+	return rev
+}
+
+// writeFileAtomic replaces the file at path with content so that readers (and a
+// restart after a crash) see either the old file or the new one, never a mix.
+func writeFileAtomic(path string, content []byte) error {
+	return writeFileAtomicWith(path, func(w io.Writer) error {
+		if _, err := w.Write(content); err != nil {
+			return fmt.Errorf("failed to write file: %w", err)
+		}
+		return nil
+	})
+}
+
+// writeFileAtomicWith replaces the file at path with what write writes, atomically
+// like writeFileAtomic. The data is written to a temporary file, fsync'd, renamed
+// over the target, and the directory is fsync'd so the rename itself is durable.
+func writeFileAtomicWith(path string, write func(w io.Writer) error) error {
+	dir := filepath.Dir(path)
+
+	// Ensure the directory for the file exists.
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directories: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // No-op once the rename has succeeded
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set file permissions: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir fsyncs a directory so that renames and new entries in it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
+
+// backupPath returns the path of the given backup generation, e.g. store.json.2.
+func backupPath(path string, gen int) string {
+	return fmt.Sprintf("%s.%d", path, gen)
+}
+
+// rotateBackups shifts <path>.1 .. <path>.(n-1) up one generation and links the
+// current file in as <path>.1, dropping the oldest generation. The current file
+// stays in place so there is always a primary snapshot on disk.
+func rotateBackups(path string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	for gen := n - 1; gen >= 1; gen-- {
+		err := os.Rename(backupPath(path, gen), backupPath(path, gen+1))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate backup: %w", err)
+		}
+	}
+
+	newest := backupPath(path, 1)
+	if err := os.Remove(newest); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to rotate backup: %w", err)
+	}
+	if err := os.Link(path, newest); err != nil {
+		// Fall back to a copy on filesystems without hard links.
+		content, readErr := os.ReadFile(path)
+		if readErr != nil {
+			return fmt.Errorf("failed to back up file: %w", readErr)
+		}
+		if err := writeFileAtomic(newest, content); err != nil {
+			return fmt.Errorf("failed to back up file: %w", err)
+		}
+	}
+	return nil
+}
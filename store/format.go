@@ -0,0 +1,509 @@
+// Package store implements the on-disk format of the data file and named snapshots,
+// and migrations from older versions of it. A file starts with a header naming its
+// format version; each entry then sits on its own line behind a CRC-32 of its
+// contents, with its value stored as native JSON, and a final line records how many
+// entries there are. Files in an older format are still read, and Load rewrites them
+// in the current one.
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// FormatVersion is the version of the on-disk format that files are written in.
+const FormatVersion = 2
+
+// formatHeader starts every file written in format version 2 or later, followed by
+// the version number and a newline.
+const formatHeader = "KVSTORE "
+
+// recordsMagic starts files written in format version 1, which had no version header.
+var recordsMagic = []byte("KVREC1\n")
+
+// formatChanges describes what each format version changed from the one before it;
+// migrating a file applies every change after its version.
+var formatChanges = map[int]string{
+	1: "entries get a CRC-32 checksum each and the file gets an entry count, so damage is confined to the entries it hits",
+	2: "the file gets a version header, and values are stored as native JSON instead of escaped strings",
+}
+
+// snapshotRecord is one line of a file: either an entry, or the trailer holding the
+// number of entries before it.
+type snapshotRecord struct {
+	Key   string          `json:"key,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"` // Value as native JSON; in version 1, a JSON string holding it
+	Text  *string         `json:"text,omitempty"`  // Value that is not valid JSON, as a string
+	End   *int            `json:"end,omitempty"`   // Set only on the trailer
+}
+
+// nativeValue reports whether value can be stored as native JSON, which it can if it
+// is valid JSON. Anything else is stored as a string.
+//
+// Native values are compacted when written: whitespace outside strings, including any
+// around the value, is removed, so a value read back from the file is equivalent to
+// the one written but not necessarily the same bytes.
+func nativeValue(value string) bool {
+	return json.Valid([]byte(value))
+}
+
+// encodeSnapshot writes data in the current format, in key order.
+func encodeSnapshot(data map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s%d\n", formatHeader, FormatVersion)
+	for _, key := range keys {
+		if err := writeEntry(&buf, key, data[key]); err != nil {
+			return nil, err
+		}
+	}
+	count := len(keys)
+	trailer, err := json.Marshal(snapshotRecord{End: &count})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal data: %w", err)
+	}
+	writeRecord(&buf, trailer)
+	return buf.Bytes(), nil
+}
+
+// writeEntry appends the record of one entry to buf. A native value is compacted with
+// json.Compact rather than marshalled as a json.RawMessage, which would also escape
+// HTML characters in it.
+func writeEntry(buf *bytes.Buffer, key, value string) error {
+	if !nativeValue(value) {
+		payload, err := json.Marshal(snapshotRecord{Key: key, Text: &value})
+		if err != nil {
+			return fmt.Errorf("failed to marshal data: %w", err)
+		}
+		writeRecord(buf, payload)
+		return nil
+	}
+
+	quoted, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal data: %w", err)
+	}
+	payload := bytes.NewBuffer(make([]byte, 0, len(quoted)+len(value)+20))
+	payload.WriteString(`{"key":`)
+	payload.Write(quoted)
+	payload.WriteString(`,"value":`)
+	if err := json.Compact(payload, []byte(value)); err != nil {
+		return fmt.Errorf("failed to compact value: %w", err)
+	}
+	payload.WriteByte('}')
+	writeRecord(buf, payload.Bytes())
+	return nil
+}
+
+// writeRecord appends a record line with its checksum to buf.
+func writeRecord(buf *bytes.Buffer, payload []byte) {
+	fmt.Fprintf(buf, "%08x ", crc32.ChecksumIEEE(payload))
+	buf.Write(payload)
+	buf.WriteByte('\n')
+}
+
+// snapshotEntry is an entry read from a file, with where its value is stored.
+type snapshotEntry struct {
+	Key   string
+	Value string
+	Ref   valueRef // Location of the value in the file; unset if the file is compressed or encrypted
+}
+
+// valueRef locates a value in a file, so it can be read again later; see LoadOptions.Lazy.
+type valueRef struct {
+	off     int64 // Offset of the record holding the value
+	n       int   // Length of the record; zero if the reference is unset
+	kind    uint8 // How the record is encoded: refRecord, refBinary or refLegacy
+	version int   // Format version of a refRecord
+}
+
+// Kinds of record a valueRef points at.
+const (
+	refRecord uint8 = iota // A checksummed line of a JSON records file
+	refBinary              // A record of a binary file
+	refLegacy              // A JSON string in a file written as a single object
+)
+
+// decodeSnapshot parses a decrypted, decompressed file in any supported format
+// version, and returns its data and the version it was in. Any damage is an error;
+// use Fsck to find out what is damaged and Repair to salvage the rest.
+func decodeSnapshot(content []byte) (map[string]string, int, error) {
+	data := make(map[string]string)
+	version, err := scanStream(bytes.NewReader(content), func(e snapshotEntry) error {
+		data[e.Key] = e.Value
+		return nil
+	}, problemError)
+	if err != nil {
+		return nil, version, err
+	}
+	return data, version, nil
+}
+
+// scanSnapshot reads every intact entry of a file, and reports what it could not
+// read and the file's format version. Entries whose values are not valid JSON are
+// returned, and are not reported; see Fsck. It fails only for a format version
+// newer than this build understands.
+func scanSnapshot(content []byte) (map[string]string, int, []FsckProblem, error) {
+	data := make(map[string]string)
+	var problems []FsckProblem
+	version, err := scanStream(bytes.NewReader(content), func(e snapshotEntry) error {
+		data[e.Key] = e.Value
+		return nil
+	}, func(p FsckProblem) error {
+		problems = append(problems, p)
+		return nil
+	})
+	return data, version, problems, err
+}
+
+// problemError turns a damaged entry into the error that fails a load.
+func problemError(p FsckProblem) error {
+	switch {
+	case p.Line > 0:
+		return fmt.Errorf("corrupt record on line %d: %s", p.Line, p.Problem)
+	case p.Key != "":
+		return fmt.Errorf("corrupt entry %q: %s", p.Key, p.Problem)
+	default:
+		return fmt.Errorf("corrupt file: %s", p.Problem)
+	}
+}
+
+// scanStream reads a decrypted, decompressed file in any supported format from r,
+// calling visit with each entry and damaged with each entry that cannot be read.
+// Returning nil from damaged skips the entry; an error from either stops the scan
+// with it. Damage in a binary file or in a file written as a single JSON object
+// leaves no way to find the next entry, so the scan ends there. It returns the
+// file's format version.
+func scanStream(r io.Reader, visit func(snapshotEntry) error, damaged func(FsckProblem) error) (int, error) {
+	br := bufio.NewReaderSize(r, 1<<16)
+	head, _ := br.Peek(len(formatHeader) + 8)
+
+	switch {
+	case bytes.HasPrefix(head, binaryMagic):
+		return FormatVersion, readBinary(br, visit, damaged)
+	case bytes.HasPrefix(head, recordsMagic), bytes.HasPrefix(head, []byte(formatHeader)):
+		return scanRecords(br, visit, damaged)
+	default:
+		return 0, scanLegacy(br, visit, damaged)
+	}
+}
+
+// scanRecords reads a file in the JSON records format, one line at a time.
+func scanRecords(r *bufio.Reader, visit func(snapshotEntry) error, damaged func(FsckProblem) error) (int, error) {
+	header, err := r.ReadBytes('\n')
+	if err != nil {
+		return 0, errors.New("format header is cut short")
+	}
+	version, err := formatVersion(header)
+	if err != nil {
+		return version, err
+	}
+
+	off := int64(len(header))
+	count, skipped, end := 0, 0, -1
+	for line := 2; ; line++ {
+		raw, err := r.ReadBytes('\n')
+		if err == io.EOF && len(raw) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return version, fmt.Errorf("failed to read file: %w", err)
+		}
+		ref := valueRef{off: off, n: len(raw), kind: refRecord, version: version}
+		off += int64(len(raw))
+
+		problem := ""
+		var rec snapshotRecord
+		var value string
+		switch {
+		case err == io.EOF:
+			problem = "record is cut short"
+		case end >= 0:
+			problem = "record follows the trailer"
+		default:
+			rec, problem = decodeRecord(raw)
+			if problem == "" && rec.End == nil {
+				value, problem = recordValue(rec, version)
+			}
+		}
+
+		switch {
+		case problem != "":
+			skipped++
+			if err := damaged(FsckProblem{Line: line, Problem: problem}); err != nil {
+				return version, err
+			}
+		case rec.End != nil:
+			end = *rec.End
+		default:
+			count++
+			if err := visit(snapshotEntry{Key: rec.Key, Value: value, Ref: ref}); err != nil {
+				return version, err
+			}
+		}
+	}
+
+	// The trailer catches lost lines that left no damage behind, such as a file cut
+	// short at a line boundary.
+	switch {
+	case end < 0:
+		return version, damaged(FsckProblem{Problem: "trailer is missing; the file may be cut short"})
+	case end != count && skipped == 0:
+		return version, damaged(FsckProblem{Problem: fmt.Sprintf("trailer counts %d entries, but %d were read", end, count)})
+	}
+	return version, nil
+}
+
+// formatVersion parses the header line of a file in the JSON records format.
+func formatVersion(header []byte) (int, error) {
+	if bytes.Equal(header, recordsMagic) {
+		return 1, nil
+	}
+
+	line := bytes.TrimSuffix(bytes.TrimPrefix(header, []byte(formatHeader)), []byte("\n"))
+	version, err := strconv.Atoi(string(line))
+	if err != nil || version < 2 {
+		return 0, fmt.Errorf("invalid format header %q", bytes.TrimSpace(header[:min(len(header), 32)]))
+	}
+	if version > FormatVersion {
+		return version, fmt.Errorf("file is in format version %d, but only versions up to %d are supported", version, FormatVersion)
+	}
+	return version, nil
+}
+
+// decodeRecord verifies and parses one record line, returning why it is unreadable
+// if it is.
+func decodeRecord(line []byte) (snapshotRecord, string) {
+	var rec snapshotRecord
+
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	sum, payload, found := bytes.Cut(line, []byte(" "))
+	if !found || len(sum) != 8 {
+		return rec, "record has no checksum"
+	}
+	want, err := hex.DecodeString(string(sum))
+	if err != nil {
+		return rec, "record has no checksum"
+	}
+	if binary.BigEndian.Uint32(want) != crc32.ChecksumIEEE(payload) {
+		return rec, "checksum mismatch"
+	}
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return rec, fmt.Sprintf("record is not valid JSON: %v", err)
+	}
+	if rec.Key == "" && rec.End == nil {
+		return rec, "record has no key"
+	}
+	return rec, ""
+}
+
+// recordValue returns the value of an entry record written in the given version.
+func recordValue(rec snapshotRecord, version int) (string, string) {
+	switch {
+	case rec.Text != nil:
+		return *rec.Text, ""
+	case rec.Value == nil:
+		return "", "" // Version 1 left out empty values
+	case version == 1:
+		var value string
+		if err := json.Unmarshal(rec.Value, &value); err != nil {
+			return "", "record value is not a string"
+		}
+		return value, ""
+	default:
+		return string(rec.Value), ""
+	}
+}
+
+// scanLegacy reads a file written as a single JSON object, the format before
+// version 1, token by token. An entry whose value is not a string is damaged on its
+// own; anything that breaks the JSON syntax ends the scan, since without checksums
+// there is no telling where the damage ends.
+func scanLegacy(r io.Reader, visit func(snapshotEntry) error, damaged func(FsckProblem) error) error {
+	dec := json.NewDecoder(r)
+	unreadable := func(err error) error {
+		return damaged(FsckProblem{Problem: fmt.Sprintf("unreadable from byte %d: %v", dec.InputOffset(), err)})
+	}
+
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		if err == nil {
+			err = errors.New("expected a JSON object")
+		}
+		return unreadable(err)
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return unreadable(err)
+		}
+		key, _ := tok.(string)
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return unreadable(err)
+		}
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			if err := damaged(FsckProblem{Key: key, Problem: "value is not a string"}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		end := dec.InputOffset()
+		ref := valueRef{off: end - int64(len(raw)), n: len(raw), kind: refLegacy}
+		if err := visit(snapshotEntry{Key: key, Value: value, Ref: ref}); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return unreadable(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return unreadable(errors.New("unexpected data after the JSON object"))
+	}
+	return nil
+}
+
+// decodeRef parses the record a valueRef points at, read back from the file, and
+// returns its value.
+func decodeRef(ref valueRef, raw []byte) (string, error) {
+	switch ref.kind {
+	case refBinary:
+		_, value, err := decodeBinaryRecord(raw)
+		return value, err
+	case refLegacy:
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return "", fmt.Errorf("value is damaged: %w", err)
+		}
+		return value, nil
+	default:
+		rec, problem := decodeRecord(raw)
+		if problem == "" {
+			var value string
+			if value, problem = recordValue(rec, ref.version); problem == "" {
+				return value, nil
+			}
+		}
+		return "", errors.New(problem)
+	}
+}
+
+// MigrationReport describes what migrating a data file to the current format changes.
+type MigrationReport struct {
+	Path         string   `json:"path"`              // Data file migrated
+	From         int      `json:"from"`              // Format version the file is in
+	To           int      `json:"to"`                // Format version it is migrated to
+	Entries      int      `json:"entries"`           // Entries in the file
+	NativeValues int      `json:"nativeValues"`      // Values stored as native JSON after migrating
+	StringValues int      `json:"stringValues"`      // Values stored as strings, since they are not valid JSON
+	Changes      []string `json:"changes,omitempty"` // What each migration step changes, oldest first
+	Applied      bool     `json:"applied"`           // Whether the file was rewritten
+}
+
+// Migrate reports what rewriting the data file at path in the current format would
+// change and, unless dryRun is set, rewrites it, keeping the original as the newest
+// backup. Load migrates files on its own, so this is only needed to inspect a
+// migration beforehand or to migrate without opening the store. Unless dryRun is set,
+// Migrate takes the data file's lock, so it fails with ErrLocked while the store is
+// open elsewhere.
+func Migrate(path string, dryRun bool, opts ...Option) (MigrationReport, error) {
+	o := buildOptions(opts)
+	report := MigrationReport{Path: path, To: FormatVersion}
+
+	if !dryRun {
+		lock, err := acquireLock(lockPath(path), false)
+		if err != nil {
+			return report, err
+		}
+		defer lock.release()
+	}
+
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		report.From = FormatVersion
+		return report, nil
+	}
+	if err != nil {
+		return report, fmt.Errorf("failed to read file: %w", err)
+	}
+	content, err := openFile(raw, o.keys)
+	if err != nil {
+		return report, err
+	}
+	data, version, err := decodeSnapshot(content)
+	report.From = version
+	if err != nil {
+		return report, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	report.Entries = len(data)
+	for _, value := range data {
+		if nativeValue(value) {
+			report.NativeValues++
+		} else {
+			report.StringValues++
+		}
+	}
+	for v := version + 1; v <= FormatVersion; v++ {
+		report.Changes = append(report.Changes, fmt.Sprintf("version %d: %s", v, formatChanges[v]))
+	}
+	if dryRun || version == FormatVersion {
+		return report, nil
+	}
+
+	codec, err := rewriteCodec(raw, o)
+	if err != nil {
+		return report, err
+	}
+	migrated, err := encodeSnapshot(data)
+	if err != nil {
+		return report, err
+	}
+	if migrated, err = sealFile(migrated, codec, o.keys); err != nil {
+		return report, err
+	}
+	if err := rotateBackups(path, max(o.backups, 1)); err != nil {
+		return report, err
+	}
+	if err := writeFileAtomic(path, migrated); err != nil {
+		return report, fmt.Errorf("failed to write migrated file: %w", err)
+	}
+	report.Applied = true
+	return report, nil
+}
+
+// rewriteCodec returns the codec to write a replacement for the file raw with: the
+// configured one, or else the one the file was written with.
+func rewriteCodec(raw []byte, o options) (Codec, error) {
+	if o.codec != nil {
+		return o.codec, nil
+	}
+	if !isEncrypted(raw) {
+		return detectCodec(raw), nil
+	}
+	if o.keys == nil {
+		return nil, ErrNoKeys
+	}
+	inner, err := o.keys.open(raw)
+	if err != nil {
+		return nil, err
+	}
+	return detectCodec(inner), nil
+}
@@ -0,0 +1,227 @@
+// Package store implements fsck and repair of persisted files. Checksummed records
+// confine damage to the entries it hits, so fsck can point at them, and repair can
+// write out everything else and set the damaged file aside.
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+)
+
+// FsckProblem is something wrong with a persisted file.
+type FsckProblem struct {
+	File    string `json:"file,omitempty"` // File the problem is in, if not the data file
+	Line    int    `json:"line,omitempty"` // Line of the damaged record, if known
+	Key     string `json:"key,omitempty"`  // Key of the damaged entry, if known
+	Problem string `json:"problem"`        // What is wrong
+}
+
+// String describes the problem on one line.
+func (p FsckProblem) String() string {
+	where := ""
+	if p.File != "" {
+		where += p.File + ": "
+	}
+	if p.Line > 0 {
+		where += fmt.Sprintf("line %d: ", p.Line)
+	}
+	if p.Key != "" {
+		where += fmt.Sprintf("key %q: ", p.Key)
+	}
+	return where + p.Problem
+}
+
+// FsckReport is the result of checking a store's files.
+type FsckReport struct {
+	Path       string        `json:"path"`               // Data file checked
+	Version    int           `json:"version"`            // Format version of the file; see FormatVersion
+	Entries    int           `json:"entries"`            // Entries that could be read
+	LogRecords int           `json:"logRecords"`         // Intact records in the write-ahead log
+	Problems   []FsckProblem `json:"problems,omitempty"` // Everything found wrong
+}
+
+// OK reports whether no problems were found.
+func (r FsckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Fsck checks the data file at path and its write-ahead log without changing them.
+// It reports damaged records, a missing or wrong trailer, values that are not valid
+// JSON and a damaged log tail. It only fails if the file cannot be examined at all,
+// e.g. because it is encrypted and WithEncryption does not supply the key.
+func Fsck(path string, opts ...Option) (FsckReport, error) {
+	o := buildOptions(opts)
+	report := FsckReport{Path: path}
+
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return report, fmt.Errorf("failed to read file: %w", err)
+	}
+	if err == nil {
+		if content, err = openFile(content, o.keys); err != nil {
+			return report, err
+		}
+
+		data, version, problems, err := scanSnapshot(content)
+		if err != nil {
+			return report, err
+		}
+		report.Version = version
+		report.Entries = len(data)
+		report.Problems = problems
+
+		keys := make([]string, 0, len(data))
+		for key := range data {
+			if !isInternalKey(key) {
+				keys = append(keys, key)
+			}
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			if err := ValidateJSON(data[key]); err != nil {
+				report.Problems = append(report.Problems, FsckProblem{Key: key, Problem: "value is not valid JSON"})
+			}
+		}
+	}
+
+	records, problem, err := checkWAL(path+".wal", o.keys)
+	if err != nil {
+		return report, err
+	}
+	report.LogRecords = records
+	if problem != nil {
+		report.Problems = append(report.Problems, *problem)
+	}
+	return report, nil
+}
+
+// checkWAL counts the intact records of a write-ahead log and reports a damaged tail,
+// which replay would discard.
+func checkWAL(path string, keys *Keyring) (int, *FsckProblem, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to open write-ahead log: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	count := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return count, nil, nil
+		}
+		if err != nil && err != io.EOF {
+			return count, nil, fmt.Errorf("failed to read write-ahead log: %w", err)
+		}
+
+		_, ok, decodeErr := decodeWALLine(line, keys)
+		if decodeErr != nil {
+			return count, nil, fmt.Errorf("failed to check write-ahead log: %w", decodeErr)
+		}
+		if !ok || err == io.EOF {
+			return count, &FsckProblem{
+				File:    path,
+				Line:    count + 1,
+				Problem: "damaged record; it and everything after it will be discarded on load",
+			}, nil
+		}
+		count++
+	}
+}
+
+// RepairReport is the result of repairing a data file.
+type RepairReport struct {
+	FsckReport
+	Salvaged   int    `json:"salvaged"`             // Entries written to the repaired file
+	Quarantine string `json:"quarantine,omitempty"` // Where the damaged original was moved; empty if nothing was repaired
+}
+
+// Repair salvages every readable entry of the damaged data file at path into a new
+// file in its place, in the format of the original, and keeps the original beside
+// it as <file>.corrupt-<time> for inspection. Values that are not valid JSON are
+// salvaged as they are. A file without damaged records is left alone. Repair takes
+// the data file's lock, so it fails with ErrLocked while the store is open elsewhere.
+func Repair(path string, opts ...Option) (RepairReport, error) {
+	lock, err := acquireLock(lockPath(path), false)
+	if err != nil {
+		return RepairReport{}, err
+	}
+	defer lock.release()
+	return repairFile(path, opts)
+}
+
+// Repair repairs the store's own data file like the package-level Repair, under the
+// lock the store already holds, and reloads the store from the repaired file.
+func (s *Store) Repair() (RepairReport, error) {
+	if err := s.writable(); err != nil {
+		return RepairReport{}, err
+	}
+	s.locks.lockAll()
+	defer s.locks.unlockAll()
+
+	report, err := repairFile(s.path, s.fileOptions())
+	if err != nil || report.Quarantine == "" {
+		return report, err
+	}
+	return report, s.loadLocked()
+}
+
+// repairFile does the work of Repair. The caller must hold the data file's lock.
+func repairFile(path string, opts []Option) (RepairReport, error) {
+	o := buildOptions(opts)
+
+	fsck, err := Fsck(path, opts...)
+	report := RepairReport{FsckReport: fsck}
+	if err != nil {
+		return report, err
+	}
+
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return report, nil
+	}
+	if err != nil {
+		return report, fmt.Errorf("failed to read file: %w", err)
+	}
+	content, err := openFile(raw, o.keys)
+	if err != nil {
+		return report, err
+	}
+
+	data, _, problems, err := scanSnapshot(content)
+	if err != nil {
+		return report, err
+	}
+	report.Salvaged = len(data)
+	if len(problems) == 0 {
+		return report, nil
+	}
+
+	// The original is kept before it is replaced, so a failure part way through loses nothing.
+	report.Quarantine = fmt.Sprintf("%s.corrupt-%s", path, time.Now().UTC().Format("20060102T150405"))
+	if err := writeFileAtomic(report.Quarantine, raw); err != nil {
+		return report, fmt.Errorf("failed to quarantine damaged file: %w", err)
+	}
+
+	codec, err := rewriteCodec(raw, o)
+	if err != nil {
+		return report, err
+	}
+	format := FormatJSON
+	if bytes.HasPrefix(content, binaryMagic) {
+		format = FormatBinary
+	}
+	if err := writeSnapshotFile(path, format, codec, o.keys, rangeMap(data)); err != nil {
+		return report, fmt.Errorf("failed to write repaired file: %w", err)
+	}
+	return report, nil
+}
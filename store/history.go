@@ -0,0 +1,308 @@
+// Package store implements per-key revision history. Every write to a key appends an
+// entry recording the value it left behind, when it happened and who made it. Entries
+// are persisted under reserved metadata keys in the same batch as the write, and only
+// the most recent ones are kept, so a bad write can be inspected and reverted later.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHistoryLimit is the number of revisions of each key kept by default. History
+// is off unless enabled with WithHistory, since every entry holds a full copy of a value.
+const DefaultHistoryLimit = 0
+
+// ErrHistoryDisabled is returned by History, HistoryAt and Revert when the store keeps
+// no history.
+var ErrHistoryDisabled = errors.New("history is disabled; enable it with WithHistory")
+
+// ErrRevisionNotFound is returned when a key's history has no entry for a revision,
+// either because the key was never written at it or because the entry was dropped.
+var ErrRevisionNotFound = errors.New("revision not found in history")
+
+// historyKeyPrefix prefixes the metadata keys holding history entries.
+const historyKeyPrefix = internalKeyPrefix + "hist:"
+
+// historyKeyEnd is the first key after every history metadata key.
+const historyKeyEnd = internalKeyPrefix + "hist;"
+
+// historyKey returns the metadata key holding key's entry for rev. The revision is
+// zero-padded so a key's entries sort in revision order.
+func historyKey(key string, rev uint64) string {
+	return fmt.Sprintf("%s%s\x00%020d", historyKeyPrefix, key, rev)
+}
+
+// parseHistoryKey splits a history metadata key into the key and revision it is for.
+func parseHistoryKey(k string) (string, uint64, bool) {
+	rest, ok := strings.CutPrefix(k, historyKeyPrefix)
+	if !ok {
+		return "", 0, false
+	}
+	i := strings.LastIndexByte(rest, 0)
+	if i < 0 {
+		return "", 0, false
+	}
+	rev, err := strconv.ParseUint(rest[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return rest[:i], rev, true
+}
+
+// HistoryEntry is one revision of a key.
+type HistoryEntry struct {
+	Revision uint64    `json:"revision"`          // Revision of the write, which was the key's version
+	Time     time.Time `json:"time"`              // When the write was committed
+	Author   string    `json:"author,omitempty"`  // Who made the write, as set with Store.As
+	Value    string    `json:"value,omitempty"`   // Value the write left behind
+	Deleted  bool      `json:"deleted,omitempty"` // Whether the write deleted the key
+}
+
+// historyIndex tracks which revisions of each key have a history entry, so writes can
+// drop the oldest ones without reading them back. Entries for a key are only changed
+// while holding that key's write lock.
+type historyIndex struct {
+	mu    sync.Mutex
+	limit int                 // Entries kept per key
+	revs  map[string][]uint64 // Revisions with an entry, oldest first
+}
+
+// newHistoryIndex returns an empty index keeping limit entries per key.
+func newHistoryIndex(limit int) *historyIndex {
+	return &historyIndex{limit: max(limit, 0), revs: make(map[string][]uint64)}
+}
+
+// overflow returns the revisions whose entries must go to make room for one more.
+func (h *historyIndex) overflow(key string) []uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	revs := h.revs[key]
+	if n := len(revs) + 1 - h.limit; n > 0 {
+		return append([]uint64(nil), revs[:n]...)
+	}
+	return nil
+}
+
+// add records a new entry for key, forgetting any beyond the limit.
+func (h *historyIndex) add(key string, rev uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	revs := append(h.revs[key], rev)
+	if n := len(revs) - h.limit; n > 0 {
+		revs = revs[n:]
+	}
+	h.revs[key] = revs
+}
+
+// list returns the revisions of key with an entry, oldest first.
+func (h *historyIndex) list(key string) []uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]uint64(nil), h.revs[key]...)
+}
+
+// replace swaps in a new set of entries.
+func (h *historyIndex) replace(revs map[string][]uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.revs = revs
+}
+
+// As returns a handle on the store that attributes its writes to author in the key
+// history. The handle shares all data and locks with s.
+func (s *Store) As(author string) *Store {
+	handle := *s
+	handle.author = author
+	return &handle
+}
+
+// checkHistory rejects reading key's history if the key cannot hold user data or the
+// store keeps no history.
+func (s *Store) checkHistory(key string) error {
+	if s.history.limit == 0 {
+		return ErrHistoryDisabled
+	}
+	return checkKey(key)
+}
+
+// History returns the retained revisions of key, newest first. A deleted key keeps its
+// history, so it can still be reverted.
+func (s *Store) History(key string) ([]HistoryEntry, error) {
+	if err := s.checkHistory(key); err != nil {
+		return nil, err
+	}
+
+	lock := s.locks.forKey(key)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	revs := s.history.list(key)
+	if len(revs) == 0 {
+		return nil, ErrKeyNotFound
+	}
+
+	entries := make([]HistoryEntry, 0, len(revs))
+	for i := len(revs) - 1; i >= 0; i-- {
+		entry, err := s.historyEntryLocked(key, revs[i])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// HistoryAt returns the entry for key at rev. It returns ErrRevisionNotFound if the
+// key's history holds no such revision.
+func (s *Store) HistoryAt(key string, rev uint64) (HistoryEntry, error) {
+	if err := s.checkHistory(key); err != nil {
+		return HistoryEntry{}, err
+	}
+
+	lock := s.locks.forKey(key)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return s.historyEntryLocked(key, rev)
+}
+
+// Revert restores key to the value it had at rev, as a new write, and returns the
+// key's new version; reverting to a deletion deletes the key. A key that still exists
+// keeps its TTL.
+func (s *Store) Revert(key string, rev uint64) (uint64, error) {
+	if err := s.checkHistory(key); err != nil {
+		return 0, err
+	}
+
+	lock := s.locks.forKey(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry, err := s.historyEntryLocked(key, rev)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.expireLocked(key); err != nil {
+		return 0, err
+	}
+
+	old, exists, err := s.backend.Get(key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read key: %w", err)
+	}
+
+	if entry.Deleted {
+		if !exists {
+			return 0, nil
+		}
+		if err := s.remove(key, old); err != nil {
+			return 0, err
+		}
+		return 0, s.clearDeadlineLocked(key)
+	}
+
+	if !exists {
+		// Drop a deadline left behind by a crash during an earlier delete.
+		if err := s.clearDeadlineLocked(key); err != nil {
+			return 0, err
+		}
+	}
+	return s.put(key, entry.Value, old, exists, time.Time{})
+}
+
+// historyEntryLocked reads key's entry for rev. The caller must hold the key's lock.
+func (s *Store) historyEntryLocked(key string, rev uint64) (HistoryEntry, error) {
+	raw, ok, err := s.backend.Get(historyKey(key, rev))
+	if err != nil {
+		return HistoryEntry{}, fmt.Errorf("failed to read history: %w", err)
+	}
+	if !ok {
+		return HistoryEntry{}, ErrRevisionNotFound
+	}
+
+	var entry HistoryEntry
+	if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+		return HistoryEntry{}, fmt.Errorf("failed to parse history of %q: %w", key, err)
+	}
+	return entry, nil
+}
+
+// historyOps returns the batch operations that add an entry for a write to key at rev
+// and drop the entries it pushes past the limit. Once the batch is applied, the
+// caller must call recordHistory. The caller must hold the key's write lock.
+func (s *Store) historyOps(key string, rev uint64, value string, deleted bool, now time.Time) ([]BatchOp, error) {
+	if s.history.limit == 0 {
+		return nil, nil
+	}
+
+	entry, err := json.Marshal(HistoryEntry{
+		Revision: rev,
+		Time:     now.UTC(),
+		Author:   s.author,
+		Value:    value,
+		Deleted:  deleted,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode history: %w", err)
+	}
+
+	ops := []BatchOp{{Key: historyKey(key, rev), Value: string(entry)}}
+	for _, dropped := range s.history.overflow(key) {
+		ops = append(ops, BatchOp{Key: historyKey(key, dropped), Delete: true})
+	}
+	return ops, nil
+}
+
+// recordHistory notes that the entry for a write to key at rev has been applied.
+func (s *Store) recordHistory(key string, rev uint64) {
+	if s.history.limit > 0 {
+		s.history.add(key, rev)
+	}
+}
+
+// loadHistoryLocked rebuilds the history index from the metadata in the backend.
+// The caller must hold every stripe's write lock.
+func (s *Store) loadHistoryLocked() error {
+	revs := make(map[string][]uint64)
+	collect := func(k, _ string) bool {
+		if !strings.HasPrefix(k, historyKeyPrefix) {
+			return true
+		}
+		key, rev, ok := parseHistoryKey(k)
+		if !ok {
+			log.Printf("store: ignoring unreadable history key %q", k)
+			return true
+		}
+		revs[key] = append(revs[key], rev)
+		return true
+	}
+
+	// Backends with sorted keys can visit just the metadata instead of every key.
+	var err error
+	if r, ok := s.backend.(RangeIterator); ok {
+		err = r.Range(historyKeyPrefix, historyKeyEnd, collect)
+	} else {
+		err = s.backend.Iterate(collect)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load history: %w", err)
+	}
+
+	for _, list := range revs {
+		slices.Sort(list)
+	}
+	s.history.replace(revs)
+	return nil
+}
@@ -0,0 +1,564 @@
+// Package store implements secondary indexes on JSON paths. An index holds the value
+// each key's document has at a path, sorted, so keys with a given value or with a
+// value in a range are found without reading every document. Indexes are declared
+// per store, persisted as metadata so Load rebuilds them, and updated by every write.
+package store
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrIndexNotFound is returned for a path that has no index.
+var ErrIndexNotFound = errors.New("index not found")
+
+// ErrIndexExists is returned when creating an index on a path that already has one.
+var ErrIndexExists = errors.New("index already exists")
+
+// indexKeyPrefix prefixes the metadata keys declaring indexes.
+const indexKeyPrefix = internalKeyPrefix + "index:"
+
+// indexKeyEnd is the first key after every index metadata key.
+const indexKeyEnd = internalKeyPrefix + "index;"
+
+// indexKey returns the metadata key declaring the index on path.
+func indexKey(path string) string {
+	return indexKeyPrefix + path
+}
+
+// IndexInfo describes a secondary index.
+type IndexInfo struct {
+	Path    string `json:"path"`    // JSON path the index is on, in canonical form
+	Entries int    `json:"entries"` // Keys whose documents have an indexable value at the path
+}
+
+// IndexRange selects the values of a range lookup. Bounds are JSON values such as
+// `30` or `"m"`, and must be of the same type: a range only matches values of that
+// type, as numbers and strings do not compare with each other.
+type IndexRange struct {
+	Min        string // Lower bound; empty leaves the range open below
+	Max        string // Upper bound; empty leaves the range open above
+	ExcludeMin bool   // Whether values equal to Min are left out
+	ExcludeMax bool   // Whether values equal to Max are left out
+}
+
+// Types of indexed value, in the order they sort in.
+const (
+	kindNull uint8 = iota
+	kindBool
+	kindNumber
+	kindString
+)
+
+// indexValue is a JSON scalar as held by an index. Objects and arrays are not indexed.
+type indexValue struct {
+	kind uint8
+	num  float64 // Value of a number; 1 for true and 0 for false
+	str  string  // Value of a string
+}
+
+// compareIndexValues orders values by type, then by value.
+func compareIndexValues(a, b indexValue) int {
+	if c := cmp.Compare(a.kind, b.kind); c != 0 {
+		return c
+	}
+	if a.kind == kindString {
+		return strings.Compare(a.str, b.str)
+	}
+	return cmp.Compare(a.num, b.num)
+}
+
+// lowestOf returns a value sorting before every value of the given type.
+func lowestOf(kind uint8) indexValue {
+	return indexValue{kind: kind, num: math.Inf(-1)}
+}
+
+// toIndexValue converts a decoded JSON value, reporting false for objects and arrays.
+func toIndexValue(v any) (indexValue, bool) {
+	switch v := v.(type) {
+	case nil:
+		return indexValue{kind: kindNull}, true
+	case bool:
+		if v {
+			return indexValue{kind: kindBool, num: 1}, true
+		}
+		return indexValue{kind: kindBool}, true
+	case float64:
+		return indexValue{kind: kindNumber, num: v}, true
+	case string:
+		return indexValue{kind: kindString, str: v}, true
+	default:
+		return indexValue{}, false
+	}
+}
+
+// parseIndexValue parses a JSON value given as a lookup bound.
+func parseIndexValue(s string) (indexValue, error) {
+	var v any
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return indexValue{}, fmt.Errorf("invalid value %s: %w", s, err)
+	}
+	iv, ok := toIndexValue(v)
+	if !ok {
+		return indexValue{}, fmt.Errorf("invalid value %s: only strings, numbers, booleans and null are indexed", s)
+	}
+	return iv, nil
+}
+
+// indexEntry is a key with the value its document has at an index's path.
+type indexEntry struct {
+	value indexValue
+	key   string
+}
+
+// compareEntries orders entries by value, then by key.
+func compareEntries(a, b indexEntry) int {
+	if c := compareIndexValues(a.value, b.value); c != 0 {
+		return c
+	}
+	return strings.Compare(a.key, b.key)
+}
+
+// secondaryIndex is the index on one path.
+type secondaryIndex struct {
+	path    jsonPath
+	values  map[string]indexValue // Indexed value of each key
+	entries []indexEntry          // Every indexed key, sorted by value and then key
+	arrays  map[string]struct{}   // Keys whose documents hold an array on the path, which Find must always examine
+}
+
+// newSecondaryIndex returns an empty index on path.
+func newSecondaryIndex(path jsonPath) *secondaryIndex {
+	return &secondaryIndex{path: path, values: make(map[string]indexValue), arrays: make(map[string]struct{})}
+}
+
+// holdsArray reports whether doc has an array at or on the way to the index's path.
+// A query condition on the path may match any of its elements, which the index
+// cannot hold.
+func (x *secondaryIndex) holdsArray(doc any) bool {
+	for _, step := range x.path {
+		switch node := doc.(type) {
+		case []any:
+			return true
+		case map[string]any:
+			doc = node[step.name]
+		default:
+			return false
+		}
+	}
+	_, isArray := doc.([]any)
+	return isArray
+}
+
+// add records key's entry, or notes that its document holds an array, without
+// keeping the entries sorted.
+func (x *secondaryIndex) add(key string, doc any) (indexEntry, bool) {
+	e, ok := x.entryFor(key, doc)
+	if ok {
+		x.values[key] = e.value
+	} else if x.holdsArray(doc) {
+		x.arrays[key] = struct{}{}
+	}
+	return e, ok
+}
+
+// entryFor returns the entry for key's document, or false if the document has no
+// indexable value at the path.
+func (x *secondaryIndex) entryFor(key string, doc any) (indexEntry, bool) {
+	raw, ok := x.path.lookup(doc)
+	if !ok {
+		return indexEntry{}, false
+	}
+	v, ok := toIndexValue(raw)
+	return indexEntry{value: v, key: key}, ok
+}
+
+// insert adds key's entry, keeping the entries sorted. Any earlier entry for key
+// must have been removed.
+func (x *secondaryIndex) insert(key string, doc any) {
+	e, ok := x.add(key, doc)
+	if !ok {
+		return
+	}
+	i, _ := slices.BinarySearchFunc(x.entries, e, compareEntries)
+	x.entries = slices.Insert(x.entries, i, e)
+}
+
+// remove drops key's entry, if it has one.
+func (x *secondaryIndex) remove(key string) {
+	delete(x.arrays, key)
+	v, ok := x.values[key]
+	if !ok {
+		return
+	}
+	if i, found := slices.BinarySearchFunc(x.entries, indexEntry{value: v, key: key}, compareEntries); found {
+		x.entries = slices.Delete(x.entries, i, i+1)
+	}
+	delete(x.values, key)
+}
+
+// position returns the index of the first entry whose value is above v, or at least
+// v if inclusive.
+func (x *secondaryIndex) position(v indexValue, inclusive bool) int {
+	return sort.Search(len(x.entries), func(i int) bool {
+		c := compareIndexValues(x.entries[i].value, v)
+		return c > 0 || (inclusive && c == 0)
+	})
+}
+
+// between returns the keys whose values lie in r, in value order.
+func (x *secondaryIndex) between(r IndexRange) ([]string, error) {
+	var lo, hi *indexValue
+	if r.Min != "" {
+		v, err := parseIndexValue(r.Min)
+		if err != nil {
+			return nil, err
+		}
+		lo = &v
+	}
+	if r.Max != "" {
+		v, err := parseIndexValue(r.Max)
+		if err != nil {
+			return nil, err
+		}
+		hi = &v
+	}
+	if lo != nil && hi != nil && lo.kind != hi.kind {
+		return nil, errors.New("range bounds must be of the same type")
+	}
+
+	// An open end stops at the edge of the other bound's type.
+	start, end := 0, len(x.entries)
+	switch {
+	case lo != nil:
+		start = x.position(*lo, !r.ExcludeMin)
+	case hi != nil:
+		start = x.position(lowestOf(hi.kind), true)
+	}
+	switch {
+	case hi != nil:
+		end = x.position(*hi, r.ExcludeMax)
+	case lo != nil:
+		end = x.position(lowestOf(lo.kind+1), true)
+	}
+
+	var keys []string
+	for i := start; i < end; i++ {
+		keys = append(keys, x.entries[i].key)
+	}
+	return keys, nil
+}
+
+// indexSet is a store's secondary indexes. Entries for a key are only changed while
+// holding that key's write lock, after the write has reached the backend.
+type indexSet struct {
+	mu      sync.RWMutex
+	indexes map[string]*secondaryIndex // Indexes by canonical path
+}
+
+// newIndexSet returns a set without indexes.
+func newIndexSet() *indexSet {
+	return &indexSet{indexes: make(map[string]*secondaryIndex)}
+}
+
+// update re-indexes key after a write that left value behind, or deleted it.
+func (is *indexSet) update(key, value string, deleted bool) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	if len(is.indexes) == 0 {
+		return
+	}
+	var doc any
+	indexable := !deleted && json.Unmarshal([]byte(value), &doc) == nil
+	for _, x := range is.indexes {
+		x.remove(key)
+		if indexable {
+			x.insert(key, doc)
+		}
+	}
+}
+
+// get returns the index on the canonical path.
+func (is *indexSet) get(path string) (*secondaryIndex, bool) {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+
+	x, ok := is.indexes[path]
+	return x, ok
+}
+
+// set adds or replaces the index on its path.
+func (is *indexSet) set(x *secondaryIndex) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	is.indexes[x.path.String()] = x
+}
+
+// drop removes the index on the canonical path and reports whether there was one.
+func (is *indexSet) drop(path string) bool {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	_, ok := is.indexes[path]
+	delete(is.indexes, path)
+	return ok
+}
+
+// replace swaps in a new set of indexes.
+func (is *indexSet) replace(indexes map[string]*secondaryIndex) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	is.indexes = indexes
+}
+
+// reset empties every index, keeping it declared.
+func (is *indexSet) reset() {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	for path, x := range is.indexes {
+		is.indexes[path] = newSecondaryIndex(x.path)
+	}
+}
+
+// info describes every index, ordered by path.
+func (is *indexSet) info() []IndexInfo {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+
+	infos := make([]IndexInfo, 0, len(is.indexes))
+	for path, x := range is.indexes {
+		infos = append(infos, IndexInfo{Path: path, Entries: len(x.entries)})
+	}
+	slices.SortFunc(infos, func(a, b IndexInfo) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return infos
+}
+
+// lookup returns the keys of the index on the canonical path whose values lie in r.
+func (is *indexSet) lookup(path string, r IndexRange) ([]string, error) {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+
+	x, ok := is.indexes[path]
+	if !ok {
+		return nil, ErrIndexNotFound
+	}
+	return x.between(r)
+}
+
+// candidates returns the keys of the index on the canonical path whose values lie in
+// r, followed by the keys whose documents hold an array on the path, which may match
+// too.
+func (is *indexSet) candidates(path string, r IndexRange) ([]string, error) {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+
+	x, ok := is.indexes[path]
+	if !ok {
+		return nil, ErrIndexNotFound
+	}
+	keys, err := x.between(r)
+	if err != nil {
+		return nil, err
+	}
+	for key := range x.arrays {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// buildIndexes indexes every key visited by iterate on each of paths, parsing each
+// document once.
+func buildIndexes(paths []jsonPath, iterate func(fn func(key, value string) bool) error) (map[string]*secondaryIndex, error) {
+	indexes := make(map[string]*secondaryIndex, len(paths))
+	for _, p := range paths {
+		indexes[p.String()] = newSecondaryIndex(p)
+	}
+	if len(paths) == 0 {
+		return indexes, nil
+	}
+
+	err := iterate(func(key, value string) bool {
+		var doc any
+		if isInternalKey(key) || json.Unmarshal([]byte(value), &doc) != nil {
+			return true
+		}
+		for _, x := range indexes {
+			if e, ok := x.add(key, doc); ok {
+				x.entries = append(x.entries, e)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Sorting once is much cheaper than inserting each entry in order.
+	for _, x := range indexes {
+		slices.SortFunc(x.entries, compareEntries)
+	}
+	return indexes, nil
+}
+
+// CreateIndex declares a secondary index on the JSON path, e.g. "$.age" or
+// "$.address.city", and indexes every key. Keys whose documents have a string,
+// number, boolean or null at the path are indexed; others are left out. The index
+// is persisted with the data and kept up to date by every write.
+func (s *Store) CreateIndex(path string) error {
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return err
+	}
+	if err := s.writable(); err != nil {
+		return err
+	}
+
+	s.locks.lockAll()
+	defer s.locks.unlockAll()
+
+	name := p.String()
+	if _, exists := s.indexes.get(name); exists {
+		return ErrIndexExists
+	}
+	built, err := buildIndexes([]jsonPath{p}, s.backend.Iterate)
+	if err != nil {
+		return fmt.Errorf("failed to build index: %w", err)
+	}
+	if err := s.backend.Put(indexKey(name), formatIndexPath(name)); err != nil {
+		return fmt.Errorf("failed to store index: %w", err)
+	}
+	s.indexes.set(built[name])
+	s.noteWrites(1)
+	return nil
+}
+
+// DropIndex removes the secondary index on the JSON path.
+func (s *Store) DropIndex(path string) error {
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return err
+	}
+	if err := s.writable(); err != nil {
+		return err
+	}
+
+	s.locks.lockAll()
+	defer s.locks.unlockAll()
+
+	name := p.String()
+	if _, exists := s.indexes.get(name); !exists {
+		return ErrIndexNotFound
+	}
+	if err := s.backend.Delete(indexKey(name)); err != nil {
+		return fmt.Errorf("failed to drop index: %w", err)
+	}
+	s.indexes.drop(name)
+	s.noteWrites(1)
+	return nil
+}
+
+// Indexes describes the store's secondary indexes, ordered by path.
+func (s *Store) Indexes() []IndexInfo {
+	return s.indexes.info()
+}
+
+// Lookup returns the keys whose documents have value, given as JSON (e.g. `30` or
+// `"ada@example.com"`), at the JSON path, which must have an index. Keys are in
+// order.
+func (s *Store) Lookup(path, value string) ([]string, error) {
+	if value == "" {
+		return nil, errors.New("value is required")
+	}
+	return s.LookupRange(path, IndexRange{Min: value, Max: value})
+}
+
+// LookupRange returns the keys whose documents have a value in r at the JSON path,
+// which must have an index, ordered by value and then by key.
+func (s *Store) LookupRange(path string, r IndexRange) ([]string, error) {
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := s.indexes.lookup(p.String(), r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Expired keys stay indexed until they are reaped, but are not part of the data.
+	now := time.Now()
+	keys = slices.DeleteFunc(keys, func(key string) bool {
+		return s.expiries.expired(key, now)
+	})
+	if keys == nil {
+		keys = []string{}
+	}
+	return keys, nil
+}
+
+// formatIndexPath encodes an index's path as the value of its metadata key.
+func formatIndexPath(path string) string {
+	quoted, _ := json.Marshal(path)
+	return string(quoted)
+}
+
+// indexMetadataLocked returns the metadata declaring the store's indexes, for writing
+// back after the backend has been cleared. The caller must hold every stripe's write lock.
+func (s *Store) indexMetadataLocked() []BatchOp {
+	var ops []BatchOp
+	for _, info := range s.indexes.info() {
+		ops = append(ops, BatchOp{Key: indexKey(info.Path), Value: formatIndexPath(info.Path)})
+	}
+	return ops
+}
+
+// loadIndexesLocked rebuilds the indexes declared in the backend's metadata from its
+// data. The caller must hold every stripe's write lock.
+func (s *Store) loadIndexesLocked() error {
+	var paths []jsonPath
+	collect := func(key, _ string) bool {
+		name, ok := strings.CutPrefix(key, indexKeyPrefix)
+		if !ok {
+			return true
+		}
+		p, err := parseJSONPath(name)
+		if err != nil {
+			log.Printf("store: ignoring unreadable index: %v", err)
+			return true
+		}
+		paths = append(paths, p)
+		return true
+	}
+
+	// Backends with sorted keys can visit just the metadata instead of every key.
+	var err error
+	if r, ok := s.backend.(RangeIterator); ok {
+		err = r.Range(indexKeyPrefix, indexKeyEnd, collect)
+	} else {
+		err = s.backend.Iterate(collect)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load indexes: %w", err)
+	}
+
+	indexes, err := buildIndexes(paths, s.backend.Iterate)
+	if err != nil {
+		return fmt.Errorf("failed to build indexes: %w", err)
+	}
+	s.indexes.replace(indexes)
+	return nil
+}
@@ -0,0 +1,281 @@
+// Package store implements the JSON paths that secondary indexes are declared on, such
+// as "$.age" or "$.address.city", and partial reads of documents. A path starts at the
+// document root "$" and steps into object members with ".name" or ["name"], and into
+// array elements with [n]. Partial reads also take JSON Pointers (RFC 6901), such as
+// "/address/city".
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrPathNotFound is returned when a document has nothing at the path being read.
+var ErrPathNotFound = errors.New("path not found")
+
+// pathStep is one step of a JSON path.
+type pathStep struct {
+	name  string // Object member stepped into, if index is negative or name is set
+	index int    // Array element stepped into, or -1 for an object member
+}
+
+// A JSON Pointer token such as "0" does not say whether it names an array element or
+// an object member, so it sets both name and index and steps into whichever it meets.
+
+// jsonPath is a parsed JSON path; an empty path selects the whole document.
+type jsonPath []pathStep
+
+// identifierPattern matches member names that need no brackets in a path.
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseJSONPath parses a path such as `$.address.city`, `$["full name"]` or `$.tags[0]`.
+func parseJSONPath(path string) (jsonPath, error) {
+	rest, ok := strings.CutPrefix(path, "$")
+	if !ok {
+		return nil, fmt.Errorf("invalid path %q: must start with '$'", path)
+	}
+
+	var p jsonPath
+	for rest != "" {
+		var step pathStep
+		var err error
+		switch rest[0] {
+		case '.':
+			step, rest, err = parseMemberStep(rest[1:])
+		case '[':
+			step, rest, err = parseBracketStep(rest[1:])
+		default:
+			err = fmt.Errorf("unexpected %q", rest[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid path %q: %w", path, err)
+		}
+		p = append(p, step)
+	}
+	return p, nil
+}
+
+// pointerUnescaper decodes the escapes of a JSON Pointer token.
+var pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+// parsePointer parses a JSON Pointer such as "/address/city" or "/tags/0". The empty
+// pointer selects the whole document.
+func parsePointer(ptr string) (jsonPath, error) {
+	if ptr == "" {
+		return jsonPath{}, nil
+	}
+	if ptr[0] != '/' {
+		return nil, fmt.Errorf("invalid pointer %q: must start with '/'", ptr)
+	}
+
+	var p jsonPath
+	for _, token := range strings.Split(ptr[1:], "/") {
+		for i := 0; i < len(token); i++ {
+			if token[i] != '~' {
+				continue
+			}
+			if i+1 >= len(token) || (token[i+1] != '0' && token[i+1] != '1') {
+				return nil, fmt.Errorf("invalid pointer %q: '~' must be followed by '0' or '1'", ptr)
+			}
+			i++
+		}
+		token = pointerUnescaper.Replace(token)
+
+		step := pathStep{name: token, index: -1}
+		// Array indexes are written without leading zeros, so "01" can only be a member.
+		if index, err := strconv.Atoi(token); err == nil && index >= 0 && strconv.Itoa(index) == token {
+			step.index = index
+		}
+		p = append(p, step)
+	}
+	return p, nil
+}
+
+// parseReadPath parses the path of a partial read: a JSON Pointer if it is empty or
+// starts with '/', and a JSON path otherwise. A JSON path may leave out the leading
+// '$', so ".address.city" reads the same as "$.address.city".
+func parseReadPath(path string) (jsonPath, error) {
+	switch {
+	case path == "" || path[0] == '/':
+		return parsePointer(path)
+	case path[0] == '.' || path[0] == '[':
+		return parseJSONPath("$" + path)
+	default:
+		return parseJSONPath(path)
+	}
+}
+
+// parseMemberStep parses the name after a '.', returning the rest of the path.
+func parseMemberStep(s string) (pathStep, string, error) {
+	end := strings.IndexAny(s, ".[")
+	if end < 0 {
+		end = len(s)
+	}
+	if end == 0 {
+		return pathStep{}, "", errors.New("empty member name")
+	}
+	return pathStep{name: s[:end], index: -1}, s[end:], nil
+}
+
+// parseBracketStep parses a quoted member name or an array index and the closing
+// ']', which follow a '[', returning the rest of the path.
+func parseBracketStep(s string) (pathStep, string, error) {
+	if s != "" && (s[0] == '"' || s[0] == '\'') {
+		quote := s[0]
+		end := 1
+		for end < len(s) && s[end] != quote {
+			if s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(s) || !strings.HasPrefix(s[end+1:], "]") {
+			return pathStep{}, "", errors.New("unterminated member name")
+		}
+		name := s[1:end]
+		if quote == '"' {
+			unquoted, err := strconv.Unquote(s[:end+1])
+			if err != nil {
+				return pathStep{}, "", fmt.Errorf("invalid member name %s", s[:end+1])
+			}
+			name = unquoted
+		}
+		return pathStep{name: name, index: -1}, s[end+2:], nil
+	}
+
+	end := strings.IndexByte(s, ']')
+	if end < 0 {
+		return pathStep{}, "", errors.New("missing ']'")
+	}
+	index, err := strconv.Atoi(s[:end])
+	if err != nil || index < 0 {
+		return pathStep{}, "", fmt.Errorf("invalid array index %q", s[:end])
+	}
+	return pathStep{index: index}, s[end+1:], nil
+}
+
+// String returns the path in canonical form, which is how indexes are named.
+func (p jsonPath) String() string {
+	var b strings.Builder
+	b.WriteString("$")
+	for _, step := range p {
+		switch {
+		case step.index >= 0:
+			fmt.Fprintf(&b, "[%d]", step.index)
+		case identifierPattern.MatchString(step.name):
+			b.WriteString("." + step.name)
+		default:
+			b.WriteString("[" + strconv.Quote(step.name) + "]")
+		}
+	}
+	return b.String()
+}
+
+// lookup returns the part of a decoded JSON document the path selects, if it exists.
+func (p jsonPath) lookup(doc any) (any, bool) {
+	doc, n := p.walk(doc)
+	return doc, n == len(p)
+}
+
+// walk follows the path through a decoded JSON document as far as it exists, and
+// returns the node it got to and the number of steps taken.
+func (p jsonPath) walk(doc any) (any, int) {
+	for i, step := range p {
+		switch node := doc.(type) {
+		case map[string]any:
+			member, ok := node[step.name]
+			if (step.index >= 0 && step.name == "") || !ok {
+				return doc, i
+			}
+			doc = member
+		case []any:
+			if step.index < 0 || step.index >= len(node) {
+				return doc, i
+			}
+			doc = node[step.index]
+		default:
+			return doc, i
+		}
+	}
+	return doc, len(p)
+}
+
+// SelectPath returns the JSON text of the part of a JSON document that path selects.
+// The path is a JSON Pointer such as "/address/city" or a JSON path such as
+// "$.address.city" or ".address.city"; "$" and the empty pointer select the whole
+// document. It returns an error wrapping ErrPathNotFound if there is nothing there.
+func SelectPath(doc, path string) (string, error) {
+	p, err := parseReadPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	var root any
+	dec := json.NewDecoder(strings.NewReader(doc))
+	dec.UseNumber() // Numbers are written back exactly as they were stored
+	if err := dec.Decode(&root); err != nil {
+		return "", fmt.Errorf("value is not a valid JSON document: %w", err)
+	}
+
+	node, n := p.walk(root)
+	if n < len(p) {
+		return "", fmt.Errorf("%w: %s", ErrPathNotFound, describeMiss(p[:n], p[n], node))
+	}
+
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(node); err != nil {
+		return "", fmt.Errorf("failed to encode value: %w", err)
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// describeMiss explains why step could not be taken from node, which the steps in at
+// lead to.
+func describeMiss(at jsonPath, step pathStep, node any) string {
+	switch node := node.(type) {
+	case map[string]any:
+		if step.index >= 0 && step.name == "" {
+			return fmt.Sprintf("%s is an object, not an array", at)
+		}
+		return fmt.Sprintf("%s has no member %q", at, step.name)
+	case []any:
+		if step.index < 0 {
+			return fmt.Sprintf("%s is an array, not an object", at)
+		}
+		return fmt.Sprintf("%s has no element %d, only %d", at, step.index, len(node))
+	case nil:
+		return fmt.Sprintf("%s is null", at)
+	default:
+		return fmt.Sprintf("%s is a %s, not an object or array", at, jsonKind(node))
+	}
+}
+
+// jsonKind names the JSON type of a decoded scalar.
+func jsonKind(v any) string {
+	switch v.(type) {
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	default:
+		return "number"
+	}
+}
+
+// ReadPath retrieves the part of the value for a given key that path selects, as JSON
+// text; see SelectPath for the paths it takes. It returns ErrKeyNotFound if the key
+// does not exist, and an error wrapping ErrPathNotFound if the document has nothing
+// at the path.
+func (s *Store) ReadPath(key, path string) (string, error) {
+	value, err := s.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return SelectPath(value, path)
+}
@@ -0,0 +1,288 @@
+// Package store implements streaming loads of the data file. Entries are parsed as
+// the file is read, so a load of an unencrypted file never holds it in memory beside
+// the data;
+// progress is reported along the way, damaged entries can be skipped rather than
+// failing the load, and values can be left in the file until they are first read.
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// LoadOptions controls how Load reads the data file; see WithLoadOptions.
+//
+// An encrypted file is sealed as a whole, so it is read and decrypted in memory before
+// any entry is parsed: loading it takes memory for the whole file on top of the data,
+// progress is only reported once it has been decrypted, and Lazy has no effect on it.
+type LoadOptions struct {
+	Progress      func(LoadProgress) // Called every megabyte or so and once the file has been read; nil disables it
+	SkipMalformed bool               // Whether damaged entries are skipped instead of failing the load
+	Malformed     func(FsckProblem)  // Called with each damaged entry skipped; nil ignores them
+	Lazy          bool               // Whether values stay in the file until first read, with only keys loaded
+}
+
+// LoadProgress reports how far Load has got through a file.
+type LoadProgress struct {
+	Path       string // File being read
+	Entries    int    // Entries read so far
+	BytesRead  int64  // Bytes of the file read so far, as stored on disk
+	TotalBytes int64  // Size of the file
+}
+
+// progressInterval is how many bytes of a file are read between progress reports.
+const progressInterval = 1 << 20
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read reads from the underlying reader and counts what it got.
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// scanSnapshotFile reads a snapshot file as a stream, calling visit with each entry,
+// and returns its format version. Entries only carry a Ref into the file if it is
+// stored plain: a compressed or encrypted value cannot be read back at an offset.
+// Encrypted files are opened in memory, since encryption seals the file as a whole.
+func scanSnapshotFile(file *os.File, keys *Keyring, lo LoadOptions, visit func(snapshotEntry) error) (int, error) {
+	path := file.Name()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	counter := &countingReader{r: file}
+	r := bufio.NewReaderSize(counter, 1<<16)
+	head, _ := r.Peek(32)
+
+	var src io.Reader = r
+	plain := true
+	if isEncrypted(head) {
+		// The whole file is one AES-GCM seal, which can only be checked once all of it is read.
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read file: %w", err)
+		}
+		if content, err = openFile(content, keys); err != nil {
+			return 0, err
+		}
+		src, plain = bytes.NewReader(content), false
+	} else if c := detectCodec(head); c != nil {
+		cr, err := c.NewReader(r)
+		if err != nil {
+			return 0, fmt.Errorf("failed to decompress %s: %w", c.Name(), err)
+		}
+		defer cr.Close()
+		src, plain = cr, false
+	}
+
+	entries, next := 0, int64(progressInterval)
+	report := func() {
+		lo.Progress(LoadProgress{Path: path, Entries: entries, BytesRead: counter.n, TotalBytes: info.Size()})
+	}
+	damaged := problemError
+	if lo.SkipMalformed {
+		damaged = func(p FsckProblem) error {
+			if lo.Malformed != nil {
+				lo.Malformed(p)
+			}
+			return nil
+		}
+	}
+
+	version, err := scanStream(src, func(e snapshotEntry) error {
+		if !plain {
+			e.Ref = valueRef{}
+		}
+		entries++
+		if lo.Progress != nil && counter.n >= next {
+			report()
+			next = counter.n + progressInterval
+		}
+		return visit(e)
+	}, damaged)
+	if err != nil {
+		return version, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if lo.Progress != nil {
+		report()
+	}
+	return version, nil
+}
+
+// readSnapshot reads and parses a single snapshot file, and returns the format
+// version it was written in. It returns a nil map and no error if the file does not
+// exist.
+func readSnapshot(path string, keys *Keyring) (map[string]string, int, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, FormatVersion, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read file: %w", err)
+	}
+	defer file.Close()
+
+	data := make(map[string]string)
+	version, err := scanSnapshotFile(file, keys, LoadOptions{}, func(e snapshotEntry) error {
+		data[e.Key] = e.Value
+		return nil
+	})
+	if err != nil {
+		return nil, version, err
+	}
+	return data, version, nil
+}
+
+// loadFile streams the data file into memory, leaving values in it if loading is
+// lazy, and returns its format version. A missing file leaves the data as it is.
+// The caller must hold every shard's write lock and walMu.
+func (b *FileBackend) loadFile() (int, error) {
+	file, err := os.Open(b.path)
+	if os.IsNotExist(err) {
+		return FormatVersion, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	// Entries go straight into maps for each shard, which replace the current ones
+	// only once the whole file has been read.
+	n := len(b.data.shards)
+	data := make([]map[string]string, n)
+	lazy := make([]map[string]valueRef, n)
+	for i := range data {
+		data[i] = make(map[string]string)
+		lazy[i] = make(map[string]valueRef)
+	}
+	deferred := 0
+	version, err := scanSnapshotFile(file, b.keys, b.load, func(e snapshotEntry) error {
+		i := shardIndex(e.Key, n)
+		// Metadata is read at every load, so there is nothing to gain by deferring it.
+		if b.load.Lazy && e.Ref.n > 0 && !isInternalKey(e.Key) {
+			lazy[i][e.Key] = e.Ref
+			deferred++
+		} else {
+			data[i][e.Key] = e.Value
+		}
+		return nil
+	})
+	if err != nil {
+		file.Close()
+		return version, err
+	}
+
+	for i := range b.data.shards {
+		b.data.shards[i].data = data[i]
+		b.data.shards[i].lazy = lazy[i]
+	}
+	if deferred == 0 {
+		file.Close()
+		file = nil
+	}
+	b.setSourceLocked(file)
+	return version, nil
+}
+
+// setSourceLocked makes file the one lazily loaded values are read from, closing the
+// previous one. The caller must hold every shard's write lock.
+func (b *FileBackend) setSourceLocked(file *os.File) {
+	if b.source != nil {
+		b.source.Close()
+	}
+	b.source = file
+}
+
+// readRef reads a lazily loaded value from the data file it was loaded from. The
+// file stays open, so this works even after a checkpoint has replaced it. The caller
+// must hold the lock of the value's shard.
+func (b *FileBackend) readRef(ref valueRef) (string, error) {
+	if b.source == nil {
+		return "", errors.New("backend is closed")
+	}
+	raw := make([]byte, ref.n)
+	if _, err := b.source.ReadAt(raw, ref.off); err != nil {
+		return "", fmt.Errorf("failed to read value: %w", err)
+	}
+	value, err := decodeRef(ref, raw)
+	if err != nil {
+		return "", fmt.Errorf("failed to read value: %w", err)
+	}
+	return value, nil
+}
+
+// rangeLocked calls fn for every pair until fn returns false, reading values that
+// are still in the data file without keeping them. The caller must hold every
+// shard's lock.
+func (b *FileBackend) rangeLocked(fn func(key, value string) bool) error {
+	for i := range b.data.shards {
+		sh := &b.data.shards[i]
+		for key, value := range sh.data {
+			if !fn(key, value) {
+				return nil
+			}
+		}
+		for key, ref := range sh.lazy {
+			value, err := b.readRef(ref)
+			if err != nil {
+				return fmt.Errorf("failed to load value of %q: %w", key, err)
+			}
+			if !fn(key, value) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// Range calls fn, in key order, for every key k with start <= k < end until fn
+// returns false. An empty end means no upper bound. Only the values of keys in the
+// range are read, so loading metadata does not pull in lazily loaded values.
+func (b *FileBackend) Range(start, end string, fn func(key, value string) bool) error {
+	b.data.rLockAll()
+	defer b.data.rUnlockAll()
+
+	inRange := func(key string) bool {
+		return key >= start && (end == "" || key < end)
+	}
+	var keys []string
+	for i := range b.data.shards {
+		for key := range b.data.shards[i].data {
+			if inRange(key) {
+				keys = append(keys, key)
+			}
+		}
+		for key := range b.data.shards[i].lazy {
+			if inRange(key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		sh := b.data.shardFor(key)
+		value, exists := sh.data[key]
+		if !exists {
+			var err error
+			if value, err = b.readRef(sh.lazy[key]); err != nil {
+				return fmt.Errorf("failed to load value of %q: %w", key, err)
+			}
+		}
+		if !fn(key, value) {
+			return nil
+		}
+	}
+	return nil
+}
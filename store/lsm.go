@@ -0,0 +1,617 @@
+// Package store implements LSM, a log-structured merge-tree Backend for datasets larger
+// than memory. Writes go to a write-ahead log and an in-memory memtable; a full memtable
+// is flushed to an immutable sorted SSTable in level 0. A background compaction merges
+// level 0 into level 1 and each level into the next once it outgrows its budget, so that
+// levels 1 and up hold non-overlapping tables. Reads check the memtable and then the
+// tables from newest to oldest, using each table's bloom filter and sparse index to
+// avoid reading data that cannot hold the key.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Defaults for LSMOptions fields left at zero.
+const (
+	DefaultLSMMemtableSize = 4 << 20 // Memtable size that triggers a flush
+	DefaultLSMTableSize    = 2 << 20 // Target size of tables written by compaction
+	DefaultLSML0Tables     = 4       // Level-0 table count that triggers a compaction
+	DefaultLSMLevelRatio   = 10      // Size ratio between consecutive levels
+	DefaultLSMMaxLevels    = 7       // Number of levels, level 0 included
+)
+
+const (
+	lsmManifestName = "MANIFEST"
+	lsmWALName      = "memtable.wal"
+	lsmTableExt     = ".sst"
+	lsmEntryBytes   = 32 // Approximate per-entry memtable overhead
+)
+
+// ErrLSMClosed is returned by operations on a closed LSM.
+var ErrLSMClosed = errors.New("lsm is closed")
+
+// LSMOptions configures an LSM. Zero values select the defaults.
+type LSMOptions struct {
+	MemtableSize int64 // Approximate memtable size in bytes at which it is flushed to level 0
+	TableSize    int64 // Target size of tables produced by compaction
+	L0Tables     int   // Number of level-0 tables that triggers a compaction into level 1
+	LevelRatio   int   // Each level may hold this many times the bytes of the one above
+	MaxLevels    int   // Number of levels, level 0 included
+}
+
+// lsmManifest is the on-disk list of live tables, rewritten atomically after every change.
+type lsmManifest struct {
+	NextFile int        `json:"next_file"`
+	Levels   [][]string `json:"levels"`
+}
+
+// LSM is a Backend storing its data in sorted tables under a directory.
+type LSM struct {
+	dir       string
+	opts      LSMOptions
+	mu        sync.RWMutex        // Guards everything below
+	memtable  map[string]lsmEntry // Writes since the last flush
+	memSize   int64               // Approximate size of the memtable
+	wal       *writeAheadLog      // Log of the writes in the memtable
+	levels    [][]*sstable        // Level 0 newest first; deeper levels sorted by key
+	nextFile  int                 // Number for the next table file
+	closed    bool
+	compactMu sync.Mutex    // Serialises compactions
+	compactCh chan struct{} // Wakes the background compaction
+	stop      chan struct{} // Closed to stop the background compaction
+	wg        sync.WaitGroup
+}
+
+// OpenLSM opens (or creates) an LSM in dir, replaying any writes left in its log.
+func OpenLSM(dir string, opts LSMOptions) (*LSM, error) {
+	if opts.MemtableSize <= 0 {
+		opts.MemtableSize = DefaultLSMMemtableSize
+	}
+	if opts.TableSize <= 0 {
+		opts.TableSize = DefaultLSMTableSize
+	}
+	if opts.L0Tables <= 0 {
+		opts.L0Tables = DefaultLSML0Tables
+	}
+	if opts.LevelRatio <= 1 {
+		opts.LevelRatio = DefaultLSMLevelRatio
+	}
+	if opts.MaxLevels < 2 {
+		opts.MaxLevels = DefaultLSMMaxLevels
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directories: %w", err)
+	}
+
+	l := &LSM{
+		dir:       dir,
+		opts:      opts,
+		memtable:  make(map[string]lsmEntry),
+		wal:       newWAL(filepath.Join(dir, lsmWALName), nil),
+		levels:    make([][]*sstable, opts.MaxLevels),
+		nextFile:  1,
+		compactCh: make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+	}
+	if err := l.recover(); err != nil {
+		l.closeTables()
+		return nil, err
+	}
+
+	l.wg.Add(1)
+	go l.compactLoop()
+	l.scheduleCompaction()
+	return l, nil
+}
+
+// recover opens the tables listed in the manifest, removes any that are not, and
+// rebuilds the memtable from the write-ahead log.
+func (l *LSM) recover() error {
+	content, err := os.ReadFile(filepath.Join(l.dir, lsmManifestName))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	live := make(map[string]bool)
+	if err == nil {
+		var manifest lsmManifest
+		if err := json.Unmarshal(content, &manifest); err != nil {
+			return fmt.Errorf("failed to parse manifest: %w", err)
+		}
+		l.nextFile = manifest.NextFile
+		for level, names := range manifest.Levels {
+			if level >= len(l.levels) {
+				return fmt.Errorf("manifest has %d levels, more than the configured %d", len(manifest.Levels), len(l.levels))
+			}
+			for _, name := range names {
+				t, err := openSSTable(filepath.Join(l.dir, name))
+				if err != nil {
+					return err
+				}
+				l.levels[level] = append(l.levels[level], t)
+				live[name] = true
+			}
+		}
+	}
+
+	// Tables from a flush or compaction that never made it into the manifest.
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), lsmTableExt) && !live[entry.Name()] {
+			os.Remove(filepath.Join(l.dir, entry.Name()))
+		}
+	}
+
+	return l.wal.replay(func(rec walRecord) {
+		switch rec.Op {
+		case walOpSet:
+			l.putMemtable(lsmEntry{key: rec.Key, value: rec.Value})
+		case walOpDelete:
+			l.putMemtable(lsmEntry{key: rec.Key, tombstone: true})
+		}
+	})
+}
+
+// Get returns the value stored under key.
+func (l *LSM) Get(key string) (string, bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return "", false, ErrLSMClosed
+	}
+
+	if e, ok := l.memtable[key]; ok {
+		return e.value, !e.tombstone, nil
+	}
+
+	for level, tables := range l.levels {
+		if level > 0 {
+			// Deeper levels do not overlap, so at most one table can hold the key.
+			i := sort.Search(len(tables), func(i int) bool { return tables[i].lastKey >= key })
+			if i == len(tables) {
+				continue
+			}
+			tables = tables[i : i+1]
+		}
+		for _, t := range tables {
+			e, found, err := t.get(key)
+			if err != nil {
+				return "", false, err
+			}
+			if found {
+				return e.value, !e.tombstone, nil
+			}
+		}
+	}
+	return "", false, nil
+}
+
+// Put logs the write and adds it to the memtable, flushing the memtable if it is full.
+func (l *LSM) Put(key, value string) error {
+	return l.write(walRecord{Op: walOpSet, Key: key, Value: value}, lsmEntry{key: key, value: value})
+}
+
+// Delete logs a tombstone for key and adds it to the memtable.
+func (l *LSM) Delete(key string) error {
+	return l.write(walRecord{Op: walOpDelete, Key: key}, lsmEntry{key: key, tombstone: true})
+}
+
+// write applies a single logged write.
+func (l *LSM) write(rec walRecord, e lsmEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrLSMClosed
+	}
+	if err := l.wal.append(rec); err != nil {
+		return fmt.Errorf("failed to log write: %w", err)
+	}
+
+	l.putMemtable(e)
+	if l.memSize >= l.opts.MemtableSize {
+		return l.flushLocked()
+	}
+	return nil
+}
+
+// putMemtable adds an entry to the memtable and updates its size estimate.
+func (l *LSM) putMemtable(e lsmEntry) {
+	if old, ok := l.memtable[e.key]; ok {
+		l.memSize -= int64(len(old.key) + len(old.value) + lsmEntryBytes)
+	}
+	l.memtable[e.key] = e
+	l.memSize += int64(len(e.key) + len(e.value) + lsmEntryBytes)
+}
+
+// Iterate calls fn for every live key-value pair, in key order, until fn returns false.
+func (l *LSM) Iterate(fn func(key, value string) bool) error {
+	return l.Range("", "", fn)
+}
+
+// Range calls fn, in key order, for every live key k with start <= k < end, until fn
+// returns false. An empty end means no upper bound.
+func (l *LSM) Range(start, end string, fn func(key, value string) bool) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return ErrLSMClosed
+	}
+
+	sources := []lsmIterator{&sliceIterator{entries: l.sortedMemtable(start, end)}}
+	for _, tables := range l.levels {
+		for _, t := range tables {
+			if t.overlaps(start, end) {
+				sources = append(sources, t.iterator(start))
+			}
+		}
+	}
+
+	it := newMergeIterator(sources)
+	for it.next() {
+		e := it.entry()
+		if end != "" && e.key >= end {
+			break
+		}
+		if e.tombstone {
+			continue
+		}
+		if !fn(e.key, e.value) {
+			return nil
+		}
+	}
+	return it.err()
+}
+
+// sortedMemtable returns the memtable entries with keys in [start, end), sorted by key.
+// The caller must hold the lock.
+func (l *LSM) sortedMemtable(start, end string) []lsmEntry {
+	entries := make([]lsmEntry, 0, len(l.memtable))
+	for key, e := range l.memtable {
+		if key >= start && (end == "" || key < end) {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries
+}
+
+// Flush writes the memtable to a new level-0 table.
+func (l *LSM) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrLSMClosed
+	}
+	return l.flushLocked()
+}
+
+// flushLocked writes the memtable to a level-0 table, records it in the manifest and
+// truncates the write-ahead log. The caller must hold the write lock.
+func (l *LSM) flushLocked() error {
+	if len(l.memtable) == 0 {
+		return nil
+	}
+
+	w, err := newSSTableWriter(l.tablePath(l.allocFile()))
+	if err != nil {
+		return err
+	}
+	for _, e := range l.sortedMemtable("", "") {
+		if err := w.add(e); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	t, err := w.finish()
+	if err != nil {
+		w.abort()
+		return err
+	}
+
+	l.levels[0] = append([]*sstable{t}, l.levels[0]...)
+	if err := l.saveManifest(); err != nil {
+		l.levels[0] = l.levels[0][1:]
+		t.close()
+		os.Remove(t.path)
+		return err
+	}
+
+	// The data is now in a table referenced by the manifest, so the log can go.
+	if err := l.wal.truncate(); err != nil {
+		return err
+	}
+	l.memtable = make(map[string]lsmEntry)
+	l.memSize = 0
+
+	l.scheduleCompaction()
+	return nil
+}
+
+// allocFile reserves a table file number. The caller must hold the write lock.
+func (l *LSM) allocFile() int {
+	n := l.nextFile
+	l.nextFile++
+	return n
+}
+
+// tablePath returns the path of a table file.
+func (l *LSM) tablePath(n int) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%09d%s", n, lsmTableExt))
+}
+
+// saveManifest atomically rewrites the manifest. The caller must hold the write lock.
+func (l *LSM) saveManifest() error {
+	manifest := lsmManifest{NextFile: l.nextFile, Levels: make([][]string, len(l.levels))}
+	for level, tables := range l.levels {
+		manifest.Levels[level] = []string{}
+		for _, t := range tables {
+			manifest.Levels[level] = append(manifest.Levels[level], filepath.Base(t.path))
+		}
+	}
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(l.dir, lsmManifestName), content)
+}
+
+// scheduleCompaction wakes the background compaction without blocking.
+func (l *LSM) scheduleCompaction() {
+	select {
+	case l.compactCh <- struct{}{}:
+	default:
+	}
+}
+
+// compactLoop runs compactions when woken until there is no more work.
+func (l *LSM) compactLoop() {
+	defer l.wg.Done()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-l.compactCh:
+			if err := l.Compact(); err != nil && !errors.Is(err, ErrLSMClosed) {
+				log.Printf("store: lsm compaction failed: %v", err)
+			}
+		}
+	}
+}
+
+// Compact runs compactions until no level exceeds its budget.
+func (l *LSM) Compact() error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+
+	for {
+		more, err := l.compactOnce()
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// lsmCompaction describes one compaction: the input tables, listed newest first, and
+// the level the output goes to.
+type lsmCompaction struct {
+	inputs []*sstable
+	level  int  // Level of the first input; outputs go to level+1
+	bottom bool // Whether no level below the output holds data, so tombstones can be dropped
+}
+
+// compactOnce runs a single compaction, if any level needs one, and reports whether it did.
+func (l *LSM) compactOnce() (bool, error) {
+	l.mu.RLock()
+	if l.closed {
+		l.mu.RUnlock()
+		return false, ErrLSMClosed
+	}
+	c := l.pickCompaction()
+	l.mu.RUnlock()
+	if c == nil {
+		return false, nil
+	}
+
+	outputs, err := l.writeCompaction(c)
+	if err != nil {
+		return false, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	consumed := make(map[*sstable]bool, len(c.inputs))
+	for _, t := range c.inputs {
+		consumed[t] = true
+	}
+	for _, level := range []int{c.level, c.level + 1} {
+		kept := l.levels[level][:0:0]
+		for _, t := range l.levels[level] {
+			if !consumed[t] {
+				kept = append(kept, t)
+			}
+		}
+		l.levels[level] = kept
+	}
+	next := append(l.levels[c.level+1], outputs...)
+	sort.Slice(next, func(i, j int) bool { return next[i].firstKey() < next[j].firstKey() })
+	l.levels[c.level+1] = next
+
+	if err := l.saveManifest(); err != nil {
+		return false, err
+	}
+	for _, t := range c.inputs {
+		t.close()
+		os.Remove(t.path)
+	}
+	return true, nil
+}
+
+// pickCompaction chooses the next compaction, or nil if every level is within budget.
+// The caller must hold the lock.
+func (l *LSM) pickCompaction() *lsmCompaction {
+	var c *lsmCompaction
+	if len(l.levels[0]) >= l.opts.L0Tables {
+		c = &lsmCompaction{inputs: append([]*sstable(nil), l.levels[0]...), level: 0}
+	} else {
+		budget := l.opts.TableSize * int64(l.opts.L0Tables) * int64(l.opts.LevelRatio)
+		for level := 1; level < len(l.levels)-1; level++ {
+			if levelBytes(l.levels[level]) > budget {
+				c = &lsmCompaction{inputs: []*sstable{l.levels[level][0]}, level: level}
+				break
+			}
+			budget *= int64(l.opts.LevelRatio)
+		}
+	}
+	if c == nil {
+		return nil
+	}
+
+	// Pull in every table of the next level that overlaps the inputs' key range.
+	start, end := c.inputs[0].firstKey(), c.inputs[0].lastKey
+	for _, t := range c.inputs[1:] {
+		start, end = min(start, t.firstKey()), max(end, t.lastKey)
+	}
+	for _, t := range l.levels[c.level+1] {
+		if t.overlaps(start, end) {
+			c.inputs = append(c.inputs, t)
+		}
+	}
+
+	c.bottom = true
+	for _, tables := range l.levels[c.level+2:] {
+		if len(tables) > 0 {
+			c.bottom = false
+		}
+	}
+	return c
+}
+
+// writeCompaction merges the inputs of c into new tables of at most TableSize bytes.
+func (l *LSM) writeCompaction(c *lsmCompaction) (outputs []*sstable, err error) {
+	sources := make([]lsmIterator, len(c.inputs))
+	for i, t := range c.inputs {
+		sources[i] = t.iterator("")
+	}
+
+	var w *sstableWriter
+	defer func() {
+		if err != nil {
+			if w != nil {
+				w.abort()
+			}
+			for _, t := range outputs {
+				t.close()
+				os.Remove(t.path)
+			}
+			outputs = nil
+		}
+	}()
+
+	it := newMergeIterator(sources)
+	for it.next() {
+		e := it.entry()
+		if e.tombstone && c.bottom {
+			continue // Nothing below can hold an older value for this key
+		}
+
+		if w == nil {
+			l.mu.Lock()
+			n := l.allocFile()
+			l.mu.Unlock()
+			if w, err = newSSTableWriter(l.tablePath(n)); err != nil {
+				return outputs, err
+			}
+		}
+		if err = w.add(e); err != nil {
+			return outputs, err
+		}
+		if w.offset >= l.opts.TableSize {
+			t, err := w.finish()
+			w = nil
+			if err != nil {
+				return outputs, err
+			}
+			outputs = append(outputs, t)
+		}
+	}
+	if err = it.err(); err != nil {
+		return outputs, err
+	}
+
+	if w != nil {
+		t, err := w.finish()
+		w = nil
+		if err != nil {
+			return outputs, err
+		}
+		outputs = append(outputs, t)
+	}
+	return outputs, nil
+}
+
+// levelBytes returns the total size of a level's tables.
+func levelBytes(tables []*sstable) int64 {
+	var n int64
+	for _, t := range tables {
+		n += t.size
+	}
+	return n
+}
+
+// Close stops the background compaction and closes the log and every table.
+// Writes still in the memtable remain in the log and are replayed on the next open.
+func (l *LSM) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.stop)
+	l.mu.Unlock()
+
+	l.wg.Wait()
+	l.compactMu.Lock() // Wait for a compaction started by a caller
+	defer l.compactMu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.wal.close()
+	if cerr := l.closeTables(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// closeTables closes every open table.
+func (l *LSM) closeTables() error {
+	var firstErr error
+	for _, tables := range l.levels {
+		for _, t := range tables {
+			if err := t.close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,328 @@
+// Package store implements multi-version concurrency control. Every committed write is
+// given a revision, and the values it replaced are kept for as long as some reader may
+// still need them, so a View pinned to a revision sees the data exactly as it was then
+// while writers carry on. The latest revision is persisted with the data, so revisions
+// keep increasing across restarts; superseded versions are only kept in memory.
+package store
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrCompacted is returned when a revision is older than the GC horizon, so the
+// versions needed to read it have been discarded.
+var ErrCompacted = errors.New("revision has been compacted")
+
+// ErrViewClosed is returned when a View is used after Close.
+var ErrViewClosed = errors.New("view is closed")
+
+// version is the state a key had during the half-open revision range [from, to).
+type version struct {
+	value   string // Value held during the range
+	deleted bool   // Whether the key was absent during the range
+	from    uint64 // Revision at which the key took this state
+	to      uint64 // Revision at which the key left this state
+}
+
+// versionLog assigns revisions to committed writes and keeps superseded versions
+// until they fall behind the GC horizon. It is a leaf lock: callers may hold a
+// key's stripe lock when calling in, but never the other way around.
+type versionLog struct {
+	mu      sync.Mutex
+	rev     atomic.Uint64        // Latest revision handed out to a write; handed out without mu
+	floor   uint64               // Oldest revision that can still be read; raised by reset
+	retain  uint64               // Revisions kept behind rev even when no view needs them
+	modRev  map[string]uint64    // Revision of the last change to each key that has history
+	history map[string][]version // Superseded versions of each key, oldest first
+	pins    map[uint64]int       // Number of open views pinned to each revision
+}
+
+// newVersionLog returns an empty version log that retains the given number of revisions.
+func newVersionLog(retain int) *versionLog {
+	return &versionLog{
+		retain:  uint64(max(retain, 0)),
+		modRev:  make(map[string]uint64),
+		history: make(map[string][]version),
+		pins:    make(map[uint64]int),
+	}
+}
+
+// current returns the revision of the latest committed write.
+func (l *versionLog) current() uint64 {
+	return l.rev.Load()
+}
+
+// next hands out a new revision for a write about to be applied, so the write can
+// persist it alongside the data. The caller must hold the lock of every key the write
+// changes until it has called record or recordAll, so no reader sees the change early.
+func (l *versionLog) next() uint64 {
+	return l.rev.Add(1)
+}
+
+// record commits a change to key at rev, keeping the state it replaced.
+// The caller must hold the key's write lock and have already applied the change.
+func (l *versionLog) record(key, old string, existed bool, rev uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.supersedeLocked(key, old, existed, rev)
+	l.pruneLocked(key, l.horizonLocked())
+}
+
+// recordAll commits a change to many keys as the single revision rev. Keys in old had
+// the given values before the change; keys in created did not exist.
+// The caller must hold every stripe's write lock and have already applied the change.
+func (l *versionLog) recordAll(old map[string]string, created []string, rev uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, value := range old {
+		l.supersedeLocked(key, value, true, rev)
+	}
+	for _, key := range created {
+		l.supersedeLocked(key, "", false, rev)
+	}
+	l.gcLocked()
+}
+
+// supersedeLocked ends key's current state at rev.
+func (l *versionLog) supersedeLocked(key, old string, existed bool, rev uint64) {
+	l.history[key] = append(l.history[key], version{
+		value:   old,
+		deleted: !existed,
+		from:    l.modRev[key],
+		to:      rev,
+	})
+	l.modRev[key] = rev
+}
+
+// reset discards all history, so no revision before the next one can be read. The
+// next revision is at least persisted, the latest revision found in the data.
+// It is used when the data is replaced wholesale, e.g. by Load.
+func (l *versionLog) reset(persisted uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rev.Store(max(l.rev.Load()+1, persisted))
+	l.floor = l.rev.Load()
+	l.modRev = make(map[string]uint64)
+	l.history = make(map[string][]version)
+}
+
+// horizonLocked returns the oldest revision that must remain readable: the older of
+// the oldest pinned revision and the retention window, but never below the floor.
+func (l *versionLog) horizonLocked() uint64 {
+	horizon := uint64(0)
+	if rev := l.rev.Load(); rev > l.retain {
+		horizon = rev - l.retain
+	}
+	for rev := range l.pins {
+		horizon = min(horizon, rev)
+	}
+	return max(horizon, l.floor)
+}
+
+// pruneLocked drops key's versions that ended at or before horizon.
+func (l *versionLog) pruneLocked(key string, horizon uint64) {
+	versions := l.history[key]
+	n := 0
+	for n < len(versions) && versions[n].to <= horizon {
+		n++
+	}
+	if n == len(versions) {
+		delete(l.history, key)
+		// Every readable revision sees the key's current state.
+		if l.modRev[key] <= horizon {
+			delete(l.modRev, key)
+		}
+		return
+	}
+	l.history[key] = versions[n:]
+}
+
+// gcLocked prunes every key's history against the current horizon.
+func (l *versionLog) gcLocked() {
+	horizon := l.horizonLocked()
+	for key := range l.history {
+		l.pruneLocked(key, horizon)
+	}
+}
+
+// pin keeps rev readable until unpin is called.
+func (l *versionLog) pin(rev uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rev > l.rev.Load() {
+		return errors.New("revision has not been committed yet")
+	}
+	if rev < l.horizonLocked() {
+		return ErrCompacted
+	}
+	l.pins[rev]++
+	return nil
+}
+
+// pinCurrent pins and returns the latest revision.
+func (l *versionLog) pinCurrent() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rev := l.rev.Load()
+	l.pins[rev]++
+	return rev
+}
+
+// unpin releases a pin taken by pin or pinCurrent and discards versions no longer needed.
+func (l *versionLog) unpin(rev uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.pins[rev]--; l.pins[rev] <= 0 {
+		delete(l.pins, rev)
+	}
+	l.gcLocked()
+}
+
+// lookup returns key's state at rev. If the key has not changed since rev, current
+// is true and the caller should read the live value instead.
+// The caller must hold the key's lock so the live value matches the log.
+func (l *versionLog) lookup(key string, rev uint64) (value string, exists, current bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rev < l.floor {
+		return "", false, false, ErrCompacted
+	}
+	if modRev, ok := l.modRev[key]; !ok || modRev <= rev {
+		return "", false, true, nil
+	}
+	for _, v := range l.history[key] {
+		if v.from <= rev && rev < v.to {
+			return v.value, !v.deleted, false, nil
+		}
+	}
+	return "", false, false, ErrCompacted
+}
+
+// changedKeys returns every key that has history, including keys deleted since.
+func (l *versionLog) changedKeys() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	keys := make([]string, 0, len(l.history))
+	for key := range l.history {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// View is a read-only view of a Store pinned to a revision. It sees every write
+// committed at or before that revision and none after, without blocking writers.
+// A View must be closed to release the versions it keeps alive.
+type View struct {
+	store  *Store      // Store the view reads from
+	rev    uint64      // Revision the view is pinned to
+	closed atomic.Bool // Set by Close
+}
+
+// Revision returns the revision of the latest committed write.
+func (s *Store) Revision() uint64 {
+	return s.versions.current()
+}
+
+// View opens a read-only view pinned to the latest revision.
+func (s *Store) View() *View {
+	return &View{store: s, rev: s.versions.pinCurrent()}
+}
+
+// ViewAt opens a read-only view pinned to an earlier revision. It returns
+// ErrCompacted if the revision is older than the GC horizon.
+func (s *Store) ViewAt(rev uint64) (*View, error) {
+	if err := s.versions.pin(rev); err != nil {
+		return nil, err
+	}
+	return &View{store: s, rev: rev}, nil
+}
+
+// Revision returns the revision the view is pinned to.
+func (v *View) Revision() uint64 {
+	return v.rev
+}
+
+// Get returns the value key had at the view's revision.
+func (v *View) Get(key string) (string, bool, error) {
+	if v.closed.Load() {
+		return "", false, ErrViewClosed
+	}
+	if isInternalKey(key) {
+		return "", false, nil
+	}
+
+	s := v.store
+	lock := s.locks.forKey(key)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	value, exists, current, err := s.versions.lookup(key, v.rev)
+	if err != nil || !current {
+		return value, exists, err
+	}
+	return s.backend.Get(key)
+}
+
+// Iterate calls fn, in key order, for every key-value pair at the view's revision
+// until fn returns false. Locks are only held while each key is looked up, so fn
+// may take as long as it likes without holding up writers.
+func (v *View) Iterate(fn func(key, value string) bool) error {
+	if v.closed.Load() {
+		return ErrViewClosed
+	}
+
+	// Keys present now, plus keys with history, cover every key present at the
+	// view's revision: a key deleted since then keeps its history while pinned.
+	s := v.store
+	seen := make(map[string]struct{})
+	if err := s.backend.Iterate(func(key, _ string) bool {
+		if !isInternalKey(key) {
+			seen[key] = struct{}{}
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	for _, key := range s.versions.changedKeys() {
+		if !isInternalKey(key) {
+			seen[key] = struct{}{}
+		}
+	}
+
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, exists, err := v.Get(key)
+		if err != nil {
+			return err
+		}
+		if exists && !fn(key, value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Close releases the view's revision so its versions can be garbage-collected.
+func (v *View) Close() error {
+	if v.closed.Swap(true) {
+		return nil
+	}
+	v.store.versions.unpin(v.rev)
+	return nil
+}
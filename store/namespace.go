@@ -0,0 +1,224 @@
+// Package store implements namespaces: isolated key spaces that live beside the main
+// one. Each namespace is a Store of its own, with its own directory holding its data
+// file (or engine files), write-ahead log, backups and snapshots, so keys in different
+// namespaces never collide and a namespace can be dropped by removing its directory.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// namespaceDataFile is the name of a namespace's data file inside its directory.
+const namespaceDataFile = "store.json"
+
+// StoreStats summarises the contents of a store or namespace.
+type StoreStats struct {
+	Keys       int             `json:"keys"`            // Number of keys
+	Bytes      int64           `json:"bytes"`           // Total size of keys and values
+	Expiring   int             `json:"expiring"`        // Keys with a TTL
+	Revision   uint64          `json:"revision"`        // Revision of the latest committed write
+	Durability DurabilityStats `json:"durability"`      // How far the data on disk lags behind memory
+	Cache      *CacheStats     `json:"cache,omitempty"` // Read cache statistics, if a cache is configured
+}
+
+// namespaceSet tracks the namespaces of a store and the ones opened so far.
+type namespaceSet struct {
+	mu   sync.Mutex
+	dir  string            // Directory holding one subdirectory per namespace
+	opts options           // Options namespaces are opened with
+	open map[string]*Store // Namespaces opened so far
+}
+
+// newNamespaceSet returns the namespaces kept under dir, opened with o.
+func newNamespaceSet(dir string, o options) *namespaceSet {
+	// A namespace never shares its parent's backend or snapshot directory.
+	o.backend = nil
+	o.snapshotDir = ""
+	return &namespaceSet{dir: dir, opts: o, open: make(map[string]*Store)}
+}
+
+// ValidateNamespaceName ensures a namespace name can be used safely as a directory name.
+func ValidateNamespaceName(name string) error {
+	if name == "" {
+		return errors.New("namespace name cannot be empty")
+	}
+	if !namePattern.MatchString(name) {
+		return errors.New("namespace name may only contain letters, digits, '.', '_' and '-'")
+	}
+	return nil
+}
+
+// CreateNamespace creates an empty namespace and returns it.
+func (s *Store) CreateNamespace(name string) (*Store, error) {
+	if err := ValidateNamespaceName(name); err != nil {
+		return nil, err
+	}
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+
+	ns := s.namespaces
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if _, err := os.Stat(ns.path(name)); err == nil {
+		return nil, errors.New("namespace already exists")
+	}
+	if err := os.MkdirAll(ns.path(name), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create namespace: %w", err)
+	}
+	if err := syncDir(ns.dir); err != nil {
+		return nil, err
+	}
+	return ns.openLocked(name)
+}
+
+// Namespace returns an existing namespace. Operations on the returned Store only see
+// that namespace's keys.
+func (s *Store) Namespace(name string) (*Store, error) {
+	if err := ValidateNamespaceName(name); err != nil {
+		return nil, err
+	}
+
+	ns := s.namespaces
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if child, ok := ns.open[name]; ok {
+		return child, nil
+	}
+	if info, err := os.Stat(ns.path(name)); err != nil || !info.IsDir() {
+		return nil, errors.New("namespace not found")
+	}
+	return ns.openLocked(name)
+}
+
+// Namespaces returns the names of every namespace, in sorted order.
+func (s *Store) Namespaces() ([]string, error) {
+	entries, err := os.ReadDir(s.namespaces.dir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %w", err)
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && ValidateNamespaceName(entry.Name()) == nil {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// DropNamespace deletes a namespace and everything stored in it.
+// Stores previously returned for the namespace must no longer be used.
+func (s *Store) DropNamespace(name string) error {
+	if err := ValidateNamespaceName(name); err != nil {
+		return err
+	}
+	if err := s.writable(); err != nil {
+		return err
+	}
+
+	ns := s.namespaces
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if info, err := os.Stat(ns.path(name)); err != nil || !info.IsDir() {
+		return errors.New("namespace not found")
+	}
+	if child, ok := ns.open[name]; ok {
+		child.durability.halt()
+		if err := child.backend.Close(); err != nil {
+			return fmt.Errorf("failed to close namespace: %w", err)
+		}
+		delete(ns.open, name)
+	}
+
+	if err := os.RemoveAll(ns.path(name)); err != nil {
+		return fmt.Errorf("failed to drop namespace: %w", err)
+	}
+	return syncDir(ns.dir)
+}
+
+// Stats returns a summary of the store's contents. Namespaces are not included.
+func (s *Store) Stats() (StoreStats, error) {
+	stats := StoreStats{Revision: s.Revision()}
+	if err := s.backend.Iterate(func(key, value string) bool {
+		if !isInternalKey(key) {
+			stats.Keys++
+			stats.Bytes += int64(len(key) + len(value))
+		}
+		return true
+	}); err != nil {
+		return StoreStats{}, fmt.Errorf("failed to collect stats: %w", err)
+	}
+
+	stats.Expiring = s.expiries.len()
+	stats.Durability = s.durability.stats()
+	if cache, ok := s.CacheStats(); ok {
+		stats.Cache = &cache
+	}
+	return stats, nil
+}
+
+// path returns the directory of the named namespace.
+func (ns *namespaceSet) path(name string) string {
+	return filepath.Join(ns.dir, name)
+}
+
+// openLocked opens and loads the named namespace. The caller must hold ns.mu.
+func (ns *namespaceSet) openLocked(name string) (*Store, error) {
+	o := ns.opts
+	if o.openBackend != nil {
+		b, err := o.openBackend(ns.path(name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open namespace: %w", err)
+		}
+		o.backend = b
+	}
+
+	child := newStore(filepath.Join(ns.path(name), namespaceDataFile), o)
+	if err := child.Load(); err != nil {
+		child.backend.Close()
+		return nil, fmt.Errorf("failed to load namespace: %w", err)
+	}
+	ns.open[name] = child
+	return child, nil
+}
+
+// save persists every namespace opened so far.
+func (ns *namespaceSet) save() error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	for name, child := range ns.open {
+		if err := child.Save(); err != nil {
+			return fmt.Errorf("failed to save namespace %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// close closes every namespace opened so far, saving each a final time.
+func (ns *namespaceSet) close() error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	var first error
+	for name, child := range ns.open {
+		if err := child.Close(); err != nil && first == nil {
+			first = fmt.Errorf("failed to close namespace %q: %w", name, err)
+		}
+		delete(ns.open, name)
+	}
+	return first
+}
@@ -0,0 +1,197 @@
+// Package store provides functional options for configuring a Store at construction time.
+package store
+
+// DefaultCheckpointEvery is the number of logged writes after which the write-ahead log
+// is folded into a fresh snapshot.
+const DefaultCheckpointEvery = 1000
+
+// DefaultBackups is the number of previous snapshot generations kept next to the data file.
+const DefaultBackups = 3
+
+// options holds the settings collected from a list of Option values.
+type options struct {
+	backend         Backend                           // Storage engine; nil selects a FileBackend
+	wal             bool                              // Whether the file backend keeps a write-ahead log
+	checkpointEvery int                               // Logged writes between automatic checkpoints
+	backups         int                               // Snapshot generations kept by the file backend
+	shards          int                               // Lock stripes in the store and shards in the built-in backends
+	snapshotDir     string                            // Directory holding named snapshots; empty selects one next to the data file
+	retainRevisions int                               // Revisions whose superseded versions are kept for views
+	historyLimit    int                               // Revisions of each key kept in its history; 0 disables it
+	codec           Codec                             // Compression of the data file and snapshots; nil writes plain JSON
+	keys            *Keyring                          // Encryption keys for the data file, log and snapshots; nil disables encryption
+	durability      DurabilityOptions                 // When the store saves itself
+	readOnly        bool                              // Whether writes are refused and files are only read
+	format          SnapshotFormat                    // Encoding of the data file, its backups and named snapshots
+	load            LoadOptions                       // How the file backend reads the data file
+	cache           *CacheOptions                     // Read cache in front of the backend; nil disables it
+	openBackend     func(dir string) (Backend, error) // Opens each namespace's backend; nil selects a FileBackend
+}
+
+// Option configures a Store created by NewStore, or a FileBackend created by NewFileBackend.
+type Option func(*options)
+
+// buildOptions applies opts over the defaults.
+func buildOptions(opts []Option) options {
+	o := options{
+		wal:             true,
+		checkpointEvery: DefaultCheckpointEvery,
+		backups:         DefaultBackups,
+		shards:          DefaultShards,
+		historyLimit:    DefaultHistoryLimit,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithBackend makes the store keep its data in b instead of the default FileBackend.
+// The file-related options below have no effect on a custom backend.
+func WithBackend(b Backend) Option {
+	return func(o *options) {
+		o.backend = b
+	}
+}
+
+// WithCheckpointEvery sets how many writes may accumulate in the write-ahead log before
+// the store checkpoints it into the snapshot file. A value of zero or less disables
+// automatic checkpoints; the log is then only folded in by an explicit Save.
+func WithCheckpointEvery(n int) Option {
+	return func(o *options) {
+		o.checkpointEvery = n
+	}
+}
+
+// WithoutWAL disables the write-ahead log. Writes are then only persisted by Save,
+// which matches the store's original behaviour.
+func WithoutWAL() Option {
+	return func(o *options) {
+		o.wal = false
+	}
+}
+
+// WithBackups sets how many previous snapshots Save keeps as <file>.1 (newest) through
+// <file>.n (oldest). Load falls back to these when the primary file cannot be read.
+// A value of zero disables backups.
+func WithBackups(n int) Option {
+	return func(o *options) {
+		o.backups = n
+	}
+}
+
+// WithShards sets how many independently locked segments the key space is split into,
+// both for the store's per-key locks and for the data of the default file backend.
+// More shards let more writers to different keys proceed in parallel.
+func WithShards(n int) Option {
+	return func(o *options) {
+		o.shards = n
+	}
+}
+
+// WithSnapshotDir sets the directory that Snapshot writes named snapshots to. By default
+// they are kept in a "snapshots" directory next to the data file.
+func WithSnapshotDir(dir string) Option {
+	return func(o *options) {
+		o.snapshotDir = dir
+	}
+}
+
+// WithRevisionRetention sets the GC horizon for old versions: values replaced within the
+// last n revisions stay readable through ViewAt even if no view was open when they were
+// replaced. Versions an open View still needs are kept regardless. The default of zero
+// keeps only those.
+func WithRevisionRetention(n int) Option {
+	return func(o *options) {
+		o.retainRevisions = n
+	}
+}
+
+// WithCache puts a memory-bounded read cache in front of the store's backend, so only
+// hot values are held in memory. It is meant for backends that keep their values on
+// disk, such as Bitcask or the LSM engine; the default file backend already holds
+// everything in memory.
+func WithCache(opts CacheOptions) Option {
+	return func(o *options) {
+		o.cache = &opts
+	}
+}
+
+// WithNamespaceBackend sets how namespaces store their data: open is called with a
+// namespace's directory and returns the backend to keep it in, e.g. a Bitcask opened
+// there. By default each namespace uses a FileBackend configured like the store's own.
+func WithNamespaceBackend(open func(dir string) (Backend, error)) Option {
+	return func(o *options) {
+		o.openBackend = open
+	}
+}
+
+// WithHistory sets how many revisions of each key are kept in its history, for History
+// and Revert. History is disabled by default, since each entry holds a full copy of a
+// value; zero disables it again.
+func WithHistory(n int) Option {
+	return func(o *options) {
+		o.historyLimit = n
+	}
+}
+
+// WithCompression compresses the data file, its backups and named snapshots with c,
+// e.g. Gzip. Files are recognised by their magic header when read, so switching
+// compression on or off keeps existing files readable. The write-ahead log is never
+// compressed.
+func WithCompression(c Codec) Option {
+	return func(o *options) {
+		o.codec = c
+	}
+}
+
+// WithEncryption encrypts the data file, its backups, the write-ahead log and named
+// snapshots with AES-GCM under the keyring's active key. Files record the ID of the key
+// they were written with, so keys retired by rotation stay usable for reading.
+// Only the file backend can encrypt its files: combined with WithBackend or
+// WithNamespaceBackend holding a Bitcask, an LSM or any other backend that writes to
+// disk unencrypted, Load and every write fail with ErrEncryptionUnsupported.
+func WithEncryption(keys *Keyring) Option {
+	return func(o *options) {
+		o.keys = keys
+	}
+}
+
+// WithDurability sets when the store saves itself; see DurabilityMode. The default,
+// DurabilityManual, leaves it to Save and Close.
+func WithDurability(opts DurabilityOptions) Option {
+	return func(o *options) {
+		o.durability = opts
+	}
+}
+
+// WithReadOnly opens the store for reading only: writes fail with ErrReadOnly and
+// nothing is written to its files, not even to discard a torn write-ahead log tail.
+// With Open, the data file is locked shared, so several readers can have it open at
+// once.
+func WithReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+// WithSnapshotFormat sets how the data file, its backups and named snapshots are
+// encoded. FormatBinary loads and saves large stores much faster than the default
+// FormatJSON. Files are recognised by their header when read, so switching formats
+// keeps existing files readable; the data file is rewritten in the new format by the
+// next Save.
+func WithSnapshotFormat(f SnapshotFormat) Option {
+	return func(o *options) {
+		o.format = f
+	}
+}
+
+// WithLoadOptions sets how Load reads the data file: with progress reports, skipping
+// damaged entries, or lazily, with only the keys read at startup and each value read
+// from the file the first time it is needed. Lazy loading keeps the file open and
+// has no effect on compressed or encrypted files, whose values are always loaded.
+func WithLoadOptions(opts LoadOptions) Option {
+	return func(o *options) {
+		o.load = opts
+	}
+}
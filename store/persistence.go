@@ -2,189 +2,443 @@
 package store
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
+	"log"
 	"path/filepath"
-	"sync"
+	"time"
 )
 
 // DefaultFilePath specifies the default location of the persistent data file.
 const DefaultFilePath = "./data/store.json"
 
-// Store represents an in-memory key-value store with persistence capabilities.
+// Store represents a key-value store with persistence capabilities.
+// It validates keys and values and serialises access to each key; the data itself
+// lives in a Backend.
 type Store struct {
-	data     map[string]string // In-memory data store
-	filePath string            // Path to the JSON file for persistence
-	mu       sync.RWMutex      // Mutex to ensure thread-safe access
+	backend     Backend        // Storage engine holding the data
+	locks       *stripedLock   // Per-key lock stripes to ensure thread-safe access
+	snapshotDir string         // Directory holding named snapshots
+	versions    *versionLog    // Revisions of committed writes and the versions they replaced
+	expiries    *expiryTable   // Deadlines of keys with a TTL
+	namespaces  *namespaceSet  // Isolated key spaces stored beside this one
+	history     *historyIndex  // Revisions of each key kept in its history
+	indexes     *indexSet      // Secondary indexes on JSON paths
+	author      string         // Who writes through this handle are attributed to; see As
+	codec       Codec          // Compression applied to named snapshots; nil writes plain JSON
+	keys        *Keyring       // Encryption keys for named snapshots; nil disables encryption
+	durability  *durability    // When the store saves itself, and how far disk lags behind
+	readOnly    bool           // Whether writes are refused; see WithReadOnly
+	lock        *fileLock      // Lock on the data file taken by Open; nil if not locked
+	format      SnapshotFormat // Encoding of named snapshots
+	misconfig   error          // Why the store may be neither loaded nor written; see checkEncryption
+	path        string         // Data file the store was created on
 }
 
 // NewStore initializes a new Store instance with the given file path.
 // If no file path is provided, it defaults to `DefaultFilePath`.
-func NewStore(filePath string) *Store {
+// Unless WithBackend is given, data is kept in a FileBackend at that path.
+// NewStore does not lock the data file; use Open when other processes may use it.
+func NewStore(filePath string, opts ...Option) *Store {
 	if filePath == "" {
 		filePath = DefaultFilePath
 	}
-	return &Store{
-		data:     make(map[string]string),
-		filePath: filePath,
-	}
+	return newStore(filePath, buildOptions(opts))
 }
 
-// Load loads the data from the JSON file into the store.
-func (s *Store) Load() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// newStore returns a store configured from already-applied options.
+func newStore(filePath string, o options) *Store {
+	backend := o.backend
+	if backend == nil {
+		backend = newFileBackend(filePath, o)
+	}
+	if o.cache != nil {
+		backend = NewCachedBackend(backend, *o.cache)
+	}
 
-	// Ensure the file exists; if not, start with an empty store.
-	if _, err := os.Stat(s.filePath); os.IsNotExist(err) {
-		return nil
+	snapshotDir := o.snapshotDir
+	if snapshotDir == "" {
+		snapshotDir = filepath.Join(filepath.Dir(filePath), "snapshots")
 	}
 
-	// Read the file contents.
-	content, err := os.ReadFile(s.filePath)
-	if err != nil {
-		return fmt.Errorf("failed to read file: %w", err)
+	s := &Store{
+		backend:     backend,
+		locks:       newStripedLock(o.shards),
+		snapshotDir: snapshotDir,
+		versions:    newVersionLog(o.retainRevisions),
+		expiries:    newExpiryTable(),
+		namespaces:  newNamespaceSet(filepath.Join(filepath.Dir(filePath), "namespaces"), o),
+		history:     newHistoryIndex(o.historyLimit),
+		indexes:     newIndexSet(),
+		codec:       o.codec,
+		keys:        o.keys,
+		durability:  newDurability(o.durability),
+		readOnly:    o.readOnly,
+		format:      o.format,
+		misconfig:   checkEncryption(backend, o.keys),
+		path:        filePath,
 	}
 
-	// Parse the JSON content into the store's data map.
-	if err := json.Unmarshal(content, &s.data); err != nil {
-		return fmt.Errorf("failed to parse JSON: %w", err)
+	// Backends that are live on open already hold any persisted revision, deadlines and history.
+	if rev, err := s.loadRevisionLocked(); err != nil {
+		log.Printf("store: %v", err)
+	} else if rev > 0 {
+		s.versions.reset(rev)
+	}
+	if err := s.loadExpiriesLocked(); err != nil {
+		log.Printf("store: %v", err)
+	}
+	if err := s.loadHistoryLocked(); err != nil {
+		log.Printf("store: %v", err)
+	}
+	if err := s.loadIndexesLocked(); err != nil {
+		log.Printf("store: %v", err)
 	}
 
-	return nil
+	s.durability.start(s.autosave)
+	return s
 }
 
-// Save saves the current in-memory data to the JSON file.
-func (s *Store) Save() error {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// Path returns the data file the store was created on. Maintenance such as Fsck and
+// Migrate should be pointed at it rather than at DefaultFilePath.
+func (s *Store) Path() string {
+	return s.path
+}
 
-	// Marshal the in-memory data into JSON format.
-	content, err := json.MarshalIndent(s.data, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal data: %w", err)
+// fileOptions returns the options the store's files are read and written with, for
+// the functions that work on files rather than on a store.
+func (s *Store) fileOptions() []Option {
+	var opts []Option
+	if s.keys != nil {
+		opts = append(opts, WithEncryption(s.keys))
 	}
+	if s.codec != nil {
+		opts = append(opts, WithCompression(s.codec))
+	}
+	return opts
+}
 
-	// Ensure the directory for the file exists.
-	err = os.MkdirAll(filepath.Dir(s.filePath), 0755)
-	if err != nil {
-		return fmt.Errorf("failed to create directories: %w", err)
+// Backend returns the storage engine behind the store.
+func (s *Store) Backend() Backend {
+	return s.backend
+}
+
+// CacheStats returns the read cache's hit/miss statistics, if the store was created
+// with WithCache.
+func (s *Store) CacheStats() (CacheStats, bool) {
+	c, ok := s.backend.(*CachedBackend)
+	if !ok {
+		return CacheStats{}, false
 	}
+	return c.Stats(), true
+}
 
-	// Write the JSON data to the file.
-	err = os.WriteFile(s.filePath, content, 0644)
+// Load loads persisted data into the store, if the backend keeps its data in memory.
+func (s *Store) Load() error {
+	if s.misconfig != nil {
+		return s.misconfig
+	}
+	s.locks.lockAll()
+	defer s.locks.unlockAll()
+	return s.loadLocked()
+}
+
+// loadLocked does the work of Load. The caller must hold every stripe's write lock.
+func (s *Store) loadLocked() error {
+	p, ok := s.backend.(Persister)
+	if !ok {
+		return nil
+	}
+	if err := p.Load(); err != nil {
+		return err
+	}
+
+	// The data was replaced wholesale, so earlier revisions can no longer be read.
+	rev, err := s.loadRevisionLocked()
 	if err != nil {
-		return fmt.Errorf("failed to write file: %w", err)
+		return err
+	}
+	s.versions.reset(rev)
+	if err := s.loadExpiriesLocked(); err != nil {
+		return err
 	}
+	if err := s.loadHistoryLocked(); err != nil {
+		return err
+	}
+	return s.loadIndexesLocked()
+}
 
-	return nil
+// Save persists the current data, if the backend keeps its data in memory.
+// The backend takes a consistent snapshot itself, so writers are only held up
+// for as long as it needs.
+func (s *Store) Save() error {
+	if err := s.writable(); err != nil {
+		return err
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+	return s.namespaces.save()
 }
 
 // Create adds a new key-value pair to the store.
 func (s *Store) Create(key, value string) error {
-    s.mu.Lock()
-    defer s.mu.Unlock()
-
-    if key == "" {
-        return errors.New("key cannot be empty")
-    }
-
-    if _, exists := s.data[key]; exists {
-        return errors.New("key already exists")
-    }
-
-    if !isValidJSON(value) {
-        return errors.New("invalid JSON format")
-    }
-
-    s.data[key] = value
-    return nil
+	_, err := s.CreateIfAbsent(key, value)
+	return err
 }
 
 // Read retrieves the value for a given key.
+// An expired key is deleted and reported as not found.
 func (s *Store) Read(key string) (string, error) {
-    s.mu.RLock()
-    defer s.mu.RUnlock()
+	s.reapIfExpired(key)
 
-    if key == "" {
-        return "", errors.New("key cannot be empty")
-    }
+	lock := s.locks.forKey(key)
+	lock.RLock()
+	defer lock.RUnlock()
 
-    value, exists := s.data[key]
-    if !exists {
-        return "", errors.New("key not found")
-    }
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
 
-    return value, nil
+	value, exists, err := s.backend.Get(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to read key: %w", err)
+	}
+	if !exists || s.expiries.expired(key, time.Now()) {
+		return "", ErrKeyNotFound
+	}
+
+	return value, nil
 }
 
 // Get retrieves the value for a given key.
+// A backend error, an expired key or a reserved key is reported as the key not being found.
 func (s *Store) Get(key string) (string, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	if isInternalKey(key) {
+		return "", false
+	}
+	s.reapIfExpired(key)
 
-	value, exists := s.data[key]
-	return value, exists
-}
+	lock := s.locks.forKey(key)
+	lock.RLock()
+	defer lock.RUnlock()
 
-// Update modifies the value for a given key.
-func (s *Store) Update(key, value string) error {
-    s.mu.Lock()
-    defer s.mu.Unlock()
+	value, exists, err := s.backend.Get(key)
+	return value, exists && err == nil && !s.expiries.expired(key, time.Now())
+}
 
-    if key == "" {
-        return errors.New("key cannot be empty")
-    }
+// Range calls fn, in key order, for every key k with start <= k < end until fn returns
+// false. An empty end means no upper bound. Backends that keep keys sorted serve this
+// directly; for others every key is visited and the matches are sorted.
+func (s *Store) Range(start, end string, fn func(key, value string) bool) error {
+	s.locks.rLockAll()
+	defer s.locks.rUnlockAll()
+
+	// Metadata keys and expired keys are not part of the data.
+	now := time.Now()
+	visible := func(key string) bool {
+		return !isInternalKey(key) && !s.expiries.expired(key, now)
+	}
 
-    if _, exists := s.data[key]; !exists {
-        return errors.New("key not found")
-    }
+	if r, ok := s.backend.(RangeIterator); ok {
+		return r.Range(start, end, func(key, value string) bool {
+			return !visible(key) || fn(key, value)
+		})
+	}
 
-    if !isValidJSON(value) {
-        return errors.New("invalid JSON format")
-    }
+	return rangeBySorting(s.backend, start, end, func(key, value string) bool {
+		return !visible(key) || fn(key, value)
+	})
+}
 
-    s.data[key] = value
-    return nil
+// Update modifies the value for a given key. The key keeps its TTL, if it has one.
+func (s *Store) Update(key, value string) error {
+	_, err := s.CompareAndSwap(key, AnyVersion, value)
+	return err
 }
 
-// Set sets a key-value pair in the store.
-func (s *Store) Set(key, value string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// Set sets a key-value pair in the store, removing any TTL the key had.
+// It returns an error only if the key is empty or reserved, or the backend could not
+// store the value.
+func (s *Store) Set(key, value string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	lock := s.locks.forKey(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := s.expireLocked(key); err != nil {
+		return err
+	}
+
+	old, exists, err := s.backend.Get(key)
+	if err != nil {
+		return fmt.Errorf("failed to read key: %w", err)
+	}
 
-	s.data[key] = value
+	if err := s.clearDeadlineLocked(key); err != nil {
+		return err
+	}
+	_, err = s.put(key, value, old, exists, time.Time{})
+	return err
 }
 
 // Delete removes a key-value pair from the store.
 func (s *Store) Delete(key string) error {
-    s.mu.Lock()
-    defer s.mu.Unlock()
+	return s.DeleteIfVersion(key, AnyVersion)
+}
+
+// Clear removes all key-value pairs from the store.
+// It returns an error only if the backend could not remove them.
+func (s *Store) Clear() error {
+	if err := s.writable(); err != nil {
+		return err
+	}
+
+	s.locks.lockAll()
+	defer s.locks.unlockAll()
 
-    if key == "" {
-        return errors.New("key cannot be empty")
-    }
+	old, err := s.clearLocked()
+	if err != nil {
+		return err
+	}
+
+	// The revision counter and index declarations went with everything else, so
+	// they are written back.
+	rev := s.versions.next()
+	if err := writeBatchAt(s.backend, rev, s.indexMetadataLocked()); err != nil {
+		return fmt.Errorf("failed to store revision: %w", err)
+	}
+	s.versions.recordAll(old, nil, rev)
+	s.expiries.replace(make(map[string]time.Time))
+	s.history.replace(make(map[string][]uint64))
+	s.indexes.reset()
+	s.noteWrites(1)
+	return nil
+}
+
+// ErrKeyNotFound is returned when an operation needs a key that does not exist.
+var ErrKeyNotFound = errors.New("key not found")
 
-    if _, exists := s.data[key]; !exists {
-        return errors.New("key not found")
-    }
+// ErrKeyExists is returned when creating a key that already exists.
+var ErrKeyExists = errors.New("key already exists")
 
-    delete(s.data, key)
-    return nil
+// errReservedKey is returned for keys in the range reserved for the store's metadata.
+var errReservedKey = errors.New("key is reserved for internal use")
+
+// checkKey rejects keys that cannot hold user data.
+func checkKey(key string) error {
+	if key == "" {
+		return errors.New("key cannot be empty")
+	}
+	if isInternalKey(key) {
+		return errReservedKey
+	}
+	return nil
 }
 
-// Clear removes all key-value pairs from the store.
-func (s *Store) Clear() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// put stores value under key and commits the change as a new revision, which becomes
+// the key's version and is returned. The write is added to the key's history. A
+// non-zero deadline replaces the key's deadline in the same batch.
+// The caller must hold the key's write lock and pass the state the key had before.
+func (s *Store) put(key, value, old string, existed bool, deadline time.Time) (uint64, error) {
+	if err := s.writable(); err != nil {
+		return 0, err
+	}
 
-	s.data = make(map[string]string)
+	rev := s.versions.next()
+	history, err := s.historyOps(key, rev, value, false, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	// The version goes first, so a crash part way through a backend without atomic
+	// batches can only leave a newer version on the old value, never the reverse.
+	// Everything in the batch is in the key's own shard.
+	ops := append([]BatchOp{
+		{Key: versionKey(key), Value: formatRevision(rev)},
+		{Key: key, Value: value},
+	}, history...)
+	if !deadline.IsZero() {
+		ops = append(ops, BatchOp{Key: ttlKey(key), Value: formatDeadline(deadline)})
+	}
+	if err := writeBatchAt(s.backend, rev, ops); err != nil {
+		return 0, err
+	}
+	if !deadline.IsZero() {
+		s.expiries.set(key, deadline)
+	}
+	s.versions.record(key, old, existed, rev)
+	s.recordHistory(key, rev)
+	s.indexes.update(key, value, false)
+	s.noteWrites(1)
+	return rev, nil
+}
+
+// remove deletes key and its version and commits the change as a new revision.
+// The key's history keeps the deletion, so the key can be reverted.
+// The caller must hold the key's write lock and pass the value the key had before.
+func (s *Store) remove(key, old string) error {
+	if err := s.writable(); err != nil {
+		return err
+	}
+
+	rev := s.versions.next()
+	history, err := s.historyOps(key, rev, "", true, time.Now())
+	if err != nil {
+		return err
+	}
+
+	ops := append([]BatchOp{
+		{Key: key, Delete: true},
+		{Key: versionKey(key), Delete: true},
+	}, history...)
+	if err := writeBatchAt(s.backend, rev, ops); err != nil {
+		return err
+	}
+	s.versions.record(key, old, true, rev)
+	s.recordHistory(key, rev)
+	s.indexes.update(key, "", true)
+	s.noteWrites(1)
+	return nil
+}
+
+// copyLocked returns a copy of every key-value pair.
+// The caller must hold every stripe's lock so the copy is consistent.
+func (s *Store) copyLocked() (map[string]string, error) {
+	data := make(map[string]string)
+	if err := s.backend.Iterate(func(key, value string) bool {
+		data[key] = value
+		return true
+	}); err != nil {
+		return nil, fmt.Errorf("failed to copy data: %w", err)
+	}
+	return data, nil
+}
+
+// clearLocked removes every key from the backend and returns the removed pairs.
+// The caller must hold every stripe's write lock and record the change.
+func (s *Store) clearLocked() (map[string]string, error) {
+	old, err := s.copyLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	if c, ok := s.backend.(Clearer); ok {
+		return old, c.Clear()
+	}
+	for key := range old {
+		if err := s.backend.Delete(key); err != nil {
+			return nil, err
+		}
+	}
+	return old, nil
 }
 
 // // isValidJSON checks if a given string is a valid JSON object.
 // func isValidJSON(data string) bool {
 //     var js map[string]interface{}
 //     return json.Unmarshal([]byte(data), &js) == nil
-// }
\ No newline at end of file
+// }
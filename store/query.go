@@ -0,0 +1,654 @@
+// Package store implements a MongoDB-style query language over stored documents. A
+// filter names fields, with dots for nested ones, and the values or conditions they
+// must meet, e.g. {"age": {"$gt": 30}, "name": {"$regex": "^A"}}; the matching
+// documents can be sorted, paged and cut down to the fields that are needed. When a
+// condition is on a field with a secondary index, only the keys it finds are read.
+package store
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query selects documents with a filter, and orders, pages and shapes the results.
+// A filter maps fields to a value they must equal, or to conditions on them:
+//
+//	$eq, $ne, $gt, $gte, $lt, $lte  compare with a value
+//	$in, $nin                       compare with each of a list of values
+//	$exists                         requires the field to be present, or absent if false
+//	$regex, $options                match strings against a regular expression; $options may hold "i", "m" and "s"
+//
+// Conditions of a filter must all be met; "$and", "$or" and "$nor" combine lists of
+// filters. A condition on a field holding an array is met if it is met by the array
+// or by any of its elements.
+type Query struct {
+	Filter     map[string]any `json:"filter,omitempty"`     // Conditions documents must meet; empty matches every document
+	Sort       []string       `json:"sort,omitempty"`       // Fields to order by, each prefixed with '-' for descending; key order if empty
+	Skip       int            `json:"skip,omitempty"`       // Matching documents to leave out from the start
+	Limit      int            `json:"limit,omitempty"`      // Most documents to return; zero returns them all
+	Projection Projection     `json:"projection,omitempty"` // Fields to include or exclude; whole documents if empty
+}
+
+// Projection selects the fields of returned documents: either fields to include,
+// mapped to true, or fields to leave out, mapped to false. In JSON, 1 and 0 are
+// accepted as well, as in MongoDB.
+type Projection map[string]bool
+
+// UnmarshalJSON decodes a projection, accepting 1 and 0 for true and false.
+func (p *Projection) UnmarshalJSON(data []byte) error {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	out := make(Projection, len(raw))
+	for field, v := range raw {
+		switch v := v.(type) {
+		case bool:
+			out[field] = v
+		case float64:
+			out[field] = v != 0
+		default:
+			return fmt.Errorf("projection of %q must be true, false, 1 or 0", field)
+		}
+	}
+	*p = out
+	return nil
+}
+
+// Document is a document returned by Find.
+type Document struct {
+	Key   string          `json:"key"`   // Key the document is stored under
+	Value json.RawMessage `json:"value"` // The document, cut down by the projection
+}
+
+// matcher reports whether a decoded document meets a filter.
+type matcher func(doc any) bool
+
+// Find returns the documents matching q.Filter, ordered by q.Sort and then by key,
+// paged with q.Skip and q.Limit and cut down by q.Projection. Values that are not
+// JSON documents never match.
+func (s *Store) Find(q Query) ([]Document, error) {
+	match, err := compileFilter(q.Filter)
+	if err != nil {
+		return nil, err
+	}
+	order, err := parseSortFields(q.Sort)
+	if err != nil {
+		return nil, err
+	}
+	project, err := compileProjection(q.Projection)
+	if err != nil {
+		return nil, err
+	}
+	if q.Skip < 0 || q.Limit < 0 {
+		return nil, errors.New("skip and limit cannot be negative")
+	}
+
+	type found struct {
+		key string
+		doc any
+	}
+	var docs []found
+	collect := func(key, value string) bool {
+		var doc any
+		if json.Unmarshal([]byte(value), &doc) == nil && match(doc) {
+			docs = append(docs, found{key: key, doc: doc})
+		}
+		return true
+	}
+
+	s.locks.rLockAll()
+	keys, planned := s.planQuery(q.Filter)
+	if planned {
+		now := time.Now()
+		for _, key := range keys {
+			if s.expiries.expired(key, now) {
+				continue
+			}
+			var value string
+			var exists bool
+			if value, exists, err = s.backend.Get(key); err != nil {
+				err = fmt.Errorf("failed to read key: %w", err)
+				break
+			}
+			if exists {
+				collect(key, value)
+			}
+		}
+	}
+	s.locks.rUnlockAll()
+	if err != nil {
+		return nil, err
+	}
+	if !planned {
+		if err := s.Range("", "", collect); err != nil {
+			return nil, fmt.Errorf("failed to scan documents: %w", err)
+		}
+	}
+
+	slices.SortFunc(docs, func(a, b found) int {
+		for _, f := range order {
+			av, aok := lookupField(a.doc, f.field)
+			bv, bok := lookupField(b.doc, f.field)
+			if c := compareSortValues(av, aok, bv, bok); c != 0 {
+				if f.descending {
+					return -c
+				}
+				return c
+			}
+		}
+		return strings.Compare(a.key, b.key)
+	})
+
+	docs = docs[min(q.Skip, len(docs)):]
+	if q.Limit > 0 && len(docs) > q.Limit {
+		docs = docs[:q.Limit]
+	}
+
+	results := make([]Document, 0, len(docs))
+	for _, d := range docs {
+		value, err := json.Marshal(project(d.doc))
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %q: %w", d.key, err)
+		}
+		results = append(results, Document{Key: d.key, Value: value})
+	}
+	return results, nil
+}
+
+// planQuery returns the keys that can match filter according to a secondary index
+// on one of its fields, or false if no index helps and every key must be scanned.
+// The caller must hold every stripe's lock, so the index agrees with the data.
+func (s *Store) planQuery(filter map[string]any) ([]string, bool) {
+	fields := make([]string, 0, len(filter))
+	for field := range filter {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+
+	for _, field := range fields {
+		path, ok := indexPathFor(field)
+		if !ok {
+			continue
+		}
+		if _, indexed := s.indexes.get(path); !indexed {
+			continue
+		}
+		r, ok := indexRangeFor(filter[field])
+		if !ok {
+			continue
+		}
+		// Bounds of different types match nothing, which a scan will find out.
+		if keys, err := s.indexes.candidates(path, r); err == nil {
+			return keys, true
+		}
+	}
+	return nil, false
+}
+
+// indexPathFor returns the index path equivalent to a field, or false if the field
+// has numeric parts, which could be array positions or member names.
+func indexPathFor(field string) (string, bool) {
+	if strings.HasPrefix(field, "$") {
+		return "", false
+	}
+	parts, err := splitField(field)
+	if err != nil {
+		return "", false
+	}
+	p := make(jsonPath, len(parts))
+	for i, part := range parts {
+		if _, err := strconv.Atoi(part); err == nil {
+			return "", false
+		}
+		p[i] = pathStep{name: part, index: -1}
+	}
+	return p.String(), true
+}
+
+// indexRangeFor returns the index range holding every value that can meet cond, or
+// false if the condition is not an equality or range on a string, number or boolean.
+// Null is left to a scan, since it also matches documents without the field.
+func indexRangeFor(cond any) (IndexRange, bool) {
+	bound := func(v any) (string, bool) {
+		switch v.(type) {
+		case bool, float64, string:
+			raw, err := json.Marshal(v)
+			return string(raw), err == nil
+		}
+		return "", false
+	}
+
+	ops, isOps := cond.(map[string]any)
+	if !isOps || !isOperatorDocument(ops) {
+		v, ok := bound(cond)
+		return IndexRange{Min: v, Max: v}, ok
+	}
+
+	var r IndexRange
+	for op, operand := range ops {
+		v, ok := bound(operand)
+		if !ok {
+			return r, false
+		}
+		switch op {
+		case "$eq":
+			r.Min, r.Max = v, v
+		case "$gt":
+			r.Min, r.ExcludeMin = v, true
+		case "$gte":
+			r.Min = v
+		case "$lt":
+			r.Max, r.ExcludeMax = v, true
+		case "$lte":
+			r.Max = v
+		default:
+			return r, false
+		}
+	}
+	return r, true
+}
+
+// compileFilter turns a filter document into a matcher.
+func compileFilter(filter map[string]any) (matcher, error) {
+	var all []matcher
+	for field, cond := range filter {
+		var m matcher
+		var err error
+		switch field {
+		case "$and", "$or", "$nor":
+			m, err = compileLogical(field, cond)
+		default:
+			if strings.HasPrefix(field, "$") {
+				return nil, fmt.Errorf("unknown operator %s", field)
+			}
+			var parts []string
+			if parts, err = splitField(field); err == nil {
+				m, err = compileCondition(parts, cond)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, m)
+	}
+
+	return func(doc any) bool {
+		for _, m := range all {
+			if !m(doc) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// compileLogical compiles $and, $or or $nor over a list of filters.
+func compileLogical(op string, cond any) (matcher, error) {
+	list, ok := cond.([]any)
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("%s needs a non-empty list of filters", op)
+	}
+	subs := make([]matcher, len(list))
+	for i, item := range list {
+		filter, ok := item.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s needs a non-empty list of filters", op)
+		}
+		m, err := compileFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		subs[i] = m
+	}
+
+	// $and needs every filter to match, $or any of them and $nor none.
+	return func(doc any) bool {
+		for _, m := range subs {
+			if m(doc) != (op == "$and") {
+				return op == "$or"
+			}
+		}
+		return op != "$or"
+	}, nil
+}
+
+// isOperatorDocument reports whether a condition is a set of operators, such as
+// {"$gt": 30}, rather than a document the field must equal.
+func isOperatorDocument(cond map[string]any) bool {
+	for key := range cond {
+		if strings.HasPrefix(key, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+// compileCondition compiles the condition on one field.
+func compileCondition(field []string, cond any) (matcher, error) {
+	ops, isOps := cond.(map[string]any)
+	if !isOps || !isOperatorDocument(ops) {
+		ops = map[string]any{"$eq": cond}
+	}
+
+	var all []matcher
+	for op, operand := range ops {
+		if !strings.HasPrefix(op, "$") {
+			return nil, fmt.Errorf("cannot mix operators and fields in the condition on %q", strings.Join(field, "."))
+		}
+		m, err := compileOperator(field, op, operand, ops)
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			all = append(all, m)
+		}
+	}
+
+	return func(doc any) bool {
+		for _, m := range all {
+			if !m(doc) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// compileOperator compiles one operator of a field's condition. It returns a nil
+// matcher for $options, which only qualifies $regex.
+func compileOperator(field []string, op string, operand any, ops map[string]any) (matcher, error) {
+	// anyValue reports whether one of the field's values meets test.
+	anyValue := func(test func(v any) bool) matcher {
+		return func(doc any) bool {
+			return slices.ContainsFunc(fieldValues(doc, field), test)
+		}
+	}
+	switch op {
+	case "$eq":
+		return eqMatcher(field, operand), nil
+	case "$ne":
+		eq := eqMatcher(field, operand)
+		return func(doc any) bool { return !eq(doc) }, nil
+	case "$gt", "$gte", "$lt", "$lte":
+		bound, ok := toIndexValue(operand)
+		if !ok {
+			return nil, fmt.Errorf("%s needs a string, number, boolean or null", op)
+		}
+		return anyValue(func(v any) bool {
+			iv, ok := toIndexValue(v)
+			if !ok || iv.kind != bound.kind {
+				return false
+			}
+			c := compareIndexValues(iv, bound)
+			switch op {
+			case "$gt":
+				return c > 0
+			case "$gte":
+				return c >= 0
+			case "$lt":
+				return c < 0
+			default:
+				return c <= 0
+			}
+		}), nil
+	case "$in", "$nin":
+		list, ok := operand.([]any)
+		if !ok {
+			return nil, fmt.Errorf("%s needs a list of values", op)
+		}
+		eqs := make([]matcher, len(list))
+		for i, v := range list {
+			eqs[i] = eqMatcher(field, v)
+		}
+		return func(doc any) bool {
+			in := slices.ContainsFunc(eqs, func(eq matcher) bool { return eq(doc) })
+			return in == (op == "$in")
+		}, nil
+	case "$exists":
+		want, ok := operand.(bool)
+		if !ok {
+			return nil, errors.New("$exists needs true or false")
+		}
+		return func(doc any) bool {
+			return (len(fieldValues(doc, field)) > 0) == want
+		}, nil
+	case "$regex":
+		re, err := compileRegex(operand, ops["$options"])
+		if err != nil {
+			return nil, err
+		}
+		return anyValue(func(v any) bool {
+			str, ok := v.(string)
+			return ok && re.MatchString(str)
+		}), nil
+	case "$options":
+		if _, ok := ops["$regex"]; !ok {
+			return nil, errors.New("$options needs $regex")
+		}
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown operator %s", op)
+	}
+}
+
+// eqMatcher matches documents where the field equals v. A missing field equals null.
+func eqMatcher(field []string, v any) matcher {
+	return func(doc any) bool {
+		values := fieldValues(doc, field)
+		if v == nil && len(values) == 0 {
+			return true
+		}
+		return slices.ContainsFunc(values, func(x any) bool {
+			return reflect.DeepEqual(x, v)
+		})
+	}
+}
+
+// compileRegex compiles the pattern of a $regex with the flags of its $options.
+func compileRegex(pattern, options any) (*regexp.Regexp, error) {
+	expr, ok := pattern.(string)
+	if !ok {
+		return nil, errors.New("$regex needs a string")
+	}
+	if options != nil {
+		flags, ok := options.(string)
+		if !ok || strings.Trim(flags, "ims") != "" {
+			return nil, errors.New(`$options may only hold "i", "m" and "s"`)
+		}
+		if flags != "" {
+			expr = "(?" + flags + ")" + expr
+		}
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid $regex: %w", err)
+	}
+	return re, nil
+}
+
+// splitField splits a dotted field name into its parts.
+func splitField(field string) ([]string, error) {
+	parts := strings.Split(field, ".")
+	if slices.Contains(parts, "") {
+		return nil, fmt.Errorf("invalid field %q", field)
+	}
+	return parts, nil
+}
+
+// fieldValues returns the values a condition on a field is tested against: the value
+// at the field, and each element if it is an array. A part that names a member of
+// the elements of an array reaches into every element, and a numeric part can also
+// select an element by position. A missing field has no values.
+func fieldValues(doc any, field []string) []any {
+	if len(field) == 0 {
+		if list, ok := doc.([]any); ok {
+			return append([]any{doc}, list...)
+		}
+		return []any{doc}
+	}
+
+	switch node := doc.(type) {
+	case map[string]any:
+		if v, ok := node[field[0]]; ok {
+			return fieldValues(v, field[1:])
+		}
+	case []any:
+		var values []any
+		if i, err := strconv.Atoi(field[0]); err == nil && i >= 0 && i < len(node) {
+			values = fieldValues(node[i], field[1:])
+		}
+		for _, elem := range node {
+			if _, isMap := elem.(map[string]any); isMap {
+				values = append(values, fieldValues(elem, field)...)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// lookupField returns the value at a field, stepping into arrays only by position.
+func lookupField(doc any, field []string) (any, bool) {
+	for _, part := range field {
+		switch node := doc.(type) {
+		case map[string]any:
+			v, ok := node[part]
+			if !ok {
+				return nil, false
+			}
+			doc = v
+		case []any:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			doc = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// compareSortValues orders field values for sorting: missing fields first, then
+// scalars as an index orders them, then objects and arrays by their JSON encoding.
+func compareSortValues(a any, aok bool, b any, bok bool) int {
+	if !aok || !bok {
+		return cmp.Compare(boolRank(aok), boolRank(bok))
+	}
+	av, ascalar := toIndexValue(a)
+	bv, bscalar := toIndexValue(b)
+	switch {
+	case ascalar && bscalar:
+		return compareIndexValues(av, bv)
+	case ascalar != bscalar:
+		return cmp.Compare(boolRank(!ascalar), boolRank(!bscalar))
+	}
+	aj, _ := json.Marshal(a)
+	bj, _ := json.Marshal(b)
+	return strings.Compare(string(aj), string(bj))
+}
+
+// boolRank orders false before true.
+func boolRank(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// sortField is a field to order results by.
+type sortField struct {
+	field      []string
+	descending bool
+}
+
+// parseSortFields parses sort fields such as "age" and "-name".
+func parseSortFields(fields []string) ([]sortField, error) {
+	order := make([]sortField, len(fields))
+	for i, f := range fields {
+		name, descending := strings.CutPrefix(f, "-")
+		parts, err := splitField(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sort field %q", f)
+		}
+		order[i] = sortField{field: parts, descending: descending}
+	}
+	return order, nil
+}
+
+// compileProjection returns a function cutting a decoded document down to the
+// projection's fields.
+func compileProjection(p Projection) (func(doc any) any, error) {
+	if len(p) == 0 {
+		return func(doc any) any { return doc }, nil
+	}
+
+	var include *bool
+	fields := make([][]string, 0, len(p))
+	for field, keep := range p {
+		if include != nil && *include != keep {
+			return nil, errors.New("projection cannot mix included and excluded fields")
+		}
+		include = &keep
+		parts, err := splitField(field)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, parts)
+	}
+
+	if !*include {
+		return func(doc any) any {
+			for _, field := range fields {
+				removeField(doc, field)
+			}
+			return doc
+		}, nil
+	}
+	return func(doc any) any {
+		out := make(map[string]any)
+		for _, field := range fields {
+			if v, ok := lookupField(doc, field); ok {
+				setField(out, field, v)
+			}
+		}
+		return out
+	}, nil
+}
+
+// setField sets a dotted field in out, creating the objects on the way.
+func setField(out map[string]any, field []string, v any) {
+	for _, part := range field[:len(field)-1] {
+		next, ok := out[part].(map[string]any)
+		if !ok {
+			next = make(map[string]any)
+			out[part] = next
+		}
+		out = next
+	}
+	out[field[len(field)-1]] = v
+}
+
+// removeField deletes a dotted field from doc, if it is there.
+func removeField(doc any, field []string) {
+	for _, part := range field[:len(field)-1] {
+		node, ok := doc.(map[string]any)
+		if !ok {
+			return
+		}
+		doc = node[part]
+	}
+	if node, ok := doc.(map[string]any); ok {
+		delete(node, field[len(field)-1])
+	}
+}
@@ -0,0 +1,205 @@
+// Package store implements lock striping: the key space is split across independently
+// locked segments so that operations on different keys do not contend for one mutex.
+// Operations that need the whole store (Save, Clear, full iteration) take every segment's
+// lock, always in index order, to get a consistent view without risking deadlock.
+package store
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+// DefaultShards is the number of independently locked segments the key space is split into.
+const DefaultShards = 32
+
+// shardIndex maps a key to one of n segments using FNV-1a. Metadata about a key maps
+// to the key's own segment, so a write and its metadata take a single segment's lock.
+func shardIndex(key string, n int) int {
+	key = shardKey(key)
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % uint32(n))
+}
+
+// shardKey returns the key whose segment k belongs in: the key a version, deadline or
+// history entry is about, or k itself.
+func shardKey(k string) string {
+	if !isInternalKey(k) {
+		return k
+	}
+	if key, ok := strings.CutPrefix(k, versionKeyPrefix); ok {
+		return key
+	}
+	if key, ok := strings.CutPrefix(k, ttlKeyPrefix); ok {
+		return key
+	}
+	if key, _, ok := parseHistoryKey(k); ok {
+		return key
+	}
+	return k
+}
+
+// stripedLock is a set of read-write locks, one per segment of the key space.
+type stripedLock struct {
+	locks []sync.RWMutex
+}
+
+// newStripedLock returns n lock stripes; n below one is treated as one.
+func newStripedLock(n int) *stripedLock {
+	return &stripedLock{locks: make([]sync.RWMutex, max(n, 1))}
+}
+
+// forKey returns the lock guarding key.
+func (l *stripedLock) forKey(key string) *sync.RWMutex {
+	return &l.locks[shardIndex(key, len(l.locks))]
+}
+
+// lockAll write-locks every stripe.
+func (l *stripedLock) lockAll() {
+	for i := range l.locks {
+		l.locks[i].Lock()
+	}
+}
+
+// unlockAll releases every stripe locked by lockAll.
+func (l *stripedLock) unlockAll() {
+	for i := range l.locks {
+		l.locks[i].Unlock()
+	}
+}
+
+// rLockAll read-locks every stripe.
+func (l *stripedLock) rLockAll() {
+	for i := range l.locks {
+		l.locks[i].RLock()
+	}
+}
+
+// rUnlockAll releases every stripe locked by rLockAll.
+func (l *stripedLock) rUnlockAll() {
+	for i := range l.locks {
+		l.locks[i].RUnlock()
+	}
+}
+
+// shard is one segment of a shardedMap.
+type shard struct {
+	mu   sync.RWMutex
+	data map[string]string
+	lazy map[string]valueRef // Keys whose values are still in the data file; see LoadOptions.Lazy
+}
+
+// shardedMap is a string map split across independently locked shards.
+// Callers lock the shard (or all shards) themselves around compound operations.
+type shardedMap struct {
+	shards []shard
+}
+
+// newShardedMap returns an empty map with n shards; n below one is treated as one.
+func newShardedMap(n int) *shardedMap {
+	m := &shardedMap{shards: make([]shard, max(n, 1))}
+	for i := range m.shards {
+		m.shards[i].data = make(map[string]string)
+	}
+	return m
+}
+
+// shardFor returns the shard holding key.
+func (m *shardedMap) shardFor(key string) *shard {
+	return &m.shards[shardIndex(key, len(m.shards))]
+}
+
+// lockAll write-locks every shard, in index order.
+func (m *shardedMap) lockAll() {
+	for i := range m.shards {
+		m.shards[i].mu.Lock()
+	}
+}
+
+// unlockAll releases every shard locked by lockAll.
+func (m *shardedMap) unlockAll() {
+	for i := range m.shards {
+		m.shards[i].mu.Unlock()
+	}
+}
+
+// rLockAll read-locks every shard, in index order.
+func (m *shardedMap) rLockAll() {
+	for i := range m.shards {
+		m.shards[i].mu.RLock()
+	}
+}
+
+// rUnlockAll releases every shard locked by rLockAll.
+func (m *shardedMap) rUnlockAll() {
+	for i := range m.shards {
+		m.shards[i].mu.RUnlock()
+	}
+}
+
+// shardsOf returns the indexes of the shards holding the keys of ops, in index order
+// and without repeats, for lockShards.
+func (m *shardedMap) shardsOf(ops []BatchOp) []int {
+	idx := make([]int, len(ops))
+	for i, op := range ops {
+		idx[i] = shardIndex(op.Key, len(m.shards))
+	}
+	slices.Sort(idx)
+	return slices.Compact(idx)
+}
+
+// lockShards write-locks the given shards, which must be in index order.
+func (m *shardedMap) lockShards(idx []int) {
+	for _, i := range idx {
+		m.shards[i].mu.Lock()
+	}
+}
+
+// unlockShards releases the shards locked by lockShards.
+func (m *shardedMap) unlockShards(idx []int) {
+	for _, i := range idx {
+		m.shards[i].mu.Unlock()
+	}
+}
+
+// rangeLocked calls fn for every pair until fn returns false.
+// The caller must hold every shard's lock.
+func (m *shardedMap) rangeLocked(fn func(key, value string) bool) {
+	for i := range m.shards {
+		for key, value := range m.shards[i].data {
+			if !fn(key, value) {
+				return
+			}
+		}
+	}
+}
+
+// copyLocked returns the contents as a single map. The caller must hold every shard's lock.
+func (m *shardedMap) copyLocked() map[string]string {
+	out := make(map[string]string)
+	m.rangeLocked(func(key, value string) bool {
+		out[key] = value
+		return true
+	})
+	return out
+}
+
+// replaceLocked replaces the contents with data. The caller must hold every shard's write lock.
+func (m *shardedMap) replaceLocked(data map[string]string) {
+	m.clearLocked()
+	for key, value := range data {
+		m.shardFor(key).data[key] = value
+	}
+}
+
+// clearLocked removes every pair. The caller must hold every shard's write lock.
+func (m *shardedMap) clearLocked() {
+	for i := range m.shards {
+		m.shards[i].data = make(map[string]string)
+		m.shards[i].lazy = nil
+	}
+}
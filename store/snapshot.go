@@ -0,0 +1,188 @@
+// Package store handles named point-in-time snapshots of the store's data.
+// A snapshot copies the data in memory while holding the store's locks, then writes
+// the copy to disk after releasing them, so writers are only blocked for the copy.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotExt is the file extension of snapshot files.
+const snapshotExt = ".json"
+
+// namePattern restricts snapshot and namespace names to safe file names.
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// SnapshotInfo describes a stored snapshot.
+type SnapshotInfo struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Size    int64     `json:"size"`
+}
+
+// ValidateSnapshotName ensures a snapshot name can be used safely as a file name.
+func ValidateSnapshotName(name string) error {
+	if name == "" {
+		return errors.New("snapshot name cannot be empty")
+	}
+	if !namePattern.MatchString(name) {
+		return errors.New("snapshot name may only contain letters, digits, '.', '_' and '-'")
+	}
+	return nil
+}
+
+// Snapshot captures a consistent copy of the data under the given name.
+// Writers are blocked only while the data is copied in memory, not while it is written to disk.
+func (s *Store) Snapshot(name string) error {
+	if err := ValidateSnapshotName(name); err != nil {
+		return err
+	}
+
+	path := s.snapshotPath(name)
+	if _, err := os.Stat(path); err == nil {
+		return errors.New("snapshot already exists")
+	}
+
+	s.locks.rLockAll()
+	data, err := s.copyLocked()
+	s.locks.rUnlockAll()
+	if err != nil {
+		return err
+	}
+
+	return writeSnapshotFile(path, s.format, s.codec, s.keys, rangeMap(data))
+}
+
+// Restore replaces the store's data with the contents of the named snapshot.
+func (s *Store) Restore(name string) error {
+	if err := ValidateSnapshotName(name); err != nil {
+		return err
+	}
+	if err := s.writable(); err != nil {
+		return err
+	}
+
+	path := s.snapshotPath(name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return errors.New("snapshot not found")
+	}
+	data, _, err := readSnapshot(path, s.keys)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	s.locks.lockAll()
+	defer s.locks.unlockAll()
+
+	old, err := s.copyLocked()
+	if err != nil {
+		return err
+	}
+
+	// The snapshot holds the revision counter and key versions of its day, which must
+	// not replace the current ones: every restored key is written at the restore's
+	// revision instead, so no version a client has read before comes back.
+	rev := s.versions.next()
+	restored := make(map[string]string, len(data))
+	for key, value := range data {
+		if key == revisionKey || strings.HasPrefix(key, versionKeyPrefix) {
+			continue
+		}
+		restored[key] = value
+		if !isInternalKey(key) {
+			restored[versionKey(key)] = formatRevision(rev)
+		}
+	}
+
+	// The whole restore is written as one batch and committed as one revision, so a
+	// failure part way through leaves the current data in place, and views never see
+	// it half done.
+	var ops []BatchOp
+	for key := range old {
+		if _, kept := restored[key]; !kept && key != revisionKey {
+			ops = append(ops, BatchOp{Key: key, Delete: true})
+		}
+	}
+	var created []string
+	for key, value := range restored {
+		ops = append(ops, BatchOp{Key: key, Value: value})
+		if _, existed := old[key]; !existed {
+			created = append(created, key)
+		}
+	}
+
+	if err := writeBatchAt(s.backend, rev, ops); err != nil {
+		return fmt.Errorf("failed to restore snapshot: %w", err)
+	}
+	s.versions.recordAll(old, created, rev)
+	s.noteWrites(1)
+
+	// Deadlines, history and indexes are restored with the data they belong to.
+	if err := s.loadExpiriesLocked(); err != nil {
+		return err
+	}
+	if err := s.loadHistoryLocked(); err != nil {
+		return err
+	}
+	return s.loadIndexesLocked()
+}
+
+// ListSnapshots returns every stored snapshot, oldest first.
+func (s *Store) ListSnapshots() ([]SnapshotInfo, error) {
+	entries, err := os.ReadDir(s.snapshotDir)
+	if os.IsNotExist(err) {
+		return []SnapshotInfo{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	snapshots := []SnapshotInfo{}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), snapshotExt)
+		if !ok || entry.IsDir() || ValidateSnapshotName(name) != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, SnapshotInfo{Name: name, Created: info.ModTime(), Size: info.Size()})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Created.Before(snapshots[j].Created)
+	})
+	return snapshots, nil
+}
+
+// DeleteSnapshot removes the named snapshot.
+func (s *Store) DeleteSnapshot(name string) error {
+	if err := ValidateSnapshotName(name); err != nil {
+		return err
+	}
+	if err := s.writable(); err != nil {
+		return err
+	}
+
+	err := os.Remove(s.snapshotPath(name))
+	if os.IsNotExist(err) {
+		return errors.New("snapshot not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete snapshot: %w", err)
+	}
+	return nil
+}
+
+// snapshotPath returns the file a snapshot is stored in.
+func (s *Store) snapshotPath(name string) string {
+	return filepath.Join(s.snapshotDir, name+snapshotExt)
+}
@@ -0,0 +1,457 @@
+// Package store implements the immutable sorted string tables (SSTables) used by the LSM engine.
+//
+// A table file is laid out as:
+//
+//	data entries | sparse index | bloom filter | footer
+//
+// Each data entry is uvarint key length | uvarint value field | key | value, where a value
+// field of 0 marks a tombstone and n marks a value of n-1 bytes. The sparse index records
+// the key and offset of every sstableIndexInterval-th entry, so a lookup reads only the
+// run of entries between two index points.
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	sstableIndexInterval = 16         // Entries between sparse index points
+	sstableFooterSize    = 44         // Fixed size of the footer
+	sstableMagic         = 0x4C534D31 // "LSM1"
+)
+
+// lsmEntry is a key with either a value or a tombstone.
+type lsmEntry struct {
+	key       string
+	value     string
+	tombstone bool
+}
+
+// sstableIndexEntry is one point of the sparse index.
+type sstableIndexEntry struct {
+	key    string
+	offset int64
+}
+
+// sstable is an open, immutable table file.
+type sstable struct {
+	path    string
+	file    *os.File
+	index   []sstableIndexEntry // Sparse index, sorted by key
+	bloom   *bloomFilter
+	dataEnd int64  // Offset where the data entries end
+	lastKey string // Largest key in the table
+	entries int64  // Number of entries, tombstones included
+	size    int64  // File size in bytes
+}
+
+// sstableWriter streams sorted entries into a new table file.
+type sstableWriter struct {
+	path    string
+	file    *os.File
+	w       *bufio.Writer
+	offset  int64
+	count   int64
+	index   []sstableIndexEntry
+	keys    []string // Collected for the bloom filter, which is sized once all keys are known
+	lastKey string
+}
+
+// newSSTableWriter creates the table file at path.
+func newSSTableWriter(path string) (*sstableWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create table: %w", err)
+	}
+	return &sstableWriter{path: path, file: file, w: bufio.NewWriter(file)}, nil
+}
+
+// add appends an entry. Entries must be added in strictly increasing key order.
+func (w *sstableWriter) add(e lsmEntry) error {
+	if w.count%sstableIndexInterval == 0 {
+		w.index = append(w.index, sstableIndexEntry{key: e.key, offset: w.offset})
+	}
+
+	var header [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(header[:], uint64(len(e.key)))
+	if e.tombstone {
+		n += binary.PutUvarint(header[n:], 0)
+	} else {
+		n += binary.PutUvarint(header[n:], uint64(len(e.value))+1)
+	}
+
+	written := 0
+	for _, part := range [][]byte{header[:n], []byte(e.key), []byte(e.value)} {
+		m, err := w.w.Write(part)
+		written += m
+		if err != nil {
+			return fmt.Errorf("failed to write table: %w", err)
+		}
+	}
+
+	w.offset += int64(written)
+	w.count++
+	w.keys = append(w.keys, e.key)
+	w.lastKey = e.key
+	return nil
+}
+
+// finish writes the index, bloom filter and footer, syncs the file and opens it for reading.
+func (w *sstableWriter) finish() (*sstable, error) {
+	defer w.file.Close()
+
+	var index bytes.Buffer
+	var scratch [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) {
+		index.Write(scratch[:binary.PutUvarint(scratch[:], v)])
+	}
+	putUvarint(uint64(len(w.index)))
+	for _, entry := range w.index {
+		putUvarint(uint64(len(entry.key)))
+		index.WriteString(entry.key)
+		putUvarint(uint64(entry.offset))
+	}
+	putUvarint(uint64(len(w.lastKey)))
+	index.WriteString(w.lastKey)
+
+	bloom := newBloomFilter(len(w.keys))
+	for _, key := range w.keys {
+		bloom.add(key)
+	}
+	bloomBytes := bloom.marshal()
+
+	crc := crc32.NewIEEE()
+	crc.Write(index.Bytes())
+	crc.Write(bloomBytes)
+
+	footer := make([]byte, sstableFooterSize)
+	binary.BigEndian.PutUint64(footer[0:8], uint64(w.offset))
+	binary.BigEndian.PutUint64(footer[8:16], uint64(index.Len()))
+	binary.BigEndian.PutUint64(footer[16:24], uint64(w.offset)+uint64(index.Len()))
+	binary.BigEndian.PutUint64(footer[24:32], uint64(len(bloomBytes)))
+	binary.BigEndian.PutUint32(footer[32:36], uint32(w.count))
+	binary.BigEndian.PutUint32(footer[36:40], crc.Sum32())
+	binary.BigEndian.PutUint32(footer[40:44], sstableMagic)
+
+	for _, part := range [][]byte{index.Bytes(), bloomBytes, footer} {
+		if _, err := w.w.Write(part); err != nil {
+			return nil, fmt.Errorf("failed to write table: %w", err)
+		}
+	}
+	if err := w.w.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to write table: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to sync table: %w", err)
+	}
+
+	return openSSTable(w.path)
+}
+
+// abort discards a partially written table.
+func (w *sstableWriter) abort() {
+	w.file.Close()
+	os.Remove(w.path)
+}
+
+// openSSTable opens a table file and loads its index and bloom filter.
+func openSSTable(path string) (*sstable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open table: %w", err)
+	}
+
+	t, err := readSSTableMeta(path, file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open table %s: %w", path, err)
+	}
+	return t, nil
+}
+
+// readSSTableMeta reads the footer, sparse index and bloom filter of a table.
+func readSSTableMeta(path string, file *os.File) (*sstable, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < sstableFooterSize {
+		return nil, errors.New("file too short")
+	}
+
+	footer := make([]byte, sstableFooterSize)
+	if _, err := file.ReadAt(footer, info.Size()-sstableFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(footer[40:44]) != sstableMagic {
+		return nil, errors.New("bad magic number")
+	}
+
+	indexOffset := int64(binary.BigEndian.Uint64(footer[0:8]))
+	indexLen := int64(binary.BigEndian.Uint64(footer[8:16]))
+	bloomLen := int64(binary.BigEndian.Uint64(footer[24:32]))
+	if indexOffset+indexLen+bloomLen+sstableFooterSize != info.Size() {
+		return nil, errors.New("inconsistent footer")
+	}
+
+	meta := make([]byte, indexLen+bloomLen)
+	if _, err := file.ReadAt(meta, indexOffset); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(meta) != binary.BigEndian.Uint32(footer[36:40]) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	t := &sstable{
+		path:    path,
+		file:    file,
+		dataEnd: indexOffset,
+		entries: int64(binary.BigEndian.Uint32(footer[32:36])),
+		size:    info.Size(),
+	}
+
+	r := bytes.NewReader(meta[:indexLen])
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	t.index = make([]sstableIndexEntry, 0, count)
+	for i := uint64(0); i < count; i++ {
+		key, err := readUvarintString(r)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		t.index = append(t.index, sstableIndexEntry{key: key, offset: int64(offset)})
+	}
+	if t.lastKey, err = readUvarintString(r); err != nil {
+		return nil, err
+	}
+
+	if t.bloom, err = unmarshalBloomFilter(meta[indexLen:]); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// firstKey returns the smallest key in the table.
+func (t *sstable) firstKey() string {
+	if len(t.index) == 0 {
+		return ""
+	}
+	return t.index[0].key
+}
+
+// overlaps reports whether the table may hold keys in [start, end]. An empty end is unbounded.
+func (t *sstable) overlaps(start, end string) bool {
+	if len(t.index) == 0 {
+		return false
+	}
+	return t.lastKey >= start && (end == "" || t.firstKey() <= end)
+}
+
+// get looks key up in the table.
+func (t *sstable) get(key string) (lsmEntry, bool, error) {
+	if len(t.index) == 0 || key < t.firstKey() || key > t.lastKey || !t.bloom.mayContain(key) {
+		return lsmEntry{}, false, nil
+	}
+
+	// Find the last index point at or before key; the entry, if present, lies between it and the next one.
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].key > key }) - 1
+	start := t.index[i].offset
+	end := t.dataEnd
+	if i+1 < len(t.index) {
+		end = t.index[i+1].offset
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(t.file, start, end-start))
+	for {
+		e, err := readSSTableEntry(r)
+		if err == io.EOF {
+			return lsmEntry{}, false, nil
+		}
+		if err != nil {
+			return lsmEntry{}, false, fmt.Errorf("failed to read table %s: %w", t.path, err)
+		}
+		if e.key == key {
+			return e, true, nil
+		}
+		if e.key > key {
+			return lsmEntry{}, false, nil
+		}
+	}
+}
+
+// iterator returns an iterator over the entries with keys >= start.
+func (t *sstable) iterator(start string) *sstableIterator {
+	var offset int64
+	if i := sort.Search(len(t.index), func(i int) bool { return t.index[i].key > start }) - 1; i > 0 {
+		offset = t.index[i].offset
+	}
+	return &sstableIterator{
+		r:     bufio.NewReader(io.NewSectionReader(t.file, offset, t.dataEnd-offset)),
+		start: start,
+	}
+}
+
+// close closes the table file.
+func (t *sstable) close() error {
+	return t.file.Close()
+}
+
+// readSSTableEntry decodes one data entry.
+func readSSTableEntry(r *bufio.Reader) (lsmEntry, error) {
+	keyLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return lsmEntry{}, err // io.EOF at the end of the data
+	}
+	valueField, err := binary.ReadUvarint(r)
+	if err != nil {
+		return lsmEntry{}, io.ErrUnexpectedEOF
+	}
+
+	e := lsmEntry{tombstone: valueField == 0}
+	buf := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return lsmEntry{}, io.ErrUnexpectedEOF
+	}
+	e.key = string(buf)
+
+	if !e.tombstone {
+		buf = make([]byte, valueField-1)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return lsmEntry{}, io.ErrUnexpectedEOF
+		}
+		e.value = string(buf)
+	}
+	return e, nil
+}
+
+// readUvarintString reads a uvarint length followed by that many bytes.
+func readUvarintString(r *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// lsmIterator walks entries in increasing key order.
+type lsmIterator interface {
+	next() bool      // Advances to the next entry, returning false when exhausted or on error
+	entry() lsmEntry // The current entry
+	err() error      // The error that stopped iteration, if any
+}
+
+// sstableIterator iterates over one table.
+type sstableIterator struct {
+	r       *bufio.Reader
+	start   string
+	current lsmEntry
+	failure error
+}
+
+func (it *sstableIterator) next() bool {
+	for {
+		e, err := readSSTableEntry(it.r)
+		if err != nil {
+			if err != io.EOF {
+				it.failure = err
+			}
+			return false
+		}
+		if e.key >= it.start {
+			it.current = e
+			return true
+		}
+	}
+}
+
+func (it *sstableIterator) entry() lsmEntry { return it.current }
+func (it *sstableIterator) err() error      { return it.failure }
+
+// sliceIterator iterates over entries already sorted in memory.
+type sliceIterator struct {
+	entries []lsmEntry
+	pos     int
+}
+
+func (it *sliceIterator) next() bool {
+	it.pos++
+	return it.pos <= len(it.entries)
+}
+
+func (it *sliceIterator) entry() lsmEntry { return it.entries[it.pos-1] }
+func (it *sliceIterator) err() error      { return nil }
+
+// mergeIterator merges several iterators into one sorted stream. When more than one
+// source holds a key, the source listed first wins, so sources are passed newest first.
+type mergeIterator struct {
+	sources []lsmIterator
+	valid   []bool // Whether each source has a current entry
+	current lsmEntry
+	failure error
+}
+
+// newMergeIterator positions every source on its first entry.
+func newMergeIterator(sources []lsmIterator) *mergeIterator {
+	m := &mergeIterator{sources: sources, valid: make([]bool, len(sources))}
+	for i, src := range sources {
+		m.advance(i, src)
+	}
+	return m
+}
+
+// advance moves one source forward, recording any error it hits.
+func (m *mergeIterator) advance(i int, src lsmIterator) {
+	m.valid[i] = src.next()
+	if !m.valid[i] && src.err() != nil && m.failure == nil {
+		m.failure = src.err()
+	}
+}
+
+func (m *mergeIterator) next() bool {
+	if m.failure != nil {
+		return false
+	}
+
+	winner := -1
+	for i, src := range m.sources {
+		if m.valid[i] && (winner < 0 || src.entry().key < m.sources[winner].entry().key) {
+			winner = i
+		}
+	}
+	if winner < 0 {
+		return false
+	}
+
+	m.current = m.sources[winner].entry()
+	// Skip the same key in older sources.
+	for i, src := range m.sources {
+		if m.valid[i] && src.entry().key == m.current.key {
+			m.advance(i, src)
+		}
+	}
+	return m.failure == nil
+}
+
+func (m *mergeIterator) entry() lsmEntry { return m.current }
+func (m *mergeIterator) err() error      { return m.failure }
@@ -5,37 +5,41 @@ package store
 import (
 	"encoding/json" // To handle JSON operations like marshaling and unmarshaling
 	"errors"        // To manage errors in a structured way
-	"sync"          // To ensure thread-safe access using mutexes
 )
 
 // JSONStore is the primary data structure that holds our in-memory store.
-// The `data` map stores key-value pairs where both the key and value are strings.
-// A mutex (`mu`) ensures thread safety for concurrent access.
+// Key-value pairs, where both the key and value are strings, are spread across
+// independently locked shards so that operations on different keys don't block each other.
 type JSONStore struct {
-	data map[string]string // The in-memory key-value storage
-	mu   sync.RWMutex      // Read-write mutex for thread-safe access
+	data *shardedMap // The in-memory key-value storage, one read-write mutex per shard
 }
 
 // NewJSONStore initializes and returns a new instance of JSONStore.
 // This is the entry point for creating a fresh store in memory.
 func NewJSONStore() *JSONStore {
+	return NewShardedJSONStore(DefaultShards)
+}
+
+// NewShardedJSONStore initializes a JSONStore whose keys are split across n shards.
+func NewShardedJSONStore(n int) *JSONStore {
 	return &JSONStore{
-		data: make(map[string]string), // Create an empty map for storing data
+		data: newShardedMap(n), // Create empty shards for storing data
 	}
 }
 
 // Add inserts a new key-value pair into the store.
 // If the key already exists or the JSON is invalid, it returns an error.
 func (s *JSONStore) Add(key, jsonData string) error {
-	s.mu.Lock()         // Lock the mutex to prevent simultaneous writes
-	defer s.mu.Unlock() // Unlock it after the operation completes
+	sh := s.data.shardFor(key) // Find the shard responsible for this key
+	sh.mu.Lock()               // Lock the shard to prevent simultaneous writes
+	defer sh.mu.Unlock()       // Unlock it after the operation completes
 
 	if key == "" {
 		return errors.New("key cannot be empty") // Validate key
 	}
 
 	// Check if the key already exists in the store
-	if _, exists := s.data[key]; exists {
+	if _, exists := sh.data[key]; exists {
 		return errors.New("key already exists") // Return an error if the key is a duplicate
 	}
 
@@ -45,22 +49,23 @@ func (s *JSONStore) Add(key, jsonData string) error {
 	}
 
 	// Add the key-value pair to the store
-	s.data[key] = jsonData
+	sh.data[key] = jsonData
 	return nil // Return nil to indicate success
 }
 
 // Get retrieves the value associated with a given key from the store.
 // If the key doesn't exist, it returns an error.
 func (s *JSONStore) Get(key string) (string, error) {
-	s.mu.RLock()         // Use a read-lock for safe concurrent reads
-	defer s.mu.RUnlock() // Release the lock when done
+	sh := s.data.shardFor(key) // Find the shard responsible for this key
+	sh.mu.RLock()              // Use a read-lock for safe concurrent reads
+	defer sh.mu.RUnlock()      // Release the lock when done
 
 	if key == "" {
 		return "", errors.New("key cannot be empty") // Validate key
 	}
 
 	// Check if the key exists in the store
-	value, exists := s.data[key]
+	value, exists := sh.data[key]
 	if !exists {
 		return "", errors.New("key not found") // Return an error if the key is missing
 	}
@@ -71,15 +76,16 @@ func (s *JSONStore) Get(key string) (string, error) {
 // Update modifies the value associated with an existing key.
 // It validates the new JSON and returns an error if the key doesn't exist or JSON is invalid.
 func (s *JSONStore) Update(key, newJSONData string) error {
-	s.mu.Lock()         // Lock the mutex for write operations
-	defer s.mu.Unlock() // Unlock it afterward
+	sh := s.data.shardFor(key) // Find the shard responsible for this key
+	sh.mu.Lock()               // Lock the shard for write operations
+	defer sh.mu.Unlock()       // Unlock it afterward
 
 	if key == "" {
 		return errors.New("key cannot be empty") // Validate key
 	}
 
 	// Check if the key exists in the store
-	if _, exists := s.data[key]; !exists {
+	if _, exists := sh.data[key]; !exists {
 		return errors.New("key not found") // Cannot update a non-existent key
 	}
 
@@ -89,27 +95,28 @@ func (s *JSONStore) Update(key, newJSONData string) error {
 	}
 
 	// Update the key with the new value
-	s.data[key] = newJSONData
+	sh.data[key] = newJSONData
 	return nil // Return nil to indicate success
 }
 
 // Delete removes a key-value pair from the store.
 // If the key is not found, it returns an error.
 func (s *JSONStore) Delete(key string) error {
-	s.mu.Lock()         // Lock the mutex to ensure safe write access
-	defer s.mu.Unlock() // Unlock it after the operation
+	sh := s.data.shardFor(key) // Find the shard responsible for this key
+	sh.mu.Lock()               // Lock the shard to ensure safe write access
+	defer sh.mu.Unlock()       // Unlock it after the operation
 
 	if key == "" {
 		return errors.New("key cannot be empty") // Validate key
 	}
 
 	// Check if the key exists in the store
-	if _, exists := s.data[key]; !exists {
+	if _, exists := sh.data[key]; !exists {
 		return errors.New("key not found") // Cannot delete a key that doesn't exist
 	}
 
 	// Remove the key-value pair from the store
-	delete(s.data, key)
+	delete(sh.data, key)
 	return nil // Return nil to indicate success
 }
 
@@ -1,17 +1,25 @@
 package store
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // TestCreate tests the creation of a new JSON object in the store
 func TestCreate(t *testing.T) {
-	store := NewStore()
+	store := newTestStore()
 
 	// Valid JSON
 	validJSON := `{"name": "John", "age": 30}`
@@ -30,7 +38,7 @@ func TestCreate(t *testing.T) {
 
 // TestRead tests the reading of a JSON object from the store
 func TestRead(t *testing.T) {
-	store := NewStore()
+	store := newTestStore()
 
 	// Creating a valid JSON object
 	validJSON := `{"name": "John", "age": 30}`
@@ -57,7 +65,7 @@ func TestRead(t *testing.T) {
 
 // TestUpdate tests the updating of an existing JSON object
 func TestUpdate(t *testing.T) {
-	store := NewStore()
+	store := newTestStore()
 
 	// Creating a valid JSON object
 	validJSON := `{"name": "John", "age": 30}`
@@ -91,7 +99,7 @@ func TestUpdate(t *testing.T) {
 
 // TestDelete tests the deletion of a JSON object from the store
 func TestDelete(t *testing.T) {
-	store := NewStore()
+	store := newTestStore()
 
 	// Creating a valid JSON object
 	validJSON := `{"name": "John", "age": 30}`
@@ -115,10 +123,10 @@ func TestDelete(t *testing.T) {
 
 // TestPersistence tests the persistence of data in the store
 func TestPersistence(t *testing.T) {
-	store := NewStore()
+	store := newTestStore()
 
-	// Create a key-value pair
-	validJSON := `{"name": "John", "age": 30}`
+	// Create a key-value pair, written compactly since values are stored compacted
+	validJSON := `{"name":"John","age":30}`
 	err := store.Create("user1", validJSON)
 	if err != nil {
 		t.Errorf("Expected no error, but got: %v", err)
@@ -131,7 +139,7 @@ func TestPersistence(t *testing.T) {
 	}
 
 	// Create a new store instance and load data
-	store2 := NewStore()
+	store2 := newTestStore()
 	err = store2.Load()
 	if err != nil {
 		t.Errorf("Expected no error when loading, but got: %v", err)
@@ -149,7 +157,7 @@ func TestPersistence(t *testing.T) {
 
 // TestInvalidJSON tests invalid JSON scenarios
 func TestInvalidJSON(t *testing.T) {
-	store := NewStore()
+	store := newTestStore()
 
 	// Invalid JSON format
 	invalidJSON := `{"name": "John", "age": }`
@@ -168,7 +176,7 @@ func TestInvalidJSON(t *testing.T) {
 
 // TestEdgeCases tests various edge cases like empty strings or invalid keys
 func TestEdgeCases(t *testing.T) {
-	store := NewStore()
+	store := newTestStore()
 
 	// Empty JSON string
 	err := store.Create("user1", "")
@@ -195,10 +203,2099 @@ func TestEdgeCases(t *testing.T) {
 	}
 }
 
+// TestWALRecovery tests that writes not yet saved are recovered from the write-ahead log
+func TestWALRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store := NewStore(path)
+
+	if err := store.Create("user1", `{"name": "John"}`); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := store.Create("user2", `{"name": "Jane"}`); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := store.Delete("user1"); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	// Simulate a crash: no Save, just reopen from disk
+	store2 := NewStore(path)
+	if err := store2.Load(); err != nil {
+		t.Fatalf("Expected no error when loading, but got: %v", err)
+	}
+	if _, err := store2.Read("user1"); err == nil {
+		t.Errorf("Expected deleted key to stay deleted after recovery")
+	}
+	if result, err := store2.Read("user2"); err != nil || result != `{"name": "Jane"}` {
+		t.Errorf("Expected recovered value, but got %q (%v)", result, err)
+	}
+}
+
+// TestWALTornWrite tests that a partially written log record is discarded on replay
+func TestWALTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store := NewStore(path)
+	if err := store.Create("user1", `{"name": "John"}`); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	// Append half a record, as if the process died mid-write
+	f, err := os.OpenFile(path+".wal", os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	f.WriteString(`0badc0de {"op":"set","key":"us`)
+	f.Close()
+
+	store2 := NewStore(path)
+	if err := store2.Load(); err != nil {
+		t.Fatalf("Expected no error when loading, but got: %v", err)
+	}
+	if _, err := store2.Read("user1"); err != nil {
+		t.Errorf("Expected intact record to be replayed, but got: %v", err)
+	}
+	if err := store2.Create("user2", `{"name": "Jane"}`); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	store3 := NewStore(path)
+	if err := store3.Load(); err != nil {
+		t.Fatalf("Expected no error when loading, but got: %v", err)
+	}
+	if _, err := store3.Read("user2"); err != nil {
+		t.Errorf("Expected write after recovery to be replayed, but got: %v", err)
+	}
+}
+
+// TestWALCheckpoint tests that the log is folded into the snapshot and truncated
+func TestWALCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store := NewStore(path, WithCheckpointEvery(2))
+
+	store.Set("a", `{"n": 1}`)
+	store.Set("b", `{"n": 2}`)
+
+	info, err := os.Stat(path + ".wal")
+	if err != nil {
+		t.Fatalf("Expected log file to exist, but got: %v", err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("Expected log to be truncated after checkpoint, but it has %d bytes", info.Size())
+	}
+
+	store2 := NewStore(path, WithoutWAL())
+	if err := store2.Load(); err != nil {
+		t.Fatalf("Expected no error when loading, but got: %v", err)
+	}
+	if _, ok := store2.Get("b"); !ok {
+		t.Errorf("Expected checkpointed key in snapshot")
+	}
+}
+
+// TestSaveBackupGenerations tests that Save keeps rolling backups of previous snapshots
+func TestSaveBackupGenerations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store := NewStore(path, WithBackups(2))
+
+	for _, value := range []string{`{"v":1}`, `{"v":2}`, `{"v":3}`} {
+		store.Set("key", value)
+		if err := store.Save(); err != nil {
+			t.Fatalf("Expected no error when saving, but got: %v", err)
+		}
+	}
+
+	expected := map[string]string{path: `{"v":3}`, path + ".1": `{"v":2}`, path + ".2": `{"v":1}`}
+	for file, want := range expected {
+		gen := NewStore(file, WithoutWAL())
+		if err := gen.Load(); err != nil {
+			t.Fatalf("Expected no error loading %s, but got: %v", file, err)
+		}
+		if got, _ := gen.Get("key"); got != want {
+			t.Errorf("Expected %s to hold %v, but got %v", file, want, got)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 backup generations to be kept")
+	}
+}
+
+// TestLoadFallsBackToBackup tests that a corrupt primary file is replaced by the newest backup on load
+func TestLoadFallsBackToBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store := NewStore(path, WithoutWAL())
+
+	store.Set("key", `{"v":1}`)
+	store.Save()
+	store.Set("key", `{"v":2}`)
+	store.Save()
+
+	if err := os.WriteFile(path, []byte(`{"key": "{\"v\"`), 0644); err != nil {
+		t.Fatalf("Failed to corrupt file: %v", err)
+	}
+
+	store2 := NewStore(path, WithoutWAL())
+	if err := store2.Load(); err != nil {
+		t.Fatalf("Expected fallback to backup, but got: %v", err)
+	}
+	if got, _ := store2.Get("key"); got != `{"v":1}` {
+		t.Errorf("Expected backup value, but got %v", got)
+	}
+
+	store3 := NewStore(path, WithoutWAL(), WithBackups(0))
+	if err := store3.Load(); err == nil {
+		t.Errorf("Expected an error without backups to fall back to")
+	}
+}
+
+// TestBackupFallbackSkipsLog tests that the write-ahead log is not replayed over a
+// backup it was not written against, but set aside, and that its revisions are not
+// handed out again
+func TestBackupFallbackSkipsLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store := NewStore(path, WithBackups(1))
+	store.Create("user1", `{"v":1}`)
+	store.Create("user2", `{"v":2}`)
+	store.Save()
+	store.Delete("user2")
+	store.Save()
+	last, _ := store.CreateWithTTL("user3", `{"v":3}`, 0) // Only in the log
+	store.Delete("user1") // Not closed, as Close would fold the log into the file
+
+	if err := os.WriteFile(path, []byte("KVSTORE 2\ngarbage"), 0644); err != nil {
+		t.Fatalf("Failed to corrupt file: %v", err)
+	}
+
+	reloaded := NewStore(path, WithBackups(1))
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Expected fallback to backup, but got: %v", err)
+	}
+	defer reloaded.Close()
+	if _, err := reloaded.Read("user3"); err == nil {
+		t.Errorf("Expected the log not to be replayed over the backup")
+	}
+	if _, err := reloaded.Read("user1"); err != nil {
+		t.Errorf("Expected the backup's user1, but got: %v", err)
+	}
+	if content, _ := os.ReadFile(path + ".wal"); len(content) != 0 {
+		t.Errorf("Expected the log to be emptied, but it holds %d bytes", len(content))
+	}
+	orphaned, _ := filepath.Glob(path + ".wal.orphaned-*")
+	if len(orphaned) != 1 {
+		t.Fatalf("Expected the log's records to be set aside, but got %v", orphaned)
+	}
+	if content, _ := os.ReadFile(orphaned[0]); !bytes.Contains(content, []byte("user3")) {
+		t.Errorf("Expected %s to hold the log's records", orphaned[0])
+	}
+	if rev, _ := reloaded.CreateWithTTL("user4", `{"v":4}`, 0); rev <= last {
+		t.Errorf("Expected a revision after %d, but got %d", last, rev)
+	}
+}
+
+// TestStoreWithBackend tests that validation and clearing work on top of a custom backend
+func TestStoreWithBackend(t *testing.T) {
+	backend := NewMemoryBackend()
+	store := NewStore("", WithBackend(backend))
+
+	if err := store.Create("user1", `{"name": "John"}`); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := store.Create("user2", `not json`); err == nil {
+		t.Errorf("Expected error for invalid JSON, but got none")
+	}
+	if _, found, _ := backend.Get("user1"); !found {
+		t.Errorf("Expected value to be stored in the custom backend")
+	}
+
+	if err := store.Clear(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if _, err := store.Read("user1"); err == nil {
+		t.Errorf("Expected error for cleared key, but got none")
+	}
+}
+
+// TestBitcaskMerge tests that merging drops stale records and the index survives a reopen via hint files
+func TestBitcaskMerge(t *testing.T) {
+	dir := t.TempDir()
+	opts := BitcaskOptions{MaxFileSize: 256, MergeInterval: -1}
+	b, err := OpenBitcask(dir, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		b.Put("counter", fmt.Sprintf(`{"n": %d}`, i))
+	}
+	b.Put("removed", `{}`)
+	b.Delete("removed")
+	b.Put("kept", `{"v": true}`)
+
+	before := b.diskBytes
+	if err := b.Merge(); err != nil {
+		t.Fatalf("Expected no error when merging, but got: %v", err)
+	}
+	if b.diskBytes >= before {
+		t.Errorf("Expected merge to shrink data from %d bytes, but got %d", before, b.diskBytes)
+	}
+	b.Put("after", `{}`)
+	if err := b.Close(); err != nil {
+		t.Fatalf("Expected no error when closing, but got: %v", err)
+	}
+
+	hints, _ := filepath.Glob(filepath.Join(dir, "*.hint"))
+	if len(hints) != 1 {
+		t.Fatalf("Expected one hint file after merge, but found %d", len(hints))
+	}
+
+	b, err = OpenBitcask(dir, opts)
+	if err != nil {
+		t.Fatalf("Expected no error when reopening, but got: %v", err)
+	}
+	defer b.Close()
+
+	expected := map[string]string{"counter": `{"n": 19}`, "kept": `{"v": true}`, "after": `{}`}
+	for key, want := range expected {
+		if got, found, err := b.Get(key); err != nil || !found || got != want {
+			t.Errorf("Expected %s = %v, but got %v (found=%v, err=%v)", key, want, got, found, err)
+		}
+	}
+	if _, found, _ := b.Get("removed"); found {
+		t.Errorf("Expected deleted key to stay deleted after merge")
+	}
+}
+
+// TestBitcaskTornWrite tests that a partial record at the end of the log is discarded on open
+func TestBitcaskTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	b, err := OpenBitcask(dir, BitcaskOptions{MergeInterval: -1})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	b.Put("user1", `{"name": "John"}`)
+	active := b.filePath(b.activeID, bitcaskDataExt)
+	b.Close()
+
+	record := encodeBitcaskRecord("user2", `{"name": "Jane"}`, false)
+	f, _ := os.OpenFile(active, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write(record[:len(record)-3])
+	f.Close()
+
+	b, err = OpenBitcask(dir, BitcaskOptions{MergeInterval: -1})
+	if err != nil {
+		t.Fatalf("Expected torn record to be discarded, but got: %v", err)
+	}
+	defer b.Close()
+	if _, found, _ := b.Get("user1"); !found {
+		t.Errorf("Expected intact record to survive")
+	}
+	if _, found, _ := b.Get("user2"); found {
+		t.Errorf("Expected torn record to be dropped")
+	}
+}
+
+// TestLSMFlushCompactAndRange tests that data survives flushes and compactions and range reads stay sorted
+func TestLSMFlushCompactAndRange(t *testing.T) {
+	dir := t.TempDir()
+	opts := LSMOptions{MemtableSize: 1 << 10, TableSize: 512, L0Tables: 2, LevelRatio: 2}
+	l, err := OpenLSM(dir, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	for i := 0; i < 300; i++ {
+		if err := l.Put(fmt.Sprintf("key%03d", i), fmt.Sprintf(`{"n": %d}`, i)); err != nil {
+			t.Fatalf("Expected no error, but got: %v", err)
+		}
+	}
+	for i := 0; i < 300; i += 3 {
+		l.Delete(fmt.Sprintf("key%03d", i))
+	}
+	if err := l.Flush(); err != nil {
+		t.Fatalf("Expected no error when flushing, but got: %v", err)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatalf("Expected no error when compacting, but got: %v", err)
+	}
+	if len(l.levels[0]) >= opts.L0Tables {
+		t.Errorf("Expected level 0 to be compacted, but it has %d tables", len(l.levels[0]))
+	}
+	l.Put("key150", `{"n": "memtable"}`)
+	l.Close()
+
+	l, err = OpenLSM(dir, opts)
+	if err != nil {
+		t.Fatalf("Expected no error when reopening, but got: %v", err)
+	}
+	defer l.Close()
+
+	if value, found, _ := l.Get("key151"); !found || value != `{"n": 151}` {
+		t.Errorf("Expected key151 from a table, but got %v (found=%v)", value, found)
+	}
+	if value, found, _ := l.Get("key150"); !found || value != `{"n": "memtable"}` {
+		t.Errorf("Expected key150 replayed from the log, but got %v (found=%v)", value, found)
+	}
+	if _, found, _ := l.Get("key003"); found {
+		t.Errorf("Expected deleted key to stay deleted")
+	}
+
+	var keys []string
+	l.Range("key100", "key110", func(key, _ string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	expected := []string{"key100", "key101", "key103", "key104", "key106", "key107", "key109"}
+	if fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("Expected range %v, but got %v", expected, keys)
+	}
+}
+
+// TestStoreRange tests range reads on a backend without native key ordering
+func TestStoreRange(t *testing.T) {
+	store := NewStore("", WithBackend(NewMemoryBackend()))
+	for _, key := range []string{"b", "d", "a", "c"} {
+		store.Set(key, `{}`)
+	}
+
+	var keys []string
+	store.Range("b", "d", func(key, _ string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if fmt.Sprint(keys) != "[b c]" {
+		t.Errorf("Expected [b c], but got %v", keys)
+	}
+}
+
+// TestConcurrentWritesAndClear tests that per-key writes interleave safely with whole-store operations
+func TestConcurrentWritesAndClear(t *testing.T) {
+	store := NewStore("", WithBackend(NewMemoryBackend()))
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("w%d-%d", w, i)
+				if err := store.Create(key, `{}`); err != nil {
+					t.Errorf("Expected no error, but got: %v", err)
+					return
+				}
+				store.Read(key)
+				if i%50 == 0 {
+					store.Clear()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	count := 0
+	store.Range("", "", func(string, string) bool {
+		count++
+		return true
+	})
+	if count == 0 || count > 8*200 {
+		t.Errorf("Expected between 1 and %d keys after concurrent writes, but got %d", 8*200, count)
+	}
+}
+
+// TestViewIsolation tests that a view keeps seeing the revision it was opened at
+func TestViewIsolation(t *testing.T) {
+	store := NewStore("", WithBackend(NewMemoryBackend()))
+	store.Create("user1", `{"name": "Alice"}`)
+	store.Create("user2", `{"name": "Bob"}`)
+
+	view := store.View()
+	defer view.Close()
+
+	store.Update("user1", `{"name": "Carol"}`)
+	store.Delete("user2")
+	store.Create("user3", `{"name": "Dave"}`)
+
+	if value, ok, err := view.Get("user1"); err != nil || !ok || value != `{"name": "Alice"}` {
+		t.Errorf("Expected the original user1, but got %q (ok %v, err %v)", value, ok, err)
+	}
+	if _, ok, _ := view.Get("user2"); !ok {
+		t.Errorf("Expected user2 to be visible in the view")
+	}
+	if _, ok, _ := view.Get("user3"); ok {
+		t.Errorf("Expected user3 not to be visible in the view")
+	}
+
+	var keys []string
+	view.Iterate(func(key, _ string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if fmt.Sprint(keys) != "[user1 user2]" {
+		t.Errorf("Expected [user1 user2], but got %v", keys)
+	}
+
+	if store.Revision() != view.Revision()+3 {
+		t.Errorf("Expected three revisions after the view, but got %d and %d", view.Revision(), store.Revision())
+	}
+}
+
+// TestViewGarbageCollection tests that versions are discarded once no view or retention window needs them
+func TestViewGarbageCollection(t *testing.T) {
+	store := NewStore("", WithBackend(NewMemoryBackend()), WithRevisionRetention(2))
+	store.Set("k", `{"v": 1}`)
+	store.Set("k", `{"v": 2}`)
+	store.Set("k", `{"v": 3}`)
+	store.Set("k", `{"v": 4}`)
+
+	if _, err := store.ViewAt(1); err != ErrCompacted {
+		t.Errorf("Expected ErrCompacted for a revision behind the horizon, but got: %v", err)
+	}
+
+	view, err := store.ViewAt(2)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	store.Set("k", `{"v": 5}`)
+	store.Set("k", `{"v": 6}`)
+	if value, _, err := view.Get("k"); err != nil || value != `{"v": 2}` {
+		t.Errorf("Expected the pinned version, but got %q (err %v)", value, err)
+	}
+	view.Close()
+
+	if _, _, err := view.Get("k"); err != ErrViewClosed {
+		t.Errorf("Expected ErrViewClosed, but got: %v", err)
+	}
+	if len(store.versions.history["k"]) != 2 {
+		t.Errorf("Expected 2 retained versions after closing the view, but got %d", len(store.versions.history["k"]))
+	}
+}
+
+// TestViewDuringClear tests that a view survives a concurrent Clear and Restore
+func TestViewDuringClear(t *testing.T) {
+	store := NewStore("", WithBackend(NewMemoryBackend()), WithSnapshotDir(t.TempDir()))
+	for i := 0; i < 100; i++ {
+		store.Set(fmt.Sprintf("k%d", i), `{}`)
+	}
+	store.Snapshot("full")
+
+	view := store.View()
+	defer view.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			store.Clear()
+			store.Restore("full")
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		count := 0
+		if err := view.Iterate(func(string, string) bool {
+			count++
+			return true
+		}); err != nil {
+			t.Fatalf("Expected no error, but got: %v", err)
+		}
+		if count != 100 {
+			t.Errorf("Expected the view to see 100 keys, but got %d", count)
+		}
+	}
+	wg.Wait()
+}
+
+// TestTTLExpiry tests that keys with a TTL disappear once it elapses
+func TestTTLExpiry(t *testing.T) {
+	store := NewStore("", WithBackend(NewMemoryBackend()))
+	store.SetWithTTL("session", `{"user": "alice"}`, 20*time.Millisecond)
+	store.Create("user1", `{"name": "Alice"}`)
+
+	if ttl, err := store.TTL("session"); err != nil || ttl <= 0 || ttl > 20*time.Millisecond {
+		t.Errorf("Expected a remaining TTL of at most 20ms, but got %v (err %v)", ttl, err)
+	}
+	if ttl, _ := store.TTL("user1"); ttl != NoExpiry {
+		t.Errorf("Expected NoExpiry for a key without a TTL, but got %v", ttl)
+	}
+	if err := store.Create("\x00ttl:user1", `{}`); err == nil {
+		t.Errorf("Expected an error for a reserved key, but got none")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if _, err := store.Read("session"); err == nil {
+		t.Errorf("Expected expired key to be gone, but it was still readable")
+	}
+	if _, exists, _ := store.Backend().Get(ttlKey("session")); exists {
+		t.Errorf("Expected the deadline to be removed along with the key")
+	}
+	if err := store.Create("session", `{"user": "bob"}`); err != nil {
+		t.Errorf("Expected to recreate an expired key, but got: %v", err)
+	}
+	if ttl, _ := store.TTL("session"); ttl != NoExpiry {
+		t.Errorf("Expected the recreated key not to expire, but got %v", ttl)
+	}
+}
+
+// TestTTLPersistAndReaper tests Expire, Persist and the background reaper
+func TestTTLPersistAndReaper(t *testing.T) {
+	store := NewStore("", WithBackend(NewMemoryBackend()))
+	store.Create("a", `{}`)
+	store.Create("b", `{}`)
+
+	if err := store.Expire("missing", time.Second); err == nil {
+		t.Errorf("Expected an error for a missing key, but got none")
+	}
+	store.Expire("a", 10*time.Millisecond)
+	store.Expire("b", 10*time.Millisecond)
+	if err := store.Persist("b"); err != nil {
+		t.Errorf("Expected no error, but got: %v", err)
+	}
+
+	stop := store.StartReaper(5 * time.Millisecond)
+	defer stop()
+	time.Sleep(50 * time.Millisecond)
+
+	if _, exists, _ := store.Backend().Get("a"); exists {
+		t.Errorf("Expected the reaper to delete the expired key")
+	}
+	if _, err := store.Read("b"); err != nil {
+		t.Errorf("Expected persisted key to remain, but got: %v", err)
+	}
+}
+
+// TestTTLSurvivesRestart tests that deadlines are saved and reloaded with the data
+func TestTTLSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store := NewStore(path)
+	store.SetWithTTL("session", `{}`, time.Hour)
+	store.Create("user1", `{}`)
+	store.Save()
+
+	reopened := NewStore(path)
+	if err := reopened.Load(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if ttl, err := reopened.TTL("session"); err != nil || ttl <= 59*time.Minute {
+		t.Errorf("Expected the deadline to survive a restart, but got %v (err %v)", ttl, err)
+	}
+
+	var keys []string
+	reopened.Range("", "", func(key, _ string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if fmt.Sprint(keys) != "[session user1]" {
+		t.Errorf("Expected metadata to be hidden from Range, but got %q", keys)
+	}
+}
+
+// TestWriteWithTTL tests that creates and updates can set a TTL in the same batch as
+// the value, so a failed write leaves neither behind
+func TestWriteWithTTL(t *testing.T) {
+	backend := &batchFailingBackend{MemoryBackend: NewMemoryBackend()}
+	store := NewStore(filepath.Join(t.TempDir(), "store.json"), WithBackend(backend))
+
+	if _, err := store.CreateWithTTL("user1", `{"v":1}`, time.Hour); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if ttl, _ := store.TTL("user1"); ttl <= 59*time.Minute {
+		t.Errorf("Expected a TTL of about an hour, but got %v", ttl)
+	}
+	if _, err := store.CompareAndSwapWithTTL("user1", AnyVersion, `{"v":2}`, 0); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if ttl, _ := store.TTL("user1"); ttl <= 59*time.Minute {
+		t.Errorf("Expected the TTL to be kept, but got %v", ttl)
+	}
+	if _, err := store.CompareAndSwapWithTTL("user1", AnyVersion, `{"v":3}`, time.Minute); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if ttl, _ := store.TTL("user1"); ttl > time.Minute {
+		t.Errorf("Expected the TTL to be replaced, but got %v", ttl)
+	}
+
+	backend.fail = true
+	if _, err := store.CreateWithTTL("user2", `{}`, time.Hour); err == nil {
+		t.Fatalf("Expected the create to fail")
+	}
+	backend.fail = false
+	if _, err := store.TTL("user2"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, but got: %v", err)
+	}
+	if _, found, _ := backend.Get(ttlKey("user2")); found {
+		t.Errorf("Expected no deadline to be left behind")
+	}
+}
+
+// TestReadOnlyExpiry tests that a read-only store reports an expired key as not found,
+// like a writable one, although it cannot delete it
+func TestReadOnlyExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store := NewStore(path)
+	store.CreateWithTTL("session", `{"user":"ada"}`, 20*time.Millisecond)
+	store.Close()
+	time.Sleep(30 * time.Millisecond)
+
+	readOnly := NewStore(path, WithReadOnly())
+	if err := readOnly.Load(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if _, err := readOnly.TTL("session"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound from TTL, but got: %v", err)
+	}
+	if _, err := readOnly.Read("session"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound from Read, but got: %v", err)
+	}
+	if _, found, _ := readOnly.Backend().Get("session"); !found {
+		t.Errorf("Expected the read-only store to leave the expired key in place")
+	}
+}
+
+// TestCacheEviction tests that the cache stays within budget and evicts by policy
+func TestCacheEviction(t *testing.T) {
+	value := `{"padding": "0123456789012345678901234567890123456789"}`
+	entrySize := int64(len("k0")+len(value)) + cacheEntryOverhead
+
+	for _, policy := range []CachePolicy{CacheLRU, CacheLFU} {
+		cache := NewCachedBackend(NewMemoryBackend(), CacheOptions{MaxBytes: 3 * entrySize, Policy: policy})
+		for _, key := range []string{"k0", "k1", "k2"} {
+			cache.Put(key, value)
+			cache.Get(key)
+		}
+
+		// k0 is read most often and most recently, so k1 is the victim under either policy.
+		cache.Get("k0")
+		cache.Get("k0")
+		cache.Get("k2")
+		cache.Put("k3", value)
+		cache.Get("k3")
+
+		stats := cache.Stats()
+		if stats.Bytes > stats.MaxBytes || stats.Entries != 3 || stats.Evictions != 1 {
+			t.Errorf("policy %d: Expected 3 entries within budget after 1 eviction, but got %+v", policy, stats)
+		}
+		if _, cached := cache.entries["k1"]; cached {
+			t.Errorf("policy %d: Expected k1 to be evicted", policy)
+		}
+		if value, found, _ := cache.Get("k1"); !found || value == "" {
+			t.Errorf("policy %d: Expected an evicted key to be reloaded from disk", policy)
+		}
+	}
+}
+
+// TestStoreCacheStats tests that a store with a cache reports hits and misses
+func TestStoreCacheStats(t *testing.T) {
+	store := NewStore("", WithBackend(NewMemoryBackend()), WithCache(CacheOptions{MaxBytes: 1 << 20}))
+	store.Create("user1", `{"name": "Alice"}`)
+
+	store.Read("user1")
+	store.Read("user1")
+	store.Read("user1")
+
+	stats, ok := store.CacheStats()
+	if !ok {
+		t.Fatalf("Expected cache statistics for a store with a cache")
+	}
+	if stats.Misses == 0 || stats.Hits < 2 || stats.HitRate() <= 0 {
+		t.Errorf("Expected repeated reads to hit the cache, but got %+v", stats)
+	}
+	if _, ok := NewStore("", WithBackend(NewMemoryBackend())).CacheStats(); ok {
+		t.Errorf("Expected no cache statistics for a store without a cache")
+	}
+}
+
+// TestNamespaces tests that namespaces isolate keys and persist separately
+func TestNamespaces(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store := NewStore(path)
+	store.Create("user1", `{"team":"root"}`)
+
+	billing, err := store.CreateNamespace("billing")
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if _, err := store.CreateNamespace("billing"); err == nil {
+		t.Errorf("Expected an error for a duplicate namespace, but got none")
+	}
+	if _, err := store.CreateNamespace("../escape"); err == nil {
+		t.Errorf("Expected an error for an invalid namespace name, but got none")
+	}
+	if err := billing.Create("user1", `{"team":"billing"}`); err != nil {
+		t.Errorf("Expected the same key in another namespace to be allowed, but got: %v", err)
+	}
+	store.Save()
+
+	reopened := NewStore(path)
+	reopened.Load()
+	names, _ := reopened.Namespaces()
+	if fmt.Sprint(names) != "[billing]" {
+		t.Errorf("Expected [billing], but got %v", names)
+	}
+	ns, err := reopened.Namespace("billing")
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if value, _ := ns.Read("user1"); value != `{"team":"billing"}` {
+		t.Errorf("Expected the namespace's own value, but got %q", value)
+	}
+	if value, _ := reopened.Read("user1"); value != `{"team":"root"}` {
+		t.Errorf("Expected the root value, but got %q", value)
+	}
+	if stats, _ := ns.Stats(); stats.Keys != 1 {
+		t.Errorf("Expected 1 key in the namespace, but got %d", stats.Keys)
+	}
+
+	if err := reopened.DropNamespace("billing"); err != nil {
+		t.Errorf("Expected no error, but got: %v", err)
+	}
+	if _, err := reopened.Namespace("billing"); err == nil {
+		t.Errorf("Expected a dropped namespace to be gone")
+	}
+}
+
+// TestTxnCommitAndRollback tests that transactions apply all of their writes or none
+func TestTxnCommitAndRollback(t *testing.T) {
+	store := NewStore("", WithBackend(NewMemoryBackend()))
+	store.Create("alice", `{"balance": 100}`)
+	store.Create("bob", `{"balance": 0}`)
+	rev := store.Revision()
+
+	err := store.Txn(func(tx *Tx) error {
+		if err := tx.Update("alice", `{"balance": 60}`); err != nil {
+			return err
+		}
+		if value, _ := tx.Read("alice"); value != `{"balance": 60}` {
+			t.Errorf("Expected the transaction to read its own write, but got %q", value)
+		}
+		return tx.Update("bob", `{"balance": 40}`)
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if value, _ := store.Read("bob"); value != `{"balance": 40}` {
+		t.Errorf("Expected the committed value, but got %q", value)
+	}
+	if store.Revision() != rev+1 {
+		t.Errorf("Expected the commit to be a single revision, but got %d after %d", store.Revision(), rev)
+	}
+
+	err = store.Txn(func(tx *Tx) error {
+		tx.Update("alice", `{"balance": 0}`)
+		tx.Delete("bob")
+		return tx.Create("alice", `{}`) // Fails: alice exists
+	})
+	if err == nil {
+		t.Errorf("Expected the failing transaction to return its error")
+	}
+	if value, _ := store.Read("alice"); value != `{"balance": 60}` {
+		t.Errorf("Expected a rolled back write to be discarded, but got %q", value)
+	}
+	if _, err := store.Read("bob"); err != nil {
+		t.Errorf("Expected a rolled back delete to be discarded, but got: %v", err)
+	}
+}
+
+// TestTxnBatchReplay tests that a committed transaction is replayed from the write-ahead log as a whole
+func TestTxnBatchReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store := NewStore(path)
+	store.Create("a", `{}`)
+	store.Txn(func(tx *Tx) error {
+		tx.Delete("a")
+		tx.Create("b", `{"moved": true}`)
+		return tx.Create("c", `{"moved": true}`)
+	})
+
+	reopened := NewStore(path)
+	if err := reopened.Load(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if _, err := reopened.Read("a"); err == nil {
+		t.Errorf("Expected the deleted key to stay deleted after replay")
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, err := reopened.Read(key); err != nil {
+			t.Errorf("Expected %s to be replayed, but got: %v", key, err)
+		}
+	}
+}
+
+// TestCompareAndSwap tests that conditional writes only apply at the expected version
+func TestCompareAndSwap(t *testing.T) {
+	store := newTestStore()
+
+	v1, err := store.CreateIfAbsent("user1", `{"name":"a"}`)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if _, err := store.CreateIfAbsent("user1", `{}`); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Expected ErrKeyExists, but got: %v", err)
+	}
+
+	// Two clients read the same version; only the first write wins.
+	_, read, _ := store.ReadVersion("user1")
+	if read != v1 {
+		t.Errorf("Expected ReadVersion to return %d, but got %d", v1, read)
+	}
+	v2, err := store.CompareAndSwap("user1", read, `{"name":"b"}`)
+	if err != nil || v2 <= v1 {
+		t.Fatalf("Expected the first swap to succeed with a newer version, but got %d (err %v)", v2, err)
+	}
+	if _, err := store.CompareAndSwap("user1", read, `{"name":"c"}`); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Expected ErrVersionMismatch, but got: %v", err)
+	}
+	if value, _ := store.Read("user1"); value != `{"name":"b"}` {
+		t.Errorf("Expected the losing write to be rejected, but got %s", value)
+	}
+
+	if err := store.DeleteIfVersion("user1", v1); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Expected ErrVersionMismatch, but got: %v", err)
+	}
+	if err := store.DeleteIfVersion("user1", v2); err != nil {
+		t.Errorf("Expected no error, but got: %v", err)
+	}
+
+	// A recreated key never reuses a version an earlier reader may hold.
+	v3, _ := store.CreateIfAbsent("user1", `{}`)
+	if v3 <= v2 {
+		t.Errorf("Expected a version after %d, but got %d", v2, v3)
+	}
+}
+
+// TestVersionsSurviveRestart tests that versions and the revision counter are persisted
+func TestVersionsSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store := NewStore(path)
+	store.Create("user1", `{}`)
+	store.Create("user2", `{}`)
+	_, version, _ := store.ReadVersion("user1")
+	store.Delete("user2")
+	latest := store.Revision()
+	store.Save()
+
+	reopened := NewStore(path)
+	if err := reopened.Load(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if _, got, _ := reopened.ReadVersion("user1"); got != version {
+		t.Errorf("Expected version %d after a restart, but got %d", version, got)
+	}
+	if next, _ := reopened.CreateIfAbsent("user2", `{}`); next <= latest {
+		t.Errorf("Expected a version after %d, but got %d", latest, next)
+	}
+}
+
+// TestSingleKeyWritesLockOneShard tests that a write to one key takes only its own
+// shard's lock, and that the revision counter it no longer writes under a key is still
+// recovered from the write-ahead log
+func TestSingleKeyWritesLockOneShard(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store := NewStore(path, WithHistory(2))
+	backend := store.Backend().(*FileBackend)
+
+	// Hold every other shard of both the store and the backend while writing.
+	i := shardIndex("user1", DefaultShards)
+	for j := range DefaultShards {
+		if j != i {
+			store.locks.locks[j].Lock()
+			backend.data.shards[j].mu.Lock()
+		}
+	}
+	done := make(chan error)
+	go func() {
+		err := store.Create("user1", `{"v":1}`)
+		if err == nil {
+			err = store.Delete("user1")
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected no error, but got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a single-key write to need only its own shard")
+	}
+	for j := range DefaultShards {
+		if j != i {
+			store.locks.locks[j].Unlock()
+			backend.data.shards[j].mu.Unlock()
+		}
+	}
+
+	// The delete is only in the log, with no key left holding its revision.
+	latest := store.Revision()
+	reopened := NewStore(path)
+	if err := reopened.Load(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if next, _ := reopened.CreateIfAbsent("user1", `{}`); next <= latest {
+		t.Errorf("Expected a version after %d, but got %d", latest, next)
+	}
+}
+
+// TestHistoryAndRevert tests that writes are kept in a bounded history that can be reverted to
+func TestHistoryAndRevert(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store := NewStore(path, WithHistory(3))
+	alice, bob := store.As("alice"), store.As("bob")
+
+	alice.Create("user1", `{"v":1}`)
+	alice.Update("user1", `{"v":2}`)
+	bob.Update("user1", `{"v":3}`)
+	bob.Delete("user1")
+
+	history, err := store.History("user1")
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("Expected 3 retained revisions, but got %d", len(history))
+	}
+	if !history[0].Deleted || history[0].Author != "bob" {
+		t.Errorf("Expected the newest entry to be bob's delete, but got %+v", history[0])
+	}
+	if history[2].Value != `{"v":2}` || history[2].Author != "alice" {
+		t.Errorf("Expected the oldest retained entry to be alice's update, but got %+v", history[2])
+	}
+
+	// The history survives a restart, and a deleted key can be brought back.
+	store.Save()
+	reopened := NewStore(path, WithHistory(3))
+	if err := reopened.Load(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if _, err := reopened.Revert("user1", history[2].Revision); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if value, _ := reopened.Read("user1"); value != `{"v":2}` {
+		t.Errorf("Expected the reverted value, but got %s", value)
+	}
+	if _, err := reopened.HistoryAt("user1", 1); !errors.Is(err, ErrRevisionNotFound) {
+		t.Errorf("Expected the first revision to have been dropped, but got: %v", err)
+	}
+
+	// History is opt-in, so a store without WithHistory writes no entries at all.
+	plain := NewStore(filepath.Join(t.TempDir(), "store.json"))
+	plain.Create("user1", `{"v":1}`)
+	plain.Update("user1", `{"v":2}`)
+	plain.Backend().Iterate(func(key, value string) bool {
+		if strings.HasPrefix(key, historyKeyPrefix) {
+			t.Errorf("Expected no history entries by default, but found %q", key)
+		}
+		return true
+	})
+	if _, err := plain.History("user1"); !errors.Is(err, ErrHistoryDisabled) {
+		t.Errorf("Expected ErrHistoryDisabled, but got: %v", err)
+	}
+}
+
+// TestCompression tests that compressed files are detected on load and old plain files still load
+func TestCompression(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	plain := NewStore(path)
+	for i := 0; i < 100; i++ {
+		plain.Create(fmt.Sprintf("user%d", i), `{"name": "Alice", "address": {"city": "Springfield"}}`)
+	}
+	plain.Save()
+	before, _ := os.ReadFile(path)
+
+	// A compressing store reads the plain file, then writes it back compressed.
+	compressed := NewStore(path, WithCompression(Gzip))
+	if err := compressed.Load(); err != nil {
+		t.Fatalf("Expected the plain file to load, but got: %v", err)
+	}
+	compressed.Save()
+	after, _ := os.ReadFile(path)
+	if !bytes.HasPrefix(after, Gzip.Magic()) || len(after) >= len(before)/4 {
+		t.Errorf("Expected a gzip file well under %d bytes, but got %d bytes", len(before), len(after))
+	}
+	if err := compressed.Snapshot("nightly"); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	// A store without compression configured still detects it.
+	reopened := NewStore(path)
+	if err := reopened.Load(); err != nil {
+		t.Fatalf("Expected the compressed file to load, but got: %v", err)
+	}
+	reopened.Delete("user1")
+	if err := reopened.Restore("nightly"); err != nil {
+		t.Fatalf("Expected the compressed snapshot to restore, but got: %v", err)
+	}
+	if value, err := reopened.Read("user1"); err != nil || !strings.Contains(value, "Springfield") {
+		t.Errorf("Expected user1 to be restored, but got %q (err %v)", value, err)
+	}
+}
+
+// TestEncryptionAndKeyRotation tests that files and log records are encrypted, and stay readable after rotation
+func TestEncryptionAndKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "keys")
+	os.WriteFile(keyFile, []byte("first:"+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))+"\n"), 0600)
+	keys, err := LoadKeyFile(keyFile)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	path := filepath.Join(dir, "store.json")
+	store := NewStore(path, WithEncryption(keys), WithCompression(Gzip))
+	store.Create("user1", `{"name":"Alice"}`)
+	store.Save()
+	store.Snapshot("before")
+	store.Create("user2", `{"name":"Bob"}`) // Only in the write-ahead log
+
+	for _, file := range []string{path, path + ".wal", filepath.Join(dir, "snapshots", "before.json")} {
+		content, _ := os.ReadFile(file)
+		if bytes.Contains(content, []byte("Alice")) || bytes.Contains(content, []byte("Bob")) {
+			t.Errorf("Expected %s to be encrypted, but found plaintext", file)
+		}
+	}
+
+	id, err := store.RotateKey()
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if content, _ := os.ReadFile(path); !bytes.Contains(content, []byte(id)) {
+		t.Errorf("Expected the data file to name key %s in its header", id)
+	}
+
+	// The rotated key was recorded, and the snapshot under the old key still restores.
+	keys, _ = LoadKeyFile(keyFile)
+	reopened := NewStore(path, WithEncryption(keys))
+	if err := reopened.Load(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := reopened.Restore("before"); err != nil {
+		t.Fatalf("Expected the old snapshot to restore, but got: %v", err)
+	}
+	if _, err := reopened.Read("user1"); err != nil {
+		t.Errorf("Expected user1 after restoring, but got: %v", err)
+	}
+
+	if err := NewStore(path).Load(); !errors.Is(err, ErrNoKeys) {
+		t.Errorf("Expected ErrNoKeys without a keyring, but got: %v", err)
+	}
+}
+
+// TestEncryptionNeedsEncryptingBackend tests that a store refuses to load or write when
+// its backend would keep the data it is given in plaintext
+func TestEncryptionNeedsEncryptingBackend(t *testing.T) {
+	dir := t.TempDir()
+	keys := NewKeyring()
+	keys.Add("first", bytes.Repeat([]byte{7}, 32))
+
+	lsm, err := OpenLSM(filepath.Join(dir, "lsm"), LSMOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer lsm.Close()
+	store := NewStore(filepath.Join(dir, "store.json"), WithBackend(lsm), WithEncryption(keys), WithCache(CacheOptions{MaxBytes: 1 << 20}))
+	if err := store.Load(); !errors.Is(err, ErrEncryptionUnsupported) {
+		t.Errorf("Expected ErrEncryptionUnsupported from Load, but got: %v", err)
+	}
+	if err := store.Create("user1", `{"name":"Alice"}`); !errors.Is(err, ErrEncryptionUnsupported) {
+		t.Errorf("Expected ErrEncryptionUnsupported from Create, but got: %v", err)
+	}
+	if _, err := Open(filepath.Join(dir, "other.json"), WithBackend(NewFileBackend(filepath.Join(dir, "other.json"))), WithEncryption(keys)); !errors.Is(err, ErrEncryptionUnsupported) {
+		t.Errorf("Expected Open to refuse an unencrypted file backend, but got: %v", err)
+	}
+
+	memory := NewStore(filepath.Join(dir, "memory.json"), WithBackend(NewMemoryBackend()), WithEncryption(keys))
+	if err := memory.Create("user1", `{"name":"Alice"}`); err != nil {
+		t.Errorf("Expected a memory backend to be accepted, but got: %v", err)
+	}
+}
+
+// TestDurabilityModes checks when each durability mode saves the data file, and
+// that Close makes a final save.
+func TestDurabilityModes(t *testing.T) {
+	dir := t.TempDir()
+	saved := func(path, key string) bool {
+		content, _ := os.ReadFile(path)
+		return bytes.Contains(content, []byte(key))
+	}
+
+	everyWrite := filepath.Join(dir, "every.json")
+	store := NewStore(everyWrite, WithoutWAL(), WithDurability(DurabilityOptions{Mode: DurabilityEveryWrite}))
+	store.Create("user1", `{"name":"Alice"}`)
+	if !saved(everyWrite, "user1") {
+		t.Errorf("Expected user1 to be saved by the write")
+	}
+	if stats := store.DurabilityStats(); stats.UnsavedWrites != 0 || stats.Saves == 0 {
+		t.Errorf("Expected no unsaved writes after a save, but got %+v", stats)
+	}
+
+	periodic := filepath.Join(dir, "periodic.json")
+	store = NewStore(periodic, WithoutWAL(), WithDurability(DurabilityOptions{Mode: DurabilityPeriodic, Writes: 3}))
+	for i := range 3 {
+		store.Create(fmt.Sprintf("user%d", i), `{}`)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !saved(periodic, "user2") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !saved(periodic, "user2") {
+		t.Errorf("Expected the background saver to save after 3 writes")
+	}
+	store.Close()
+
+	manual := filepath.Join(dir, "manual.json")
+	store = NewStore(manual, WithoutWAL())
+	store.Create("user1", `{}`)
+	store.Create("user2", `{}`)
+	if stats := store.DurabilityStats(); stats.UnsavedWrites != 2 || stats.UnsavedFor <= 0 {
+		t.Errorf("Expected 2 unsaved writes, but got %+v", stats)
+	}
+	if saved(manual, "user1") {
+		t.Errorf("Expected nothing to be saved before Close")
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if !saved(manual, "user2") {
+		t.Errorf("Expected Close to save the store")
+	}
+}
+
+// TestOpenLocking checks that Open locks the data file against other writers, and
+// that read-only stores share it and refuse writes.
+func TestOpenLocking(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+
+	writer, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	writer.Create("user1", `{"name":"Alice"}`)
+
+	if _, err := Open(path); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked for a second writer, but got: %v", err)
+	}
+	if _, err := Open(path, WithReadOnly()); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked for a reader while a writer is open, but got: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	readers := make([]*Store, 2)
+	for i := range readers {
+		if readers[i], err = Open(path, WithReadOnly()); err != nil {
+			t.Fatalf("Expected readers to share the lock, but got: %v", err)
+		}
+	}
+	if value, err := readers[1].Read("user1"); err != nil || value != `{"name":"Alice"}` {
+		t.Errorf("Expected user1 to be readable, but got %q, %v", value, err)
+	}
+	if err := readers[0].Create("user2", `{}`); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly, but got: %v", err)
+	}
+	if err := readers[0].Save(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly from Save, but got: %v", err)
+	}
+	if _, err := Open(path); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked for a writer while readers are open, but got: %v", err)
+	}
+
+	for _, reader := range readers {
+		reader.Close()
+	}
+	writer, err = Open(path)
+	if err != nil {
+		t.Fatalf("Expected the lock to be free after Close, but got: %v", err)
+	}
+	writer.Close()
+}
+
+// TestFsckAndRepair tests that a damaged record only costs its own entry, and that
+// Repair salvages the rest while keeping the original
+func TestFsckAndRepair(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store := NewStore(path, WithoutWAL(), WithHistory(0))
+	for i := 1; i <= 5; i++ {
+		store.Create(fmt.Sprintf("user%d", i), fmt.Sprintf(`{"id": %d}`, i))
+	}
+	store.Backend().Put("broken", "not json")
+	store.Save()
+
+	report, err := Fsck(path)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Key != "broken" {
+		t.Errorf("Expected only the invalid JSON value to be reported, but got %v", report.Problems)
+	}
+
+	// Damage one byte of user3's record.
+	content, _ := os.ReadFile(path)
+	i := bytes.Index(content, []byte(`"user3"`))
+	content[i+2] ^= 0xff
+	os.WriteFile(path, content, 0644)
+
+	if err := NewStore(path, WithoutWAL(), WithBackups(0)).Load(); err == nil {
+		t.Errorf("Expected Load to refuse a damaged file")
+	}
+	if report, _ := Fsck(path); len(report.Problems) != 2 || report.Problems[0].Line == 0 {
+		t.Errorf("Expected the damaged record and the invalid value to be reported, but got %v", report.Problems)
+	}
+
+	repaired, err := Repair(path)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if original, _ := os.ReadFile(repaired.Quarantine); !bytes.Equal(original, content) {
+		t.Errorf("Expected the damaged original to be kept as %s", repaired.Quarantine)
+	}
+
+	reloaded := NewStore(path, WithoutWAL(), WithBackups(0))
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Expected the repaired file to load, but got: %v", err)
+	}
+	if _, err := reloaded.Read("user3"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected user3 to be lost, but got: %v", err)
+	}
+	for _, key := range []string{"user1", "user2", "user4", "user5"} {
+		if _, err := reloaded.Read(key); err != nil {
+			t.Errorf("Expected %s to be salvaged, but got: %v", key, err)
+		}
+	}
+
+	// A file cut short at a line boundary is caught by its trailer.
+	content, _ = os.ReadFile(path)
+	os.WriteFile(path, content[:bytes.LastIndexByte(content[:len(content)-1], '\n')+1], 0644)
+	if report, _ := Fsck(path); report.OK() {
+		t.Errorf("Expected a truncated file to be reported")
+	}
+}
+
+// TestOpenedStoreRepairsItself tests that a store opened with Open repairs its own data
+// file under the lock it holds, which the package-level Repair cannot take
+func TestOpenedStoreRepairsItself(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store := NewStore(path, WithoutWAL(), WithBackups(0))
+	for i := 1; i <= 5; i++ {
+		store.Create(fmt.Sprintf("user%d", i), fmt.Sprintf(`{"id":%d}`, i))
+	}
+	store.Save()
+	content, _ := os.ReadFile(path)
+	i := bytes.Index(content, []byte(`"user3"`))
+	content[i+2] ^= 0xff
+	os.WriteFile(path, content, 0644)
+
+	opened, err := Open(path, WithoutWAL(), WithBackups(0), WithLoadOptions(LoadOptions{SkipMalformed: true}))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer opened.Close()
+	if opened.Path() != path {
+		t.Errorf("Expected the store to report its data file %s, but got %s", path, opened.Path())
+	}
+	if _, err := Repair(path); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked repairing an open store's file, but got: %v", err)
+	}
+
+	report, err := opened.Repair()
+	if err != nil || report.Quarantine == "" {
+		t.Fatalf("Expected the damaged file to be repaired, but got %+v, %v", report, err)
+	}
+	if _, err := opened.Read("user4"); err != nil {
+		t.Errorf("Expected the store to be reloaded from the repaired file, but got: %v", err)
+	}
+	if _, err := opened.Read("user3"); err == nil {
+		t.Errorf("Expected the damaged entry to be gone after the repair")
+	}
+	if err := NewStore(path, WithoutWAL(), WithBackups(0)).Load(); err != nil {
+		t.Errorf("Expected the repaired file to load, but got: %v", err)
+	}
+}
+
+// TestSetRejectsEmptyKey tests that Set refuses an empty key, which would leave a record
+// that no later load could parse
+func TestSetRejectsEmptyKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store := NewStore(path)
+	store.Create("user1", `{"id": 1}`)
+
+	if err := store.Set("", `{"id": 0}`); err == nil {
+		t.Errorf("Expected Set to refuse an empty key")
+	}
+	if err := store.Txn(func(tx *Tx) error { return tx.Set("", `{"id": 0}`) }); err == nil {
+		t.Errorf("Expected Tx.Set to refuse an empty key")
+	}
+	if err := store.Save(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	store.Close()
+
+	reloaded := NewStore(path)
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Expected the store to load, but got: %v", err)
+	}
+	if _, err := reloaded.Read("user1"); err != nil {
+		t.Errorf("Expected user1 to be kept, but got: %v", err)
+	}
+}
+
+// TestFormatMigration tests that files in older formats are reported by a dry run
+// and migrated by Load, with JSON values compacted and other values kept as they were
+func TestFormatMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	legacy := []byte(`{"user1": "{\"name\": \"Alice\"}", "note": "plain text"}`)
+	os.WriteFile(path, legacy, 0644)
+
+	report, err := Migrate(path, true)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if report.From != 0 || report.To != FormatVersion || len(report.Changes) != FormatVersion || report.Applied {
+		t.Errorf("Expected a dry run from version 0 to %d, but got %+v", FormatVersion, report)
+	}
+	if report.NativeValues != 1 || report.StringValues != 1 {
+		t.Errorf("Expected 1 native and 1 string value, but got %+v", report)
+	}
+	if content, _ := os.ReadFile(path); !bytes.Equal(content, legacy) {
+		t.Errorf("Expected a dry run to leave the file alone")
+	}
+
+	store := NewStore(path, WithoutWAL())
+	if err := store.Load(); err != nil {
+		t.Fatalf("Expected the legacy file to load, but got: %v", err)
+	}
+	content, _ := os.ReadFile(path)
+	if !bytes.HasPrefix(content, []byte(fmt.Sprintf("KVSTORE %d\n", FormatVersion))) || !bytes.Contains(content, []byte(`"value":{"name":"Alice"}`)) {
+		t.Errorf("Expected Load to rewrite the file with native JSON values, but got:\n%s", content)
+	}
+	if backup, _ := os.ReadFile(path + ".1"); !bytes.Equal(backup, legacy) {
+		t.Errorf("Expected the legacy file to be kept as a backup")
+	}
+
+	reloaded := NewStore(path, WithoutWAL())
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if value, _ := reloaded.Read("user1"); value != `{"name":"Alice"}` {
+		t.Errorf("Expected the value to survive compacted, but got %q", value)
+	}
+	if value, _, _ := reloaded.Backend().Get("note"); value != "plain text" {
+		t.Errorf("Expected the non-JSON value to survive, but got %q", value)
+	}
+	if report, _ := Migrate(path, true); report.From != FormatVersion || len(report.Changes) != 0 {
+		t.Errorf("Expected nothing left to migrate, but got %+v", report)
+	}
+
+	os.WriteFile(path, []byte("KVSTORE 99\n"), 0644)
+	if err := NewStore(path, WithoutWAL(), WithBackups(0)).Load(); err == nil {
+		t.Errorf("Expected a newer format version to be refused")
+	}
+}
+
+// TestValueWhitespace tests that JSON values are stored compacted, once each, and read
+// back without the whitespace around and within them, eagerly or lazily
+func TestValueWhitespace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	values := map[string]string{
+		"pretty": "{\n  \"name\": \"Alice\",\n  \"tags\": [\"a\", \"b\"]\n}",
+		"padded": `  {"x": 1}  `,
+		"tabbed": "\t{\"x\":1}\t",
+		"spaced": `{"s": "keeps  inner  spaces"}`,
+	}
+	want := map[string]string{
+		"pretty": `{"name":"Alice","tags":["a","b"]}`,
+		"padded": `{"x":1}`,
+		"tabbed": `{"x":1}`,
+		"spaced": `{"s":"keeps  inner  spaces"}`,
+	}
+	store := NewStore(path, WithoutWAL(), WithBackups(0))
+	for key, value := range values {
+		store.Create(key, value)
+	}
+	store.Save()
+
+	content, _ := os.ReadFile(path)
+	if !bytes.Contains(content, []byte(`"value":{"name":"Alice","tags":["a","b"]}}`)) || bytes.Contains(content, []byte(`"text"`)) {
+		t.Errorf("Expected each value stored once, as compact native JSON, but got:\n%s", content)
+	}
+	for _, opts := range []LoadOptions{{}, {Lazy: true}} {
+		reloaded := NewStore(path, WithoutWAL(), WithLoadOptions(opts))
+		if err := reloaded.Load(); err != nil {
+			t.Fatalf("Expected no error, but got: %v", err)
+		}
+		for key, expected := range want {
+			if value, _ := reloaded.Read(key); value != expected {
+				t.Errorf("Expected %s to read back as %q with %+v, but got %q", key, expected, opts, value)
+			}
+		}
+		reloaded.Close()
+	}
+}
+
+// TestBinaryFormat tests that binary files load under any configured format, with or
+// without compression, convert to and from JSON, and are covered by fsck and repair
+func TestBinaryFormat(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "store.bin")
+	store := NewStore(path, WithoutWAL(), WithBackups(0), WithSnapshotFormat(FormatBinary))
+	for i := 0; i < 100; i++ {
+		store.Create(fmt.Sprintf("user%d", i), fmt.Sprintf(`{"id":%d}`, i))
+	}
+	store.Backend().Put("note", "two\nlines")
+	store.Save()
+	store.Snapshot("nightly")
+
+	content, _ := os.ReadFile(path)
+	if !bytes.HasPrefix(content, binaryMagic) {
+		t.Fatalf("Expected a binary file, but got %q", content[:min(len(content), 16)])
+	}
+
+	check := func(path string, opts ...Option) {
+		t.Helper()
+		reloaded := NewStore(path, append(opts, WithoutWAL(), WithBackups(0))...)
+		if err := reloaded.Load(); err != nil {
+			t.Fatalf("Expected %s to load, but got: %v", path, err)
+		}
+		if value, _ := reloaded.Read("user42"); value != `{"id":42}` {
+			t.Errorf("Expected user42 in %s, but got %q", path, value)
+		}
+		if value, _, _ := reloaded.Backend().Get("note"); value != "two\nlines" {
+			t.Errorf("Expected the note in %s, but got %q", path, value)
+		}
+	}
+	check(path)
+
+	compressed := filepath.Join(dir, "compressed.bin")
+	jsonPath := filepath.Join(dir, "store.json")
+	if err := ConvertSnapshot(path, compressed, FormatBinary, WithCompression(Gzip)); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := ConvertSnapshot(compressed, jsonPath, FormatJSON); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if content, _ := os.ReadFile(jsonPath); !bytes.HasPrefix(content, []byte("KVSTORE ")) {
+		t.Errorf("Expected a JSON file, but got %q", content[:min(len(content), 16)])
+	}
+	check(compressed)
+	check(jsonPath, WithSnapshotFormat(FormatBinary))
+
+	if err := store.Restore("nightly"); err != nil {
+		t.Errorf("Expected the binary snapshot to restore, but got: %v", err)
+	}
+
+	// Damage a record in the middle; the records before it are salvaged.
+	before, _ := Fsck(path)
+	content[len(content)/2] ^= 0xff
+	os.WriteFile(path, content, 0644)
+	if err := NewStore(path, WithoutWAL(), WithBackups(0)).Load(); err == nil {
+		t.Errorf("Expected Load to refuse a damaged file")
+	}
+	repaired, err := Repair(path)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if repaired.Quarantine == "" || repaired.Salvaged == 0 || repaired.Salvaged >= before.Entries {
+		t.Errorf("Expected part of the file to be salvaged, but got %+v", repaired)
+	}
+	if content, _ := os.ReadFile(path); !bytes.HasPrefix(content, binaryMagic) {
+		t.Errorf("Expected the repaired file to stay binary")
+	}
+}
+
+// TestStreamingLoad tests that Load reports progress, can skip damaged entries, and can
+// leave values in the file until they are first read
+func TestStreamingLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	pad := strings.Repeat("x", 8<<10)
+	store := NewStore(path, WithBackups(0))
+	for i := 0; i < 200; i++ {
+		store.Create(fmt.Sprintf("user%d", i), fmt.Sprintf(`{"id":%d,"pad":%q}`, i, pad))
+	}
+	store.Save()
+	store.Close()
+
+	var reports []LoadProgress
+	progress := NewStore(path, WithBackups(0), WithLoadOptions(LoadOptions{
+		Progress: func(p LoadProgress) { reports = append(reports, p) },
+	}))
+	if err := progress.Load(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	progress.Close()
+	if len(reports) < 2 {
+		t.Fatalf("Expected several progress reports, but got %d", len(reports))
+	}
+	if last := reports[len(reports)-1]; last.BytesRead != last.TotalBytes || last.Entries < 200 {
+		t.Errorf("Expected the last report to cover the whole file, but got %+v", last)
+	}
+
+	// Only keys are read at startup; each value is read from the file when first needed.
+	lazy := NewStore(path, WithBackups(0), WithLoadOptions(LoadOptions{Lazy: true}))
+	if err := lazy.Load(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	sh := lazy.Backend().(*FileBackend).data.shardFor("user42")
+	if _, deferred := sh.lazy["user42"]; !deferred {
+		t.Errorf("Expected user42 not to be loaded yet")
+	}
+	if value, _ := lazy.Read("user42"); !strings.HasPrefix(value, `{"id":42,`) {
+		t.Errorf("Expected user42 to be read from the file, but got %.20q", value)
+	}
+	if _, deferred := sh.lazy["user42"]; deferred {
+		t.Errorf("Expected user42 to be kept in memory once read")
+	}
+	if stats, _ := lazy.Stats(); stats.Keys != 200 {
+		t.Errorf("Expected 200 keys, but got %d", stats.Keys)
+	}
+
+	// Writes to lazily loaded keys go through the log and survive a checkpoint.
+	lazy.Update("user1", `{"id":"one"}`)
+	lazy.Delete("user2")
+	lazy.Close()
+	lazy = NewStore(path, WithBackups(0), WithLoadOptions(LoadOptions{Lazy: true}))
+	lazy.Load()
+	lazy.Save()
+	if value, _ := lazy.Read("user1"); value != `{"id":"one"}` {
+		t.Errorf("Expected the update to be replayed, but got %.20q", value)
+	}
+	if _, err := lazy.Read("user2"); err == nil {
+		t.Errorf("Expected the delete to be replayed")
+	}
+	if value, _ := lazy.Read("user3"); !strings.HasPrefix(value, `{"id":3,`) {
+		t.Errorf("Expected user3 to survive the checkpoint, but got %.20q", value)
+	}
+	lazy.Close()
+
+	// A damaged entry fails the load unless it is skipped.
+	content, _ := os.ReadFile(path)
+	content = bytes.Replace(content, []byte(`{"id":7,`), []byte(`{"id":8,`), 1)
+	os.WriteFile(path, content, 0644)
+	if err := NewStore(path, WithoutWAL(), WithBackups(0)).Load(); err == nil {
+		t.Errorf("Expected Load to refuse a damaged file")
+	}
+	var problems []FsckProblem
+	skipping := NewStore(path, WithoutWAL(), WithBackups(0), WithLoadOptions(LoadOptions{
+		SkipMalformed: true,
+		Malformed:     func(p FsckProblem) { problems = append(problems, p) },
+	}))
+	if err := skipping.Load(); err != nil {
+		t.Fatalf("Expected damaged entries to be skipped, but got: %v", err)
+	}
+	if len(problems) != 1 || problems[0].Line == 0 {
+		t.Errorf("Expected one damaged record, but got %v", problems)
+	}
+	if _, err := skipping.Read("user7"); err == nil {
+		t.Errorf("Expected the damaged entry to be skipped")
+	}
+	if value, _ := skipping.Read("user8"); !strings.HasPrefix(value, `{"id":8,`) {
+		t.Errorf("Expected the other entries to load, but got %.20q", value)
+	}
+}
+
+// TestSecondaryIndexes tests that indexes on JSON paths follow every write, answer
+// equality and range lookups, and are rebuilt on load
+func TestSecondaryIndexes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store := NewStore(path)
+	store.Create("ada", `{"age": 36, "email": "ada@example.com"}`)
+	store.Create("bob", `{"age": 25, "email": "bob@example.com"}`)
+	store.Create("cy", `{"age": 41}`)
+	store.Create("dee", `{"age": "unknown"}`)
+
+	if err := store.CreateIndex("$.age"); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := store.CreateIndex(`$["email"]`); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := store.CreateIndex("$.email"); !errors.Is(err, ErrIndexExists) {
+		t.Errorf("Expected ErrIndexExists, but got: %v", err)
+	}
+
+	expect := func(name string, keys []string, err error, want ...string) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: expected no error, but got: %v", name, err)
+		}
+		if !slices.Equal(keys, want) && !(len(keys) == 0 && len(want) == 0) {
+			t.Errorf("%s: expected %v, but got %v", name, want, keys)
+		}
+	}
+	keys, err := store.LookupRange("$.age", IndexRange{Min: "30", ExcludeMin: true})
+	expect("age > 30", keys, err, "ada", "cy")
+	keys, err = store.LookupRange("$.age", IndexRange{Max: "36"})
+	expect("age <= 36", keys, err, "bob", "ada")
+	keys, err = store.Lookup("$.email", `"bob@example.com"`)
+	expect("email", keys, err, "bob")
+	keys, err = store.Lookup("$.age", `"unknown"`)
+	expect("age unknown", keys, err, "dee")
+
+	// Writes of every kind keep the indexes in step.
+	store.Update("bob", `{"age": 52}`)
+	store.Delete("cy")
+	store.Txn(func(tx *Tx) error {
+		return tx.Create("eve", `{"age": 33, "email": "eve@example.com"}`)
+	})
+	keys, err = store.LookupRange("$.age", IndexRange{Min: "30"})
+	expect("age >= 30 after writes", keys, err, "eve", "ada", "bob")
+	keys, err = store.Lookup("$.email", `"bob@example.com"`)
+	expect("email after update", keys, err)
+
+	if _, err := store.Lookup("$.name", `"ada"`); !errors.Is(err, ErrIndexNotFound) {
+		t.Errorf("Expected ErrIndexNotFound, but got: %v", err)
+	}
+	if _, err := store.LookupRange("$.age", IndexRange{Min: "1", Max: `"z"`}); err == nil {
+		t.Errorf("Expected bounds of different types to be refused")
+	}
+
+	// Declarations are persisted, so Load rebuilds the indexes from the data.
+	store.Save()
+	store.Close()
+	reloaded := NewStore(path)
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if indexes := reloaded.Indexes(); len(indexes) != 2 || indexes[0].Path != "$.age" || indexes[0].Entries != 4 {
+		t.Errorf("Expected the indexes to be rebuilt, but got %+v", indexes)
+	}
+	keys, err = reloaded.LookupRange("$.age", IndexRange{Min: "30", Max: "40"})
+	expect("age in [30, 40] after load", keys, err, "eve", "ada")
+
+	// Clearing the data keeps the indexes declared.
+	reloaded.Clear()
+	reloaded.Create("fay", `{"age": 30}`)
+	keys, err = reloaded.Lookup("$.age", "30")
+	expect("age after clear", keys, err, "fay")
+	if err := reloaded.DropIndex("$.age"); err != nil {
+		t.Errorf("Expected no error, but got: %v", err)
+	}
+	if _, err := reloaded.Lookup("$.age", "30"); !errors.Is(err, ErrIndexNotFound) {
+		t.Errorf("Expected the dropped index to be gone, but got: %v", err)
+	}
+	reloaded.Close()
+}
+
+// TestFind tests that queries filter, sort, page and project documents
+func TestFind(t *testing.T) {
+	store := NewStore(filepath.Join(t.TempDir(), "store.json"))
+	store.Create("ada", `{"name": "Ada", "age": 36, "tags": ["math", "code"], "address": {"city": "London"}}`)
+	store.Create("alan", `{"name": "Alan", "age": 41, "tags": ["code"], "password": "secret"}`)
+	store.Create("bob", `{"name": "Bob", "age": 25, "address": {"city": "Paris"}}`)
+	store.Create("cy", `{"name": "Cy", "age": "unknown"}`)
+
+	find := func(name string, q Query, want ...string) []Document {
+		t.Helper()
+		docs, err := store.Find(q)
+		if err != nil {
+			t.Fatalf("%s: expected no error, but got: %v", name, err)
+		}
+		var keys []string
+		for _, doc := range docs {
+			keys = append(keys, doc.Key)
+		}
+		if !slices.Equal(keys, want) {
+			t.Errorf("%s: expected %v, but got %v", name, want, keys)
+		}
+		return docs
+	}
+	filter := func(s string) map[string]any {
+		var f map[string]any
+		if err := json.Unmarshal([]byte(s), &f); err != nil {
+			t.Fatalf("Invalid filter %s: %v", s, err)
+		}
+		return f
+	}
+
+	find("all", Query{}, "ada", "alan", "bob", "cy")
+	find("$gt and $regex", Query{Filter: filter(`{"age": {"$gt": 30}, "name": {"$regex": "^A"}}`)}, "ada", "alan")
+	find("$in on array", Query{Filter: filter(`{"tags": {"$in": ["math", "art"]}}`)}, "ada")
+	find("array element", Query{Filter: filter(`{"tags": "code"}`)}, "ada", "alan")
+	find("$exists", Query{Filter: filter(`{"address.city": {"$exists": false}}`)}, "alan", "cy")
+	find("$or", Query{Filter: filter(`{"$or": [{"age": {"$lt": 30}}, {"address.city": "London"}]}`)}, "ada", "bob")
+	find("$and", Query{Filter: filter(`{"$and": [{"age": {"$gte": 25}}, {"age": {"$lte": 36}}]}`)}, "ada", "bob")
+	find("$regex $options", Query{Filter: filter(`{"name": {"$regex": "^a", "$options": "i"}}`)}, "ada", "alan")
+	find("sort", Query{Sort: []string{"-age"}, Filter: filter(`{"age": {"$gt": 0}}`)}, "alan", "ada", "bob")
+	find("skip and limit", Query{Sort: []string{"name"}, Skip: 1, Limit: 2}, "alan", "bob")
+
+	docs := find("include", Query{Filter: filter(`{"name": "Ada"}`), Projection: Projection{"name": true, "address.city": true}}, "ada")
+	if want := `{"address":{"city":"London"},"name":"Ada"}`; string(docs[0].Value) != want {
+		t.Errorf("Expected %s, but got %s", want, docs[0].Value)
+	}
+	docs = find("exclude", Query{Filter: filter(`{"name": "Alan"}`), Projection: Projection{"password": false, "tags": false}}, "alan")
+	if want := `{"age":41,"name":"Alan"}`; string(docs[0].Value) != want {
+		t.Errorf("Expected %s, but got %s", want, docs[0].Value)
+	}
+
+	// Conditions on an indexed field read only the keys the index finds, and must
+	// match exactly what a scan does.
+	if err := store.CreateIndex("$.age"); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := store.CreateIndex("$.tags"); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	find("indexed $gt", Query{Filter: filter(`{"age": {"$gt": 30}, "name": {"$regex": "^A"}}`)}, "ada", "alan")
+	find("indexed equality", Query{Filter: filter(`{"age": "unknown"}`)}, "cy")
+	find("indexed array element", Query{Filter: filter(`{"tags": "code"}`)}, "ada", "alan")
+
+	for _, q := range []Query{
+		{Filter: filter(`{"age": {"$unknown": 1}}`)},
+		{Filter: filter(`{"$or": {"age": 1}}`)},
+		{Filter: filter(`{"name": {"$regex": "("}}`)},
+		{Projection: Projection{"name": true, "age": false}},
+		{Limit: -1},
+	} {
+		if _, err := store.Find(q); err == nil {
+			t.Errorf("Expected an error for query %+v", q)
+		}
+	}
+}
+
+// TestReadPath tests that JSON Pointer and JSON path expressions select parts of a document
+func TestReadPath(t *testing.T) {
+	store := NewStore(filepath.Join(t.TempDir(), "store.json"))
+	store.Create("user1", `{"name": "Ada", "age": 36.50, "address": {"city": "London"}, "tags": ["math", "code"], "a/b": {"~": true}}`)
+
+	for path, want := range map[string]string{
+		"/address/city":  `"London"`,
+		"$.address.city": `"London"`,
+		".address.city":  `"London"`,
+		`$["address"]`:   `{"city":"London"}`,
+		"/tags/1":        `"code"`,
+		".tags[0]":       `"math"`,
+		"/age":           `36.50`,
+		"/a~1b/~0":       `true`,
+		"$":              `{"a/b":{"~":true},"address":{"city":"London"},"age":36.50,"name":"Ada","tags":["math","code"]}`,
+	} {
+		got, err := store.ReadPath("user1", path)
+		if err != nil {
+			t.Errorf("%s: expected no error, but got: %v", path, err)
+		} else if got != want {
+			t.Errorf("%s: expected %s, but got %s", path, want, got)
+		}
+	}
+
+	for path, want := range map[string]string{
+		"/address/zip": `$.address has no member "zip"`,
+		".tags[5]":     "$.tags has no element 5, only 2",
+		"/name/first":  "$.name is a string, not an object or array",
+		"$.address[0]": "$.address is an object, not an array",
+	} {
+		_, err := store.ReadPath("user1", path)
+		if !errors.Is(err, ErrPathNotFound) || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected ErrPathNotFound saying %q, but got: %v", path, want, err)
+		}
+	}
+
+	for _, path := range []string{"address.city", "/a~2", "$.tags[x]"} {
+		if _, err := store.ReadPath("user1", path); err == nil || errors.Is(err, ErrPathNotFound) {
+			t.Errorf("%s: expected the path to be refused, but got: %v", path, err)
+		}
+	}
+	if _, err := store.ReadPath("user2", "/name"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, but got: %v", err)
+	}
+}
+
+// benchmarkProcs lists the GOMAXPROCS settings the parallel benchmarks run at
+var benchmarkProcs = []int{1, 2, 4, 8}
+
+// benchmarkKeys returns n distinct keys for the parallel benchmarks
+func benchmarkKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user%d", i)
+	}
+	return keys
+}
+
+// BenchmarkStoreParallel measures mixed read/update throughput through Store.
+// shards=1 is equivalent to the previous single RWMutex.
+func BenchmarkStoreParallel(b *testing.B) {
+	keys := benchmarkKeys(1024)
+	for _, shards := range []int{1, DefaultShards} {
+		for _, procs := range benchmarkProcs {
+			b.Run(fmt.Sprintf("shards=%d/procs=%d", shards, procs), func(b *testing.B) {
+				defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+
+				store := NewStore("", WithBackend(NewShardedMemoryBackend(shards)), WithShards(shards))
+				for _, key := range keys {
+					store.Set(key, `{"n": 1}`)
+				}
+
+				var seed atomic.Uint64
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					i := seed.Add(1) * 7919 // Spread goroutines over different keys
+					for pb.Next() {
+						key := keys[i%uint64(len(keys))]
+						if i%4 == 0 {
+							store.Update(key, `{"n": 2}`)
+						} else {
+							store.Read(key)
+						}
+						i++
+					}
+				})
+			})
+		}
+	}
+}
+
+// BenchmarkJSONStoreParallel measures mixed read/update throughput through JSONStore.
+func BenchmarkJSONStoreParallel(b *testing.B) {
+	keys := benchmarkKeys(1024)
+	for _, shards := range []int{1, DefaultShards} {
+		for _, procs := range benchmarkProcs {
+			b.Run(fmt.Sprintf("shards=%d/procs=%d", shards, procs), func(b *testing.B) {
+				defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+
+				store := NewShardedJSONStore(shards)
+				for _, key := range keys {
+					store.Add(key, `{"n": 1}`)
+				}
+
+				var seed atomic.Uint64
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					i := seed.Add(1) * 7919 // Spread goroutines over different keys
+					for pb.Next() {
+						key := keys[i%uint64(len(keys))]
+						if i%4 == 0 {
+							store.Update(key, `{"n": 2}`)
+						} else {
+							store.Get(key)
+						}
+						i++
+					}
+				})
+			})
+		}
+	}
+}
+
+// benchmarkSnapshotEntries is the number of entries in the Load and Save benchmarks
+const benchmarkSnapshotEntries = 100000
+
+// benchmarkSnapshotStore returns a store in dir holding benchmarkSnapshotEntries
+// entries, saved in format
+func benchmarkSnapshotStore(b *testing.B, dir string, format SnapshotFormat) *Store {
+	b.Helper()
+	store := NewStore(filepath.Join(dir, "store"), WithoutWAL(), WithBackups(0), WithHistory(0), WithSnapshotFormat(format))
+	for i := 0; i < benchmarkSnapshotEntries; i++ {
+		store.Backend().Put(fmt.Sprintf("user%d", i), fmt.Sprintf(`{"id": %d, "name": "User %d", "address": {"city": "Springfield"}}`, i, i))
+	}
+	if err := store.Save(); err != nil {
+		b.Fatalf("Failed to save: %v", err)
+	}
+	return store
+}
+
+// BenchmarkLoad measures loading a saved store in the JSON and binary formats
+func BenchmarkLoad(b *testing.B) {
+	for _, format := range []SnapshotFormat{FormatJSON, FormatBinary} {
+		b.Run("format="+format.String(), func(b *testing.B) {
+			dir := b.TempDir()
+			benchmarkSnapshotStore(b, dir, format)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				store := NewStore(filepath.Join(dir, "store"), WithoutWAL(), WithHistory(0))
+				if err := store.Load(); err != nil {
+					b.Fatalf("Failed to load: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSave measures saving a store in the JSON and binary formats
+func BenchmarkSave(b *testing.B) {
+	for _, format := range []SnapshotFormat{FormatJSON, FormatBinary} {
+		b.Run("format="+format.String(), func(b *testing.B) {
+			store := benchmarkSnapshotStore(b, b.TempDir(), format)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := store.Save(); err != nil {
+					b.Fatalf("Failed to save: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// TestSnapshotAndRestore tests that a named snapshot can be listed, restored and deleted
+func TestSnapshotAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	store := NewStore(filepath.Join(dir, "store.json"))
+	store.Create("user1", `{"name": "Alice"}`)
+	store.Create("user2", `{"name": "Bob"}`)
+
+	if err := store.Snapshot("before"); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := store.Snapshot("before"); err == nil {
+		t.Errorf("Expected an error for a duplicate snapshot name, but got none")
+	}
+	if err := store.Snapshot("../escape"); err == nil {
+		t.Errorf("Expected an error for an invalid snapshot name, but got none")
+	}
+
+	store.Update("user1", `{"name": "Carol"}`)
+	store.Delete("user2")
+	store.Create("user3", `{"name": "Dave"}`)
+
+	if err := store.Restore("before"); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if value, _ := store.Read("user1"); value != `{"name":"Alice"}` {
+		t.Errorf("Expected restored value for user1, but got %q", value)
+	}
+	if _, err := store.Read("user2"); err != nil {
+		t.Errorf("Expected user2 to be restored, but got: %v", err)
+	}
+	if _, err := store.Read("user3"); err == nil {
+		t.Errorf("Expected user3 to be removed by the restore")
+	}
+
+	snapshots, err := store.ListSnapshots()
+	if err != nil || len(snapshots) != 1 || snapshots[0].Name != "before" {
+		t.Errorf("Expected one snapshot named 'before', but got %v (err %v)", snapshots, err)
+	}
+	if err := store.DeleteSnapshot("before"); err != nil {
+		t.Errorf("Expected no error, but got: %v", err)
+	}
+	if err := store.Restore("before"); err == nil {
+		t.Errorf("Expected an error restoring a deleted snapshot, but got none")
+	}
+}
+
+// batchFailingBackend is an in-memory backend whose batches fail once fail is set
+type batchFailingBackend struct {
+	*MemoryBackend
+	fail bool
+}
+
+// WriteBatch fails if fail is set, and applies the batch otherwise
+func (b *batchFailingBackend) WriteBatch(ops []BatchOp) error {
+	if b.fail {
+		return errors.New("disk full")
+	}
+	return b.MemoryBackend.WriteBatch(ops)
+}
+
+// WriteBatchAt fails like WriteBatch
+func (b *batchFailingBackend) WriteBatchAt(rev uint64, ops []BatchOp) error {
+	return b.WriteBatch(ops)
+}
+
+// TestRestoreIsAtomic tests that a restore that cannot be written leaves the current
+// data in place, and that a read-only store cannot delete snapshots
+func TestRestoreIsAtomic(t *testing.T) {
+	dir := t.TempDir()
+	backend := &batchFailingBackend{MemoryBackend: NewMemoryBackend()}
+	store := NewStore(filepath.Join(dir, "store.json"), WithBackend(backend))
+	store.Create("user1", `{"name": "Alice"}`)
+	if err := store.Snapshot("before"); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	store.Update("user1", `{"name": "Carol"}`)
+	store.Create("user2", `{"name": "Bob"}`)
+
+	backend.fail = true
+	if err := store.Restore("before"); err == nil {
+		t.Fatalf("Expected the restore to fail")
+	}
+	backend.fail = false
+	if value, _ := store.Read("user1"); value != `{"name": "Carol"}` {
+		t.Errorf("Expected user1 to keep its current value, but got %q", value)
+	}
+	if _, err := store.Read("user2"); err != nil {
+		t.Errorf("Expected user2 to be kept, but got: %v", err)
+	}
+
+	reader := NewStore(filepath.Join(dir, "store.json"), WithBackend(NewMemoryBackend()), WithReadOnly())
+	if err := reader.DeleteSnapshot("before"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly, but got: %v", err)
+	}
+	if snapshots, _ := store.ListSnapshots(); len(snapshots) != 1 {
+		t.Errorf("Expected the snapshot to be kept, but got %v", snapshots)
+	}
+}
+
+// TestRestoreGivesNewVersions tests that restored keys get the restore's revision as
+// their version, so a version read before the restore no longer matches, and that keys
+// the restore removes lose their version
+func TestRestoreGivesNewVersions(t *testing.T) {
+	store := NewStore(filepath.Join(t.TempDir(), "store.json"))
+	v1, _ := store.CreateWithTTL("user1", `{"v":1}`, 0)
+	store.Snapshot("before")
+	store.Update("user1", `{"v":2}`)
+	store.Create("user2", `{"v":1}`)
+
+	if err := store.Restore("before"); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	_, version, err := store.ReadVersion("user1")
+	if err != nil || version <= v1 {
+		t.Fatalf("Expected user1 at a version after %d, but got %d, %v", v1, version, err)
+	}
+	if _, err := store.CompareAndSwap("user1", v1, `{"v":3}`); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Expected a stale version to be refused after the restore, but got: %v", err)
+	}
+	if _, err := store.CompareAndSwap("user1", version, `{"v":3}`); err != nil {
+		t.Errorf("Expected the restored version to match, but got: %v", err)
+	}
+	if _, found, _ := store.Backend().Get(versionKey("user2")); found {
+		t.Errorf("Expected the version of a key the restore removed to be deleted")
+	}
+}
+
+// TestSnapshotDuringWrites tests that snapshots can be taken while writers are active
+func TestSnapshotDuringWrites(t *testing.T) {
+	store := NewStore("", WithBackend(NewMemoryBackend()), WithSnapshotDir(t.TempDir()))
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				store.Set(fmt.Sprintf("w%d-%d", w, i), `{}`)
+			}
+		}(w)
+	}
+	for i := 0; i < 5; i++ {
+		if err := store.Snapshot(fmt.Sprintf("snap%d", i)); err != nil {
+			t.Errorf("Expected no error, but got: %v", err)
+		}
+	}
+	wg.Wait()
+
+	if err := store.Restore("snap4"); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	snapshots, _ := store.ListSnapshots()
+	if len(snapshots) != 5 {
+		t.Errorf("Expected 5 snapshots, but got %d", len(snapshots))
+	}
+}
+
 // Utility function to create a new store instance
-func NewStore() *Store {
+func newTestStore() *Store {
 	return &Store{
-		data:     make(map[string]string),
-		filePath: "data/store.json",
+		backend: &FileBackend{
+			data: newShardedMap(1),
+			path: "data/store.json",
+		},
+		locks:      newStripedLock(1),
+		versions:   newVersionLog(0),
+		expiries:   newExpiryTable(),
+		namespaces: newNamespaceSet("data/namespaces", buildOptions(nil)),
+		history:    newHistoryIndex(DefaultHistoryLimit),
+		indexes:    newIndexSet(),
+		durability: newDurability(DurabilityOptions{}),
 	}
 }
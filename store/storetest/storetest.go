@@ -0,0 +1,230 @@
+// Package storetest provides a conformance suite for implementations of store.Backend.
+// A third-party backend can be checked against the same expectations as the built-in
+// ones by calling Suite.Run from its own tests:
+//
+//	func TestMyBackend(t *testing.T) {
+//		storetest.Suite{
+//			Open:       func(t *testing.T, dir string) store.Backend { return mybackend.Open(dir) },
+//			Persistent: true,
+//		}.Run(t)
+//	}
+package storetest
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"json-key-value-store/store"
+)
+
+// Suite describes the backend under test.
+type Suite struct {
+	// Open returns a backend whose storage lives in dir. The suite calls it with a fresh
+	// directory for every test, and again with the same directory to test reopening.
+	Open func(t *testing.T, dir string) store.Backend
+
+	// Persistent reports whether data written before Close is expected to be visible
+	// after the backend is reopened on the same directory.
+	Persistent bool
+}
+
+// Run runs every conformance test against the backend.
+func (s Suite) Run(t *testing.T) {
+	t.Run("PutGet", s.testPutGet)
+	t.Run("Overwrite", s.testOverwrite)
+	t.Run("Delete", s.testDelete)
+	t.Run("Iterate", s.testIterate)
+	t.Run("IterateStop", s.testIterateStop)
+	t.Run("Concurrent", s.testConcurrent)
+	if s.Persistent {
+		t.Run("Reopen", s.testReopen)
+	}
+}
+
+// open opens a backend in a fresh directory and closes it when the test ends.
+func (s Suite) open(t *testing.T) store.Backend {
+	t.Helper()
+	b := s.Open(t, t.TempDir())
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func (s Suite) testPutGet(t *testing.T) {
+	b := s.open(t)
+
+	if _, found, err := b.Get("missing"); err != nil || found {
+		t.Fatalf("Get on missing key: found=%v err=%v, want not found", found, err)
+	}
+
+	mustPut(t, b, "user1", `{"name": "John"}`)
+	expectValue(t, b, "user1", `{"name": "John"}`)
+}
+
+func (s Suite) testOverwrite(t *testing.T) {
+	b := s.open(t)
+
+	mustPut(t, b, "user1", `{"age": 30}`)
+	mustPut(t, b, "user1", `{"age": 31}`)
+	expectValue(t, b, "user1", `{"age": 31}`)
+}
+
+func (s Suite) testDelete(t *testing.T) {
+	b := s.open(t)
+
+	mustPut(t, b, "user1", `{}`)
+	if err := b.Delete("user1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, found, err := b.Get("user1"); err != nil || found {
+		t.Errorf("Get after Delete: found=%v err=%v, want not found", found, err)
+	}
+	if err := b.Delete("never-existed"); err != nil {
+		t.Errorf("Delete on missing key: %v, want nil", err)
+	}
+}
+
+func (s Suite) testIterate(t *testing.T) {
+	b := s.open(t)
+
+	want := map[string]string{}
+	for i := 0; i < 50; i++ {
+		key, value := fmt.Sprintf("key%02d", i), fmt.Sprintf(`{"n": %d}`, i)
+		mustPut(t, b, key, value)
+		want[key] = value
+	}
+	if err := b.Delete("key07"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	delete(want, "key07")
+
+	got := map[string]string{}
+	if err := b.Iterate(func(key, value string) bool {
+		if _, dup := got[key]; dup {
+			t.Errorf("Iterate visited %q twice", key)
+		}
+		got[key] = value
+		return true
+	}); err != nil {
+		t.Fatalf("Iterate: %v", err)
+	}
+
+	if len(got) != len(want) {
+		t.Errorf("Iterate visited %d keys, want %d", len(got), len(want))
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("Iterate %q = %q, want %q", key, got[key], value)
+		}
+	}
+}
+
+func (s Suite) testIterateStop(t *testing.T) {
+	b := s.open(t)
+
+	for i := 0; i < 10; i++ {
+		mustPut(t, b, fmt.Sprintf("key%d", i), `{}`)
+	}
+
+	visited := 0
+	if err := b.Iterate(func(string, string) bool {
+		visited++
+		return visited < 3
+	}); err != nil {
+		t.Fatalf("Iterate: %v", err)
+	}
+	if visited != 3 {
+		t.Errorf("Iterate visited %d keys after fn returned false, want 3", visited)
+	}
+}
+
+func (s Suite) testConcurrent(t *testing.T) {
+	b := s.open(t)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("w%d-k%d", w, i)
+				if err := b.Put(key, `{}`); err != nil {
+					t.Errorf("Put: %v", err)
+					return
+				}
+				if _, found, err := b.Get(key); err != nil || !found {
+					t.Errorf("Get %q after Put: found=%v err=%v", key, found, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	var keys []string
+	b.Iterate(func(key, _ string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	sort.Strings(keys)
+	if len(keys) != 8*50 {
+		t.Errorf("Iterate after concurrent writes found %d keys, want %d", len(keys), 8*50)
+	}
+}
+
+func (s Suite) testReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	b := s.Open(t, dir)
+	if p, ok := b.(store.Persister); ok {
+		if err := p.Load(); err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+	}
+	mustPut(t, b, "kept", `{"v":1}`)
+	mustPut(t, b, "gone", `{"v": 2}`)
+	if err := b.Delete("gone"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if p, ok := b.(store.Persister); ok {
+		if err := p.Save(); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	b = s.Open(t, dir)
+	defer b.Close()
+	if p, ok := b.(store.Persister); ok {
+		if err := p.Load(); err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+	}
+	expectValue(t, b, "kept", `{"v":1}`)
+	if _, found, _ := b.Get("gone"); found {
+		t.Errorf("deleted key %q is visible after reopening", "gone")
+	}
+}
+
+// mustPut stores a value or fails the test.
+func mustPut(t *testing.T, b store.Backend, key, value string) {
+	t.Helper()
+	if err := b.Put(key, value); err != nil {
+		t.Fatalf("Put(%q): %v", key, err)
+	}
+}
+
+// expectValue checks that key holds value.
+func expectValue(t *testing.T, b store.Backend, key, value string) {
+	t.Helper()
+	got, found, err := b.Get(key)
+	if err != nil || !found {
+		t.Fatalf("Get(%q): found=%v err=%v", key, found, err)
+	}
+	if got != value {
+		t.Errorf("Get(%q) = %q, want %q", key, got, value)
+	}
+}
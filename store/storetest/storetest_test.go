@@ -0,0 +1,71 @@
+package storetest_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"json-key-value-store/store"
+	"json-key-value-store/store/storetest"
+)
+
+// TestMemoryBackend runs the conformance suite against the in-memory backend.
+func TestMemoryBackend(t *testing.T) {
+	storetest.Suite{
+		Open: func(t *testing.T, dir string) store.Backend {
+			return store.NewMemoryBackend()
+		},
+	}.Run(t)
+}
+
+// TestFileBackend runs the conformance suite against the JSON file backend.
+func TestFileBackend(t *testing.T) {
+	storetest.Suite{
+		Open: func(t *testing.T, dir string) store.Backend {
+			return store.NewFileBackend(filepath.Join(dir, "store.json"))
+		},
+		Persistent: true,
+	}.Run(t)
+}
+
+// TestBitcask runs the conformance suite against the Bitcask engine.
+func TestBitcask(t *testing.T) {
+	storetest.Suite{
+		Open: func(t *testing.T, dir string) store.Backend {
+			b, err := store.OpenBitcask(dir, store.BitcaskOptions{MaxFileSize: 512, MergeInterval: -1})
+			if err != nil {
+				t.Fatalf("OpenBitcask: %v", err)
+			}
+			return b
+		},
+		Persistent: true,
+	}.Run(t)
+}
+
+// TestLSM runs the conformance suite against the LSM engine.
+func TestLSM(t *testing.T) {
+	storetest.Suite{
+		Open: func(t *testing.T, dir string) store.Backend {
+			l, err := store.OpenLSM(dir, store.LSMOptions{MemtableSize: 512, TableSize: 256, L0Tables: 2})
+			if err != nil {
+				t.Fatalf("OpenLSM: %v", err)
+			}
+			return l
+		},
+		Persistent: true,
+	}.Run(t)
+}
+
+// TestCachedBackend runs the conformance suite against a small cache in front of Bitcask,
+// so most reads exercise eviction and reloading from disk.
+func TestCachedBackend(t *testing.T) {
+	storetest.Suite{
+		Open: func(t *testing.T, dir string) store.Backend {
+			b, err := store.OpenBitcask(dir, store.BitcaskOptions{MergeInterval: -1})
+			if err != nil {
+				t.Fatalf("OpenBitcask: %v", err)
+			}
+			return store.NewCachedBackend(b, store.CacheOptions{MaxBytes: 512, Policy: store.CacheLFU})
+		},
+		Persistent: true,
+	}.Run(t)
+}
@@ -0,0 +1,385 @@
+// Package store implements per-key expiry. A key's deadline is kept in memory for fast
+// checks and persisted in the backend under a reserved metadata key, so it survives
+// restarts, snapshots and restores along with the data. Expired keys are removed lazily
+// when they are next accessed, and in bulk by an optional background reaper.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NoExpiry is returned by TTL for keys that do not expire.
+const NoExpiry time.Duration = -1
+
+// internalKeyPrefix marks backend keys holding the store's own metadata. User keys
+// may not start with it, and it is hidden from reads and iteration.
+const internalKeyPrefix = "\x00"
+
+// ttlKeyPrefix prefixes the metadata key holding a key's expiry deadline.
+const ttlKeyPrefix = internalKeyPrefix + "ttl:"
+
+// ttlKeyEnd is the first key after every ttl metadata key.
+const ttlKeyEnd = internalKeyPrefix + "ttl;"
+
+// isInternalKey reports whether key is a metadata key rather than user data.
+func isInternalKey(key string) bool {
+	return strings.HasPrefix(key, internalKeyPrefix)
+}
+
+// ttlKey returns the metadata key holding key's deadline.
+func ttlKey(key string) string {
+	return ttlKeyPrefix + key
+}
+
+// expiryTable tracks the deadline of every key that has one.
+// Entries for a key are only changed while holding that key's write lock.
+type expiryTable struct {
+	mu        sync.Mutex
+	deadlines map[string]time.Time
+}
+
+// newExpiryTable returns an empty expiry table.
+func newExpiryTable() *expiryTable {
+	return &expiryTable{deadlines: make(map[string]time.Time)}
+}
+
+// get returns key's deadline, if it has one.
+func (t *expiryTable) get(key string) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	deadline, ok := t.deadlines[key]
+	return deadline, ok
+}
+
+// expired reports whether key has a deadline that has passed.
+func (t *expiryTable) expired(key string, now time.Time) bool {
+	deadline, ok := t.get(key)
+	return ok && !now.Before(deadline)
+}
+
+// set records key's deadline.
+func (t *expiryTable) set(key string, deadline time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.deadlines[key] = deadline
+}
+
+// remove forgets key's deadline.
+func (t *expiryTable) remove(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.deadlines, key)
+}
+
+// replace swaps in a new set of deadlines.
+func (t *expiryTable) replace(deadlines map[string]time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.deadlines = deadlines
+}
+
+// len returns the number of keys with a deadline.
+func (t *expiryTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.deadlines)
+}
+
+// due returns every key whose deadline has passed.
+func (t *expiryTable) due(now time.Time) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var keys []string
+	for key, deadline := range t.deadlines {
+		if !now.Before(deadline) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// SetWithTTL sets a key-value pair that is deleted once ttl has elapsed.
+func (s *Store) SetWithTTL(key, value string, ttl time.Duration) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return errors.New("ttl must be positive")
+	}
+
+	lock := s.locks.forKey(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := s.expireLocked(key); err != nil {
+		return err
+	}
+
+	old, exists, err := s.backend.Get(key)
+	if err != nil {
+		return fmt.Errorf("failed to read key: %w", err)
+	}
+
+	// The deadline is written in the same batch, so the value never exists without it.
+	_, err = s.put(key, value, old, exists, deadlineAfter(ttl))
+	return err
+}
+
+// Expire sets key to be deleted once ttl has elapsed, replacing any earlier deadline.
+func (s *Store) Expire(key string, ttl time.Duration) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return errors.New("ttl must be positive")
+	}
+
+	lock := s.locks.forKey(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := s.requireLocked(key); err != nil {
+		return err
+	}
+	if err := s.setDeadlineLocked(key, time.Now().Add(ttl)); err != nil {
+		return err
+	}
+	s.noteWrites(1)
+	return nil
+}
+
+// TTL returns how long key has left before it expires, or NoExpiry if it does not expire.
+func (s *Store) TTL(key string) (time.Duration, error) {
+	if err := checkKey(key); err != nil {
+		return 0, err
+	}
+
+	lock := s.locks.forKey(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := s.requireLocked(key); err != nil {
+		return 0, err
+	}
+
+	deadline, ok := s.expiries.get(key)
+	if !ok {
+		return NoExpiry, nil
+	}
+	return time.Until(deadline), nil
+}
+
+// Persist removes key's deadline so that it no longer expires.
+func (s *Store) Persist(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	lock := s.locks.forKey(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := s.requireLocked(key); err != nil {
+		return err
+	}
+	if err := s.clearDeadlineLocked(key); err != nil {
+		return err
+	}
+	s.noteWrites(1)
+	return nil
+}
+
+// ReapExpired deletes every key whose deadline has passed and returns how many were deleted.
+func (s *Store) ReapExpired() (int, error) {
+	reaped := 0
+	for _, key := range s.expiries.due(time.Now()) {
+		ok, err := s.reap(key)
+		if err != nil {
+			return reaped, err
+		}
+		if ok {
+			reaped++
+		}
+	}
+	return reaped, nil
+}
+
+// StartReaper deletes expired keys in the background every interval until the
+// returned function is called. Expired keys are hidden from reads either way;
+// the reaper only reclaims their space.
+func (s *Store) StartReaper(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := s.ReapExpired(); err != nil {
+					log.Printf("store: reaping expired keys failed: %v", err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// reapIfExpired deletes key if its deadline has passed. Readers call it before taking
+// the key's read lock; a failure is only logged, since they hide expired keys anyway.
+func (s *Store) reapIfExpired(key string) {
+	if s.readOnly || !s.expiries.expired(key, time.Now()) {
+		return
+	}
+	if _, err := s.reap(key); err != nil {
+		log.Printf("store: removing expired key %q failed: %v", key, err)
+	}
+}
+
+// reap deletes key if it has expired and reports whether it did.
+func (s *Store) reap(key string) (bool, error) {
+	lock := s.locks.forKey(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if !s.expiries.expired(key, time.Now()) {
+		return false, nil
+	}
+	if err := s.expireLocked(key); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// expireLocked deletes key and its deadline if the deadline has passed.
+// The caller must hold the key's write lock.
+func (s *Store) expireLocked(key string) error {
+	if !s.expiries.expired(key, time.Now()) {
+		return nil
+	}
+
+	old, exists, err := s.backend.Get(key)
+	if err != nil {
+		return fmt.Errorf("failed to read key: %w", err)
+	}
+	if exists {
+		if err := s.remove(key, old); err != nil {
+			return err
+		}
+	}
+	return s.clearDeadlineLocked(key)
+}
+
+// requireLocked returns an error unless key exists and has not expired. An expired key
+// is deleted, unless the store is read-only: it is then only reported as not found.
+// The caller must hold the key's write lock.
+func (s *Store) requireLocked(key string) error {
+	if s.readOnly {
+		if s.expiries.expired(key, time.Now()) {
+			return ErrKeyNotFound
+		}
+	} else if err := s.expireLocked(key); err != nil {
+		return err
+	}
+
+	_, exists, err := s.backend.Get(key)
+	if err != nil {
+		return fmt.Errorf("failed to read key: %w", err)
+	}
+	if !exists {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// deadlineAfter returns the deadline ttl from now, or the zero time for a zero ttl.
+func deadlineAfter(ttl time.Duration) time.Time {
+	if ttl == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// formatDeadline encodes a deadline for storage in the backend.
+func formatDeadline(deadline time.Time) string {
+	return deadline.UTC().Format(`"` + time.RFC3339Nano + `"`)
+}
+
+// setDeadlineLocked persists and records key's deadline.
+// The caller must hold the key's write lock.
+func (s *Store) setDeadlineLocked(key string, deadline time.Time) error {
+	if err := s.writable(); err != nil {
+		return err
+	}
+	if err := s.backend.Put(ttlKey(key), formatDeadline(deadline)); err != nil {
+		return fmt.Errorf("failed to store ttl: %w", err)
+	}
+	s.expiries.set(key, deadline)
+	return nil
+}
+
+// clearDeadlineLocked removes key's deadline, if it has one.
+// The caller must hold the key's write lock.
+func (s *Store) clearDeadlineLocked(key string) error {
+	if _, ok := s.expiries.get(key); !ok {
+		return nil
+	}
+	if err := s.writable(); err != nil {
+		return err
+	}
+	if err := s.backend.Delete(ttlKey(key)); err != nil {
+		return fmt.Errorf("failed to remove ttl: %w", err)
+	}
+	s.expiries.remove(key)
+	return nil
+}
+
+// loadExpiriesLocked rebuilds the in-memory deadlines from the metadata in the backend.
+// The caller must hold every stripe's write lock.
+func (s *Store) loadExpiriesLocked() error {
+	deadlines := make(map[string]time.Time)
+	collect := func(key, value string) bool {
+		if !strings.HasPrefix(key, ttlKeyPrefix) {
+			return true
+		}
+		deadline, err := time.Parse(`"`+time.RFC3339Nano+`"`, value)
+		if err != nil {
+			log.Printf("store: ignoring unreadable ttl for %q: %v", strings.TrimPrefix(key, ttlKeyPrefix), err)
+			return true
+		}
+		deadlines[strings.TrimPrefix(key, ttlKeyPrefix)] = deadline
+		return true
+	}
+
+	// Backends with sorted keys can visit just the metadata instead of every key.
+	var err error
+	if r, ok := s.backend.(RangeIterator); ok {
+		err = r.Range(ttlKeyPrefix, ttlKeyEnd, collect)
+	} else {
+		err = s.backend.Iterate(collect)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load ttls: %w", err)
+	}
+
+	s.expiries.replace(deadlines)
+	return nil
+}
@@ -0,0 +1,235 @@
+// Package store implements multi-key transactions. A transaction runs with every lock
+// stripe held, so it is serialised against all other operations; its writes are
+// buffered and applied together on commit, as one backend batch and one revision.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ErrTxnDone is returned when a Tx is used after its transaction has finished.
+var ErrTxnDone = errors.New("transaction has already finished")
+
+// txnWrite is a buffered write to one key.
+type txnWrite struct {
+	value   string // New value; ignored for deletes
+	deleted bool   // Whether the key is deleted
+	keepTTL bool   // Whether the key keeps its existing deadline (Update)
+}
+
+// Tx is a transaction in progress. Reads see the transaction's own writes; nothing is
+// visible to other callers until the transaction commits.
+type Tx struct {
+	store  *Store
+	now    time.Time            // Time expiry is judged against, fixed for the transaction
+	writes map[string]*txnWrite // Buffered writes by key
+	done   bool                 // Set once the transaction commits or rolls back
+}
+
+// Txn runs fn in a transaction. If fn returns nil, its writes are committed atomically;
+// if it returns an error or panics, they are discarded and the error is returned.
+// fn must only use tx, not the Store, which is locked for the duration.
+func (s *Store) Txn(fn func(tx *Tx) error) error {
+	s.locks.lockAll()
+	defer s.locks.unlockAll()
+
+	tx := &Tx{store: s, now: time.Now(), writes: make(map[string]*txnWrite)}
+	defer func() { tx.done = true }()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// Get returns the value of key as seen by the transaction.
+func (tx *Tx) Get(key string) (string, bool, error) {
+	if tx.done {
+		return "", false, ErrTxnDone
+	}
+	if isInternalKey(key) {
+		return "", false, nil
+	}
+	if w, ok := tx.writes[key]; ok {
+		return w.value, !w.deleted, nil
+	}
+	if tx.store.expiries.expired(key, tx.now) {
+		return "", false, nil
+	}
+
+	value, exists, err := tx.store.backend.Get(key)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read key: %w", err)
+	}
+	return value, exists, nil
+}
+
+// Read retrieves the value for a given key, like Store.Read.
+func (tx *Tx) Read(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+
+	value, exists, err := tx.Get(key)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", ErrKeyNotFound
+	}
+	return value, nil
+}
+
+// Create adds a new key-value pair, like Store.Create.
+func (tx *Tx) Create(key, value string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	_, exists, err := tx.Get(key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrKeyExists
+	}
+
+	if !isValidJSON(value) {
+		return errors.New("invalid JSON format")
+	}
+
+	tx.writes[key] = &txnWrite{value: value}
+	return nil
+}
+
+// Update modifies the value for a given key, like Store.Update.
+func (tx *Tx) Update(key, value string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	_, exists, err := tx.Get(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrKeyNotFound
+	}
+
+	if !isValidJSON(value) {
+		return errors.New("invalid JSON format")
+	}
+
+	// Keep the TTL unless an earlier write in this transaction already dropped it.
+	keepTTL := true
+	if w, ok := tx.writes[key]; ok {
+		keepTTL = w.keepTTL
+	}
+	tx.writes[key] = &txnWrite{value: value, keepTTL: keepTTL}
+	return nil
+}
+
+// Set sets a key-value pair, like Store.Set.
+func (tx *Tx) Set(key, value string) error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	tx.writes[key] = &txnWrite{value: value}
+	return nil
+}
+
+// Delete removes a key-value pair, like Store.Delete.
+func (tx *Tx) Delete(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	_, exists, err := tx.Get(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrKeyNotFound
+	}
+
+	tx.writes[key] = &txnWrite{deleted: true}
+	return nil
+}
+
+// commit applies the buffered writes as a single batch and revision.
+// The caller must hold every stripe's write lock.
+func (tx *Tx) commit() error {
+	if len(tx.writes) == 0 {
+		return nil
+	}
+	s := tx.store
+	if err := s.writable(); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(tx.writes))
+	for key := range tx.writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Record what each key held before, for the version log.
+	old := make(map[string]string)
+	var created []string
+	for _, key := range keys {
+		value, exists, err := s.backend.Get(key)
+		if err != nil {
+			return fmt.Errorf("failed to read key: %w", err)
+		}
+		if exists {
+			old[key] = value
+		} else {
+			created = append(created, key)
+		}
+	}
+
+	// Deadlines are dropped in the same batch as the writes that end them; an expired
+	// key's deadline always goes, since the transaction treated the key as absent.
+	// Every key written gets the commit's revision as its version.
+	rev := s.versions.next()
+	var ops []BatchOp
+	var cleared []string
+	for _, key := range keys {
+		w := tx.writes[key]
+		if _, hasTTL := s.expiries.get(key); hasTTL && (!w.keepTTL || s.expiries.expired(key, tx.now)) {
+			ops = append(ops, BatchOp{Key: ttlKey(key), Delete: true})
+			cleared = append(cleared, key)
+		}
+		if w.deleted {
+			ops = append(ops, BatchOp{Key: key, Delete: true}, BatchOp{Key: versionKey(key), Delete: true})
+		} else {
+			ops = append(ops, BatchOp{Key: versionKey(key), Value: formatRevision(rev)}, BatchOp{Key: key, Value: w.value})
+		}
+		history, err := s.historyOps(key, rev, w.value, w.deleted, tx.now)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, history...)
+	}
+
+	if err := writeBatchAt(s.backend, rev, ops); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	for _, key := range cleared {
+		s.expiries.remove(key)
+	}
+	for _, key := range keys {
+		s.recordHistory(key, rev)
+		s.indexes.update(key, tx.writes[key].value, tx.writes[key].deleted)
+	}
+	s.versions.recordAll(old, created, rev)
+	s.noteWrites(len(keys))
+	return nil
+}
@@ -26,6 +26,10 @@ func ValidateKey(key string) error {
 		return errors.New("key cannot be empty") // Reject empty keys
 	}
 
+	if isInternalKey(key) {
+		return errReservedKey // Reserved for the store's own metadata
+	}
+
 	if len(key) > 256 {
 		return errors.New("key length exceeds 256 characters") // Enforce max length
 	}
@@ -0,0 +1,260 @@
+// Package store implements per-key versions for optimistic concurrency. A key's version
+// is the revision of the last write to it, persisted beside the value under a reserved
+// metadata key. Versions survive restarts and are never reused, even by a key that is
+// deleted and created again, so a client can read a key with its version and make its
+// write conditional on nobody having written the key in the meantime.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AnyVersion matches whatever version a key has. Conditional writes given it only
+// require the key to exist.
+const AnyVersion uint64 = math.MaxUint64
+
+// ErrVersionMismatch is returned by a conditional write when the key has been written
+// since the expected version was read.
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// versionKeyPrefix prefixes the metadata key holding a key's version.
+const versionKeyPrefix = internalKeyPrefix + "ver:"
+
+// versionKeyEnd is the first key after every version metadata key.
+const versionKeyEnd = internalKeyPrefix + "ver;"
+
+// revisionKey is the metadata key holding the latest revision handed out, so revisions
+// keep increasing across restarts even after the keys written last are deleted. It is
+// not written with every batch where the backend can avoid it; see RevisionBatchWriter.
+const revisionKey = internalKeyPrefix + "rev"
+
+// versionKey returns the metadata key holding key's version.
+func versionKey(key string) string {
+	return versionKeyPrefix + key
+}
+
+// formatRevision encodes a revision for storage in the backend.
+func formatRevision(rev uint64) string {
+	return strconv.FormatUint(rev, 10)
+}
+
+// ReadVersion retrieves the value for a given key along with its version, which can be
+// passed to CompareAndSwap or DeleteIfVersion. Keys written before versions were tracked
+// have version 0 until they are next written.
+func (s *Store) ReadVersion(key string) (string, uint64, error) {
+	s.reapIfExpired(key)
+
+	lock := s.locks.forKey(key)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	if err := checkKey(key); err != nil {
+		return "", 0, err
+	}
+
+	value, exists, err := s.backend.Get(key)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read key: %w", err)
+	}
+	if !exists || s.expiries.expired(key, time.Now()) {
+		return "", 0, ErrKeyNotFound
+	}
+
+	version, err := s.versionLocked(key)
+	if err != nil {
+		return "", 0, err
+	}
+	return value, version, nil
+}
+
+// CreateIfAbsent adds a new key-value pair and returns its version. It returns
+// ErrKeyExists if the key is already present.
+func (s *Store) CreateIfAbsent(key, value string) (uint64, error) {
+	return s.CreateWithTTL(key, value, 0)
+}
+
+// CreateWithTTL adds a new key-value pair that is deleted once ttl has elapsed, and
+// returns its version. The value and its deadline are written in one batch, so the key
+// never exists without its TTL. A zero ttl creates a key that does not expire.
+func (s *Store) CreateWithTTL(key, value string, ttl time.Duration) (uint64, error) {
+	if ttl < 0 {
+		return 0, errors.New("ttl must be positive")
+	}
+
+	lock := s.locks.forKey(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := checkKey(key); err != nil {
+		return 0, err
+	}
+	if err := s.expireLocked(key); err != nil {
+		return 0, err
+	}
+
+	_, exists, err := s.backend.Get(key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read key: %w", err)
+	}
+	if exists {
+		return 0, ErrKeyExists
+	}
+
+	if !isValidJSON(value) {
+		return 0, errors.New("invalid JSON format")
+	}
+
+	// Drop a deadline left behind by a crash during an earlier delete.
+	if err := s.clearDeadlineLocked(key); err != nil {
+		return 0, err
+	}
+	return s.put(key, value, "", false, deadlineAfter(ttl))
+}
+
+// CompareAndSwap replaces the value of key, provided the key is still at
+// expectedVersion, and returns the new version. It returns ErrVersionMismatch if the
+// key has been written since; AnyVersion skips the check. The key keeps its TTL.
+func (s *Store) CompareAndSwap(key string, expectedVersion uint64, value string) (uint64, error) {
+	return s.CompareAndSwapWithTTL(key, expectedVersion, value, 0)
+}
+
+// CompareAndSwapWithTTL is CompareAndSwap that also gives key a new deadline, ttl from
+// now, written in the same batch as the value. A zero ttl keeps the key's current TTL.
+func (s *Store) CompareAndSwapWithTTL(key string, expectedVersion uint64, value string, ttl time.Duration) (uint64, error) {
+	if ttl < 0 {
+		return 0, errors.New("ttl must be positive")
+	}
+
+	lock := s.locks.forKey(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := checkKey(key); err != nil {
+		return 0, err
+	}
+	if err := s.expireLocked(key); err != nil {
+		return 0, err
+	}
+
+	old, exists, err := s.backend.Get(key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read key: %w", err)
+	}
+	if !exists {
+		return 0, ErrKeyNotFound
+	}
+	if err := s.checkVersionLocked(key, expectedVersion); err != nil {
+		return 0, err
+	}
+
+	if !isValidJSON(value) {
+		return 0, errors.New("invalid JSON format")
+	}
+
+	return s.put(key, value, old, true, deadlineAfter(ttl))
+}
+
+// DeleteIfVersion removes key, provided it is still at expectedVersion. It returns
+// ErrVersionMismatch if the key has been written since; AnyVersion skips the check.
+func (s *Store) DeleteIfVersion(key string, expectedVersion uint64) error {
+	lock := s.locks.forKey(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if err := s.expireLocked(key); err != nil {
+		return err
+	}
+
+	old, exists, err := s.backend.Get(key)
+	if err != nil {
+		return fmt.Errorf("failed to read key: %w", err)
+	}
+	if !exists {
+		return ErrKeyNotFound
+	}
+	if err := s.checkVersionLocked(key, expectedVersion); err != nil {
+		return err
+	}
+
+	if err := s.remove(key, old); err != nil {
+		return err
+	}
+	return s.clearDeadlineLocked(key)
+}
+
+// versionLocked returns key's persisted version, or 0 if it has none.
+// The caller must hold the key's lock.
+func (s *Store) versionLocked(key string) (uint64, error) {
+	raw, ok, err := s.backend.Get(versionKey(key))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read version: %w", err)
+	}
+	if !ok {
+		return 0, nil
+	}
+	version, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse version of %q: %w", key, err)
+	}
+	return version, nil
+}
+
+// checkVersionLocked returns ErrVersionMismatch unless key is at expected.
+// The caller must hold the key's lock.
+func (s *Store) checkVersionLocked(key string, expected uint64) error {
+	if expected == AnyVersion {
+		return nil
+	}
+	current, err := s.versionLocked(key)
+	if err != nil {
+		return err
+	}
+	if current != expected {
+		return fmt.Errorf("%w: key %q is at version %d, not %d", ErrVersionMismatch, key, current, expected)
+	}
+	return nil
+}
+
+// loadRevisionLocked returns the latest revision recorded in the backend: the persisted
+// revision counter or the newest key version, whichever is later.
+// The caller must hold every stripe's write lock.
+func (s *Store) loadRevisionLocked() (uint64, error) {
+	var latest uint64
+	var parseErr error
+	collect := func(key, value string) bool {
+		if key != revisionKey && !strings.HasPrefix(key, versionKeyPrefix) {
+			return true
+		}
+		rev, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			parseErr = fmt.Errorf("failed to parse revision in %q: %w", key, err)
+			return false
+		}
+		latest = max(latest, rev)
+		return true
+	}
+
+	// Backends with sorted keys can visit just the metadata instead of every key; the
+	// revision counter sorts before the version keys.
+	var err error
+	if r, ok := s.backend.(RangeIterator); ok {
+		err = r.Range(revisionKey, versionKeyEnd, collect)
+	} else {
+		err = s.backend.Iterate(collect)
+	}
+	if err == nil {
+		err = parseErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to load revision: %w", err)
+	}
+	return latest, nil
+}
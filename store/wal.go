@@ -0,0 +1,251 @@
+// Package store implements a write-ahead log so that writes made between snapshots survive a crash.
+// Every mutation is appended to the log and fsync'd before it is applied to the in-memory data.
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Operations recorded in the write-ahead log.
+const (
+	walOpSet    = "set"
+	walOpDelete = "delete"
+	walOpClear  = "clear"
+	walOpBatch  = "batch" // Several sets and deletes applied together
+)
+
+// walRecord is a single logged mutation.
+type walRecord struct {
+	Op    string      `json:"op"`
+	Key   string      `json:"key,omitempty"`
+	Value string      `json:"value,omitempty"`
+	Batch []walRecord `json:"batch,omitempty"` // Records of a walOpBatch, which replays all or nothing
+	Rev   uint64      `json:"rev,omitempty"`   // Store revision a walOpBatch commits; see WriteBatchAt
+}
+
+// writeAheadLog appends records to a file, one per line, each prefixed with the
+// hex-encoded CRC-32 of the JSON that follows it. A torn or corrupt tail left by a
+// crash is detected by the checksum and discarded on replay. With encryption, the
+// JSON is sealed and written as '!' followed by its base64 encoding.
+type writeAheadLog struct {
+	path     string   // Location of the log file
+	keys     *Keyring // Encryption keys for records; nil writes plain JSON
+	file     *os.File // Opened lazily on the first append
+	records  int      // Records appended since the log was last truncated
+	readOnly bool     // Whether replay leaves a torn tail in place instead of truncating it
+}
+
+// newWAL returns a write-ahead log backed by the file at path, encrypting records
+// under keys if it is set.
+func newWAL(path string, keys *Keyring) *writeAheadLog {
+	return &writeAheadLog{path: path, keys: keys}
+}
+
+// open opens the log file for appending, creating it if necessary.
+func (w *writeAheadLog) open() error {
+	if w.file != nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(w.path), 0755); err != nil {
+		return fmt.Errorf("failed to create directories: %w", err)
+	}
+
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open write-ahead log: %w", err)
+	}
+	w.file = file
+	return nil
+}
+
+// append durably writes a record to the log. It returns only after the record has been fsync'd.
+func (w *writeAheadLog) append(rec walRecord) error {
+	if err := w.open(); err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode log record: %w", err)
+	}
+	if w.keys != nil {
+		sealed, err := w.keys.seal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt log record: %w", err)
+		}
+		payload = append([]byte{walSealedMark}, base64.StdEncoding.EncodeToString(sealed)...)
+	}
+
+	line := make([]byte, 0, len(payload)+10)
+	line = fmt.Appendf(line, "%08x ", crc32.ChecksumIEEE(payload))
+	line = append(line, payload...)
+	line = append(line, '\n')
+
+	if _, err := w.file.Write(line); err != nil {
+		return fmt.Errorf("failed to write log record: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync write-ahead log: %w", err)
+	}
+
+	w.records++
+	return nil
+}
+
+// replay calls apply for every intact record in the log, in the order they were written.
+// Replay stops at the first torn or corrupt record, and the log is truncated there so that
+// later appends do not end up behind unreadable bytes.
+func (w *writeAheadLog) replay(apply func(walRecord)) error {
+	flag := os.O_RDWR
+	if w.readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(w.path, flag, 0644)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open write-ahead log: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var good int64 // Offset just past the last intact record
+	count := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break // A partial final line without a newline is a torn write
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read write-ahead log: %w", err)
+		}
+
+		rec, ok, err := decodeWALLine(line, w.keys)
+		if err != nil {
+			return fmt.Errorf("failed to replay write-ahead log: %w", err)
+		}
+		if !ok {
+			break
+		}
+		apply(rec)
+		good += int64(len(line))
+		count++
+	}
+
+	if w.readOnly {
+		w.records = count
+		return nil
+	}
+	if err := file.Truncate(good); err != nil {
+		return fmt.Errorf("failed to truncate write-ahead log: %w", err)
+	}
+	w.records = count
+	return nil
+}
+
+// walSealedMark starts the payload of an encrypted log record.
+const walSealedMark = '!'
+
+// decodeWALLine parses and verifies a single log line. A line that fails its checksum
+// is reported as not ok; one that passes but cannot be decrypted is an error, since
+// it is intact and must not be discarded as a torn write.
+func decodeWALLine(line []byte, keys *Keyring) (walRecord, bool, error) {
+	var rec walRecord
+
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	sum, payload, found := bytes.Cut(line, []byte(" "))
+	if !found || len(sum) != 8 {
+		return rec, false, nil
+	}
+
+	want, err := hex.DecodeString(string(sum))
+	if err != nil {
+		return rec, false, nil
+	}
+	got := crc32.ChecksumIEEE(payload)
+	if binary.BigEndian.Uint32(want) != got {
+		return rec, false, nil
+	}
+
+	if len(payload) > 0 && payload[0] == walSealedMark {
+		sealed, err := base64.StdEncoding.DecodeString(string(payload[1:]))
+		if err != nil || !isEncrypted(sealed) {
+			return rec, false, nil
+		}
+		if keys == nil {
+			return rec, false, ErrNoKeys
+		}
+		if payload, err = keys.open(sealed); err != nil {
+			return rec, false, err
+		}
+	}
+
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return rec, false, nil
+	}
+	return rec, true, nil
+}
+
+// truncate empties the log once its records have been folded into a snapshot.
+func (w *writeAheadLog) truncate() error {
+	if w.file == nil {
+		err := os.Truncate(w.path, 0)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to truncate write-ahead log: %w", err)
+		}
+		w.records = 0
+		return nil
+	}
+
+	if err := w.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate write-ahead log: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync write-ahead log: %w", err)
+	}
+	w.records = 0
+	return nil
+}
+
+// setAside moves the log's records to a file beside it, <log>.orphaned-<time>, and
+// empties the log. It returns that file's path, or an empty path if the log held
+// nothing.
+func (w *writeAheadLog) setAside() (string, error) {
+	raw, err := os.ReadFile(w.path)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && len(raw) == 0) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read write-ahead log: %w", err)
+	}
+
+	aside := fmt.Sprintf("%s.orphaned-%s", w.path, time.Now().UTC().Format("20060102T150405"))
+	if err := writeFileAtomic(aside, raw); err != nil {
+		return "", fmt.Errorf("failed to set aside write-ahead log: %w", err)
+	}
+	return aside, w.truncate()
+}
+
+// close releases the log file handle.
+func (w *writeAheadLog) close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}